@@ -1,5 +1,69 @@
 package main
- 
+
+import (
+	"flag"
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"github.com/brettcannon/kinesis-experiment/kinesisfake"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const usage = `usage: kinesis-experiment serve-local [flags]
+
+serve-local runs a local Kinesis that the SDK client reaches by setting
+aws.Config.Endpoint to its address, with any credentials and region. Streams
+are kept in memory unless -dir names a directory to save them in, in which case
+they are there again, records and all, when the server is restarted.
+`
+
 func main() {
-    // This space intentially left blank.
+	if len(os.Args) < 2 || os.Args[1] != "serve-local" {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err := serveLocal(os.Args[2:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serveLocal serves a kinesisfake.Kinesis over HTTP until the process is stopped.
+func serveLocal(args []string) error {
+	flags := flag.NewFlagSet("serve-local", flag.ExitOnError)
+	addr := flags.String("addr", "localhost:4567", "address to listen on")
+	streams := flags.String("streams", "", "streams to create at start unless they exist, as comma-separated name:shards pairs")
+	dir := flags.String("dir", "", "directory to save streams in, instead of memory")
+	retention := flags.Duration("retention", kinesisfake.DefaultRetention, "how long records are kept")
+	flags.Parse(args)
+
+	k, err := kinesisfake.Open(kinesisfake.Config{Dir: *dir, Retention: *retention})
+	if err != nil {
+		return err
+	}
+	defer k.Close()
+	for _, s := range strings.Split(*streams, ",") {
+		if s == "" {
+			continue
+		}
+		i := strings.LastIndex(s, ":")
+		if i < 0 {
+			return fmt.Errorf("stream %q is not name:shards", s)
+		}
+		shards, err := strconv.ParseInt(s[i+1:], 10, 64)
+		if err != nil {
+			return fmt.Errorf("stream %q is not name:shards", s)
+		}
+		if _, err := k.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String(s[:i]), ShardCount: aws.Long(shards)}); err != nil {
+			// A saved stream is kept as it is.
+			if aerr := aws.Error(err); aerr == nil || aerr.Code != "ResourceInUseException" {
+				return err
+			}
+		}
+	}
+	log.Printf("serving Kinesis on http://%s", *addr)
+	return http.ListenAndServe(*addr, kinesisfake.NewHandler(k))
 }
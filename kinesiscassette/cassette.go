@@ -0,0 +1,170 @@
+// Package kinesiscassette records the HTTP interactions of a Kinesis client into a cassette and replays them.
+//
+// Record captures every request the SDK client sends, with its response, from the client's Send handlers, so a
+// client in production can keep the exact DescribeStream pages, PutRecords results and error responses behind an
+// incident. Credentials are redacted before anything is kept. Replay swaps the Send handlers of another client for
+// the cassette, which answers the calls made through it without a network, the same way every run.
+package kinesiscassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// redacted replaces the values of the headers in redactedHeaders.
+const redacted = "REDACTED"
+
+// redactedHeaders are the request headers that carry credentials.
+var redactedHeaders = []string{"Authorization", "X-Amz-Security-Token"}
+
+// Cassette is a recording of the HTTP interactions of a Kinesis client, in the order they took place.
+type Cassette struct {
+	Interactions []*Interaction `json:"interactions"`
+}
+
+// Interaction is one request and what came back for it: a response or, when the request never got one, the
+// error of the HTTP client.
+type Interaction struct {
+	// Operation is the Kinesis operation called, such as "PutRecords".
+	Operation string    `json:"operation"`
+	Request   *Request  `json:"request"`
+	Response  *Response `json:"response,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Request is a recorded HTTP request.
+type Request struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"`
+}
+
+// Response is a recorded HTTP response.
+type Response struct {
+	StatusCode int         `json:"statusCode"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body"`
+}
+
+// Load reads the cassette saved at path.
+func Load(path string) (*Cassette, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Cassette
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Save writes the cassette to path.
+func (c *Cassette) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// operation returns the Kinesis operation a request calls, taken from its X-Amz-Target header.
+func operation(header http.Header) string {
+	target := header.Get("X-Amz-Target")
+	return target[strings.LastIndex(target, ".")+1:]
+}
+
+// Recorder records the interactions of a Kinesis client.
+type Recorder struct {
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+// Record starts recording the interactions of c. Its Send handlers are wrapped, so they must be set up already;
+// each attempt the client makes at a call is recorded, retries included.
+func Record(c *kinesis.Kinesis) *Recorder {
+	rec := &Recorder{}
+	send := c.Handlers.Send
+	c.Handlers.Send.Clear()
+	c.Handlers.Send.PushBack(func(r *aws.Request) {
+		body := readRequestBody(r)
+		send.Run(r)
+		rec.add(r, body)
+	})
+	return rec
+}
+
+// Cassette returns a copy of the interactions recorded so far.
+func (rec *Recorder) Cassette() *Cassette {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return &Cassette{Interactions: append([]*Interaction(nil), rec.cassette.Interactions...)}
+}
+
+// Save writes the interactions recorded so far to a cassette at path.
+func (rec *Recorder) Save(path string) error {
+	return rec.Cassette().Save(path)
+}
+
+// add records the interaction of r, which was sent with body.
+func (rec *Recorder) add(r *aws.Request, body []byte) {
+	header := cloneHeader(r.HTTPRequest.Header)
+	for _, k := range redactedHeaders {
+		if header.Get(k) != "" {
+			header.Set(k, redacted)
+		}
+	}
+	i := &Interaction{
+		Operation: operation(header),
+		Request:   &Request{Method: r.HTTPRequest.Method, URL: r.HTTPRequest.URL.String(), Header: header, Body: string(body)},
+	}
+	if r.HTTPResponse != nil {
+		i.Response = &Response{StatusCode: r.HTTPResponse.StatusCode, Header: cloneHeader(r.HTTPResponse.Header), Body: string(readResponseBody(r))}
+	} else if r.Error != nil {
+		i.Error = r.Error.Error()
+		if e, ok := r.Error.(*url.Error); ok {
+			i.Error = e.Err.Error()
+		}
+	}
+	rec.mu.Lock()
+	rec.cassette.Interactions = append(rec.cassette.Interactions, i)
+	rec.mu.Unlock()
+}
+
+// readRequestBody returns the body r is about to send, leaving it to be sent.
+func readRequestBody(r *aws.Request) []byte {
+	if r.Body == nil {
+		return nil
+	}
+	start, err := r.Body.Seek(0, 1)
+	if err != nil {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	r.Body.Seek(start, 0)
+	return body
+}
+
+// readResponseBody returns the body of the response to r, leaving it to be read again.
+func readResponseBody(r *aws.Request) []byte {
+	body, _ := ioutil.ReadAll(r.HTTPResponse.Body)
+	r.HTTPResponse.Body.Close()
+	r.HTTPResponse.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
@@ -0,0 +1,134 @@
+package kinesiscassette
+
+import (
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"github.com/brettcannon/kinesis-experiment/kinesisfake"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// outcome is what a call returned, kept comparable between recording and replaying.
+type outcome struct {
+	out  interface{}
+	code string
+	err  string
+}
+
+// calls makes the same calls against c whether it is recorded or replayed; stop, when set, is called before the
+// last one, which then fails to connect.
+func calls(t *testing.T, c *kinesis.Kinesis, stop func()) []outcome {
+	var got []outcome
+	add := func(out interface{}, err error) {
+		o := outcome{out: out}
+		if e := aws.Error(err); e != nil {
+			o.out, o.code = nil, e.Code
+		} else if e, ok := err.(*url.Error); ok {
+			o.out, o.err = nil, e.Err.Error()
+		} else if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		got = append(got, o)
+	}
+	add(c.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String("s"), ShardCount: aws.Long(2)}))
+	add(c.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String("s")}))
+	add(c.PutRecords(&kinesis.PutRecordsInput{StreamName: aws.String("s"), Records: []*kinesis.PutRecordsRequestEntry{
+		{PartitionKey: aws.String("a"), Data: []byte("1")},
+		{PartitionKey: aws.String("b"), Data: []byte("2")},
+	}}))
+	add(c.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String("missing")}))
+	if stop != nil {
+		stop()
+	}
+	add(c.ListStreams(&kinesis.ListStreamsInput{}))
+	return got
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cassette")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cassette.json")
+
+	server := httptest.NewServer(kinesisfake.NewHandler(kinesisfake.New()))
+	c := kinesisfake.NewClient(server.URL)
+	rec := Record(c)
+	recorded := calls(t, c, server.Close)
+	if err := rec.Save(path); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if recorded[3].code != "ResourceNotFoundException" || recorded[4].err == "" {
+		t.Fatalf("expected an error response and a failed connection to be recorded, were %+v", recorded[3:])
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if strings.Contains(string(data), "Credential=") || !strings.Contains(string(data), redacted) {
+		t.Errorf("expected the credentials to be redacted")
+	}
+
+	cassette, err := Load(path)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(cassette.Interactions) != 5 || cassette.Interactions[2].Operation != "PutRecords" {
+		t.Fatalf("expected the 5 calls in order, were %+v", cassette.Interactions)
+	}
+	for i := 0; i < 2; i++ {
+		replay, p := NewClient(cassette)
+		if replayed := calls(t, replay, nil); !reflect.DeepEqual(recorded, replayed) {
+			t.Errorf("expected the replay to return\n%+v\nwas\n%+v", recorded, replayed)
+		}
+		if err := p.Check(); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+}
+
+func TestReplayChecksCalls(t *testing.T) {
+	cassette := &Cassette{Interactions: []*Interaction{
+		{Operation: "ListStreams", Response: &Response{StatusCode: 200, Body: `{"HasMoreStreams":false,"StreamNames":["a"]}`}},
+		{Operation: "ListStreams", Response: &Response{StatusCode: 200, Body: `{"HasMoreStreams":false,"StreamNames":["b"]}`}},
+	}}
+	c, p := NewClient(cassette)
+	out, err := c.ListStreams(&kinesis.ListStreamsInput{})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if *out.StreamNames[0] != "a" {
+		t.Errorf("expected the first interaction to be played first, was %s", *out.StreamNames[0])
+	}
+	if err := p.Check(); err == nil || !strings.Contains(err.Error(), "1 ListStreams") {
+		t.Errorf("expected an interaction not to have been played, was %v", err)
+	}
+	if _, err := c.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String("s")}); err == nil {
+		t.Errorf("expected a call without an interaction to fail")
+	}
+	if err := p.Check(); err == nil || !strings.Contains(err.Error(), "DescribeStream") {
+		t.Errorf("expected the call without an interaction to be reported, was %v", err)
+	}
+}
+
+func TestReplayRetriesServerErrors(t *testing.T) {
+	cassette := &Cassette{Interactions: []*Interaction{
+		{Operation: "ListStreams", Response: &Response{StatusCode: 500, Body: `{"__type":"InternalFailure"}`}},
+		{Operation: "ListStreams", Response: &Response{StatusCode: 200, Body: `{"HasMoreStreams":false,"StreamNames":["a"]}`}},
+	}}
+	c, p := NewClient(cassette)
+	if _, err := c.ListStreams(&kinesis.ListStreamsInput{}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := p.Check(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
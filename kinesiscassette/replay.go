@@ -0,0 +1,95 @@
+package kinesiscassette
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/aws/credentials"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Player answers the calls of a Kinesis client from a cassette.
+//
+// The interactions of each operation are played in the order they were recorded, whatever the requests hold, so
+// a cassette replays the same way as long as the calls of each operation come in the same order. A call with no
+// interaction left fails.
+type Player struct {
+	mu sync.Mutex
+	// queues holds the interactions of each operation still to be played.
+	queues map[string][]*Interaction
+	// unexpected lists the calls that found no interaction to play.
+	unexpected []string
+}
+
+// Replay makes the cassette answer every call made through c, in place of Kinesis.
+func Replay(c *kinesis.Kinesis, cassette *Cassette) *Player {
+	p := &Player{queues: make(map[string][]*Interaction)}
+	for _, i := range cassette.Interactions {
+		p.queues[i.Operation] = append(p.queues[i.Operation], i)
+	}
+	c.Handlers.Send.Clear()
+	c.Handlers.Send.PushBack(p.send)
+	return p
+}
+
+// NewClient returns an SDK client that replays cassette, with made up credentials and region. Like a client
+// made with the default configuration, it retries throttled calls and 5xx responses.
+func NewClient(cassette *Cassette) (*kinesis.Kinesis, *Player) {
+	c := kinesis.New(&aws.Config{
+		Credentials: credentials.NewStaticCredentials("cassette", "cassette", ""),
+		Region:      "us-east-1",
+		MaxRetries:  aws.DEFAULT_RETRIES,
+	})
+	return c, Replay(c, cassette)
+}
+
+// Check reports calls that found no interaction to play and interactions that were never played.
+func (p *Player) Check() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.unexpected) > 0 {
+		return fmt.Errorf("cassette had no interaction left for %d calls, the first to %s", len(p.unexpected), p.unexpected[0])
+	}
+	for op, queue := range p.queues {
+		if len(queue) > 0 {
+			return fmt.Errorf("cassette has %d %s interactions that were not played", len(queue), op)
+		}
+	}
+	return nil
+}
+
+func (p *Player) send(r *aws.Request) {
+	op := operation(r.HTTPRequest.Header)
+	p.mu.Lock()
+	queue := p.queues[op]
+	if len(queue) == 0 {
+		p.unexpected = append(p.unexpected, op)
+		p.mu.Unlock()
+		r.Error = fmt.Errorf("cassette has no %s interaction left", op)
+		return
+	}
+	i := queue[0]
+	p.queues[op] = queue[1:]
+	p.mu.Unlock()
+
+	if i.Response == nil {
+		r.Error = &url.Error{Op: r.HTTPRequest.Method, URL: r.HTTPRequest.URL.String(), Err: errors.New(i.Error)}
+		return
+	}
+	r.HTTPResponse = &http.Response{
+		Status:        fmt.Sprintf("%d %s", i.Response.StatusCode, http.StatusText(i.Response.StatusCode)),
+		StatusCode:    i.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        cloneHeader(i.Response.Header),
+		Body:          ioutil.NopCloser(bytes.NewReader([]byte(i.Response.Body))),
+		ContentLength: int64(len(i.Response.Body)),
+		Request:       r.HTTPRequest,
+	}
+}
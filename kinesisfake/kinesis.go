@@ -0,0 +1,355 @@
+// Package kinesisfake is an in-memory Kinesis for tests. It keeps real state behind the whole of
+// kinesisiface.KinesisAPI: records are routed to shards by the MD5 hash of their partition key or by their
+// explicit hash key, get sequence numbers that grow across the stream and are read back through shard iterators,
+// and shards split and merge the way Kinesis does it, closing the parents and opening children.
+//
+// Resharding and stream creation and deletion take effect at once, so streams are always ACTIVE. No throughput
+// limits are enforced. Records are trimmed once they are older than the retention period.
+//
+// Open keeps the streams in a directory instead of memory, so that they survive a restart: each shard appends
+// its records to segment files, indexed by sequence number, and deletes a segment once all of its records have
+// expired.
+//
+// NewHandler serves it, or any other implementation of the API, over HTTP in the Kinesis wire protocol, so that
+// the SDK client and everything built on it can run against it without an AWS account.
+package kinesisfake
+
+import (
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"github.com/awslabs/aws-sdk-go/service/kinesis/kinesisiface"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Limits Kinesis places on requests, which the fake enforces.
+const (
+	MaxRecordsPerRequest  = 500
+	MaxRecordSize         = 1 << 20
+	MaxPartitionKeyLength = 256
+	MaxGetRecordsLimit    = 10000
+	// IteratorValidity is how long a shard iterator can be used after it was handed out.
+	IteratorValidity = 5 * time.Minute
+)
+
+// Page sizes of the listing calls when the request sets no Limit, and the largest Limit each accepts.
+const (
+	describeStreamLimit    = 100
+	maxDescribeStreamLimit = 10000
+	listStreamsLimit       = 10
+	maxListStreamsLimit    = 10000
+	listTagsLimit          = 10
+	maxListTagsLimit       = 50
+)
+
+// DefaultRetention is how long records are kept unless configured otherwise, the default of Kinesis.
+const DefaultRetention = 24 * time.Hour
+
+// validStreamName matches the names Kinesis accepts for streams.
+var validStreamName = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,128}$`)
+
+// maxHashKey is the highest hash key, 2^128 - 1.
+var maxHashKey = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 128), big.NewInt(1))
+
+// Config configures a Kinesis.
+type Config struct {
+	// Dir is the directory the streams are kept in, which is created if needed. When empty, they are kept in
+	// memory.
+	Dir string
+	// Retention is how long records are kept after they were put. It defaults to DefaultRetention.
+	Retention time.Duration
+}
+
+// Kinesis is a Kinesis service kept in memory or in a directory. It is safe for concurrent use.
+type Kinesis struct {
+	config  Config
+	mu      sync.Mutex
+	streams map[string]*stream
+	now     func() time.Time
+}
+
+var _ kinesisiface.KinesisAPI = (*Kinesis)(nil)
+
+// New returns a Kinesis with no streams, kept in memory.
+func New() *Kinesis {
+	k, _ := Open(Config{})
+	return k
+}
+
+// Open returns a Kinesis with the streams saved in config.Dir, reading them on from where they were left. Records
+// that have outlived the retention period since are trimmed.
+func Open(config Config) (*Kinesis, error) {
+	return open(config, time.Now)
+}
+
+// open is Open with the clock the Kinesis reads the time from.
+func open(config Config, now func() time.Time) (*Kinesis, error) {
+	if config.Retention <= 0 {
+		config.Retention = DefaultRetention
+	}
+	k := &Kinesis{config: config, streams: make(map[string]*stream), now: now}
+	if config.Dir == "" {
+		return k, nil
+	}
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+	streams, err := loadStreams(config.Dir, k.horizon())
+	if err != nil {
+		return nil, err
+	}
+	k.streams = streams
+	return k, nil
+}
+
+// Close closes the files of the streams. A Kinesis kept in memory has none.
+func (k *Kinesis) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var first error
+	for _, s := range k.streams {
+		if err := s.closeSegments(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// horizon is the arrival time of the oldest record retained.
+func (k *Kinesis) horizon() time.Time {
+	return k.now().Add(-k.config.Retention)
+}
+
+// apiError builds the error Kinesis returns with code, as the SDK hands it to callers.
+func apiError(code, format string, args ...interface{}) error {
+	return aws.APIError{StatusCode: 400, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func invalidArgument(format string, args ...interface{}) error {
+	return apiError("InvalidArgumentException", format, args...)
+}
+
+// str dereferences an optional string parameter.
+func str(p *string) string {
+	if p == nil {
+		return ""
+	}
+	return *p
+}
+
+// lookup returns the stream called name. It must be called with mu held.
+func (k *Kinesis) lookup(name *string) (*stream, error) {
+	s := k.streams[str(name)]
+	if s == nil {
+		return nil, apiError("ResourceNotFoundException", "Stream %s not found.", str(name))
+	}
+	return s, nil
+}
+
+// CreateStream creates a stream whose shards split the hash key space evenly.
+func (k *Kinesis) CreateStream(input *kinesis.CreateStreamInput) (*kinesis.CreateStreamOutput, error) {
+	name := str(input.StreamName)
+	if !validStreamName.MatchString(name) {
+		return nil, invalidArgument("StreamName %q is not a valid stream name.", name)
+	}
+	if input.ShardCount == nil || *input.ShardCount < 1 {
+		return nil, invalidArgument("ShardCount must be at least 1.")
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.streams[name] != nil {
+		return nil, apiError("ResourceInUseException", "Stream %s already exists.", name)
+	}
+	s := &stream{name: name, tags: make(map[string]string)}
+	if k.config.Dir != "" {
+		s.dir = filepath.Join(k.config.Dir, name+streamDirSuffix)
+		if err := os.Mkdir(s.dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	n := big.NewInt(*input.ShardCount)
+	space := new(big.Int).Add(maxHashKey, big.NewInt(1))
+	ranges := make([][2]*big.Int, *input.ShardCount)
+	for i := range ranges {
+		start := new(big.Int).Mul(space, big.NewInt(int64(i)))
+		start.Div(start, n)
+		end := new(big.Int).Mul(space, big.NewInt(int64(i+1)))
+		end.Div(end, n)
+		end.Sub(end, big.NewInt(1))
+		ranges[i] = [2]*big.Int{start, end}
+	}
+	if err := s.reshard(nil, ranges); err != nil {
+		if s.dir != "" {
+			s.closeSegments()
+			os.RemoveAll(s.dir)
+		}
+		return nil, err
+	}
+	k.streams[name] = s
+	return &kinesis.CreateStreamOutput{}, nil
+}
+
+// DeleteStream deletes a stream and its records.
+func (k *Kinesis) DeleteStream(input *kinesis.DeleteStreamInput) (*kinesis.DeleteStreamOutput, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s, err := k.lookup(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+	delete(k.streams, s.name)
+	if s.dir != "" {
+		s.closeSegments()
+		if err := os.RemoveAll(s.dir); err != nil {
+			return nil, err
+		}
+	}
+	return &kinesis.DeleteStreamOutput{}, nil
+}
+
+// DescribeStream returns a page of the stream's shards, open and closed, in order of shard ID.
+func (k *Kinesis) DescribeStream(input *kinesis.DescribeStreamInput) (*kinesis.DescribeStreamOutput, error) {
+	limit, err := pageLimit(input.Limit, describeStreamLimit, maxDescribeStreamLimit)
+	if err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s, err := k.lookup(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+	after := str(input.ExclusiveStartShardID)
+	var shards []*kinesis.Shard
+	more := false
+	for _, sh := range s.shards {
+		if sh.id <= after {
+			continue
+		}
+		if len(shards) == limit {
+			more = true
+			break
+		}
+		shards = append(shards, sh.describe())
+	}
+	return &kinesis.DescribeStreamOutput{StreamDescription: &kinesis.StreamDescription{
+		HasMoreShards: aws.Boolean(more),
+		Shards:        shards,
+		StreamARN:     aws.String("arn:aws:kinesis:us-east-1:000000000000:stream/" + s.name),
+		StreamName:    aws.String(s.name),
+		StreamStatus:  aws.String("ACTIVE"),
+	}}, nil
+}
+
+// ListStreams returns a page of the stream names, in order.
+func (k *Kinesis) ListStreams(input *kinesis.ListStreamsInput) (*kinesis.ListStreamsOutput, error) {
+	limit, err := pageLimit(input.Limit, listStreamsLimit, maxListStreamsLimit)
+	if err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	names := make([]string, 0, len(k.streams))
+	for name := range k.streams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	after := str(input.ExclusiveStartStreamName)
+	out := &kinesis.ListStreamsOutput{HasMoreStreams: aws.Boolean(false), StreamNames: []*string{}}
+	for _, name := range names {
+		if name <= after {
+			continue
+		}
+		if len(out.StreamNames) == limit {
+			out.HasMoreStreams = aws.Boolean(true)
+			break
+		}
+		out.StreamNames = append(out.StreamNames, aws.String(name))
+	}
+	return out, nil
+}
+
+// pageLimit checks the Limit of a listing call against max, defaulting to def.
+func pageLimit(limit *int64, def, max int) (int, error) {
+	if limit == nil {
+		return def, nil
+	}
+	if *limit < 1 || *limit > int64(max) {
+		return 0, invalidArgument("Limit must be between 1 and %d.", max)
+	}
+	return int(*limit), nil
+}
+
+// AddTagsToStream adds tags to a stream, replacing the values of the keys it already has.
+func (k *Kinesis) AddTagsToStream(input *kinesis.AddTagsToStreamInput) (*kinesis.AddTagsToStreamOutput, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s, err := k.lookup(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+	if input.Tags != nil {
+		for key, value := range *input.Tags {
+			s.tags[key] = str(value)
+		}
+	}
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	return &kinesis.AddTagsToStreamOutput{}, nil
+}
+
+// ListTagsForStream returns a page of the stream's tags, in order of key.
+func (k *Kinesis) ListTagsForStream(input *kinesis.ListTagsForStreamInput) (*kinesis.ListTagsForStreamOutput, error) {
+	limit, err := pageLimit(input.Limit, listTagsLimit, maxListTagsLimit)
+	if err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s, err := k.lookup(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(s.tags))
+	for key := range s.tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	after := str(input.ExclusiveStartTagKey)
+	out := &kinesis.ListTagsForStreamOutput{HasMoreTags: aws.Boolean(false), Tags: []*kinesis.Tag{}}
+	for _, key := range keys {
+		if key <= after {
+			continue
+		}
+		if len(out.Tags) == limit {
+			out.HasMoreTags = aws.Boolean(true)
+			break
+		}
+		out.Tags = append(out.Tags, &kinesis.Tag{Key: aws.String(key), Value: aws.String(s.tags[key])})
+	}
+	return out, nil
+}
+
+// RemoveTagsFromStream removes tags from a stream. Keys it does not have are ignored.
+func (k *Kinesis) RemoveTagsFromStream(input *kinesis.RemoveTagsFromStreamInput) (*kinesis.RemoveTagsFromStreamOutput, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s, err := k.lookup(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range input.TagKeys {
+		delete(s.tags, str(key))
+	}
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	return &kinesis.RemoveTagsFromStreamOutput{}, nil
+}
@@ -0,0 +1,398 @@
+package kinesisfake
+
+import (
+	"crypto/md5"
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newStream(t *testing.T, name string, shards int64) *Kinesis {
+	k := New()
+	if _, err := k.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String(name), ShardCount: aws.Long(shards)}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return k
+}
+
+func describe(t *testing.T, k *Kinesis, name string) []*kinesis.Shard {
+	out, err := k.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String(name)})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return out.StreamDescription.Shards
+}
+
+func put(t *testing.T, k *Kinesis, input *kinesis.PutRecordInput) *kinesis.PutRecordOutput {
+	if input.StreamName == nil {
+		input.StreamName = aws.String("s")
+	}
+	out, err := k.PutRecord(input)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return out
+}
+
+// read returns the data of the records from an iterator of the given type, reading until the shard is closed or
+// nothing more comes back.
+func read(t *testing.T, k *Kinesis, shardID, iteratorType, seq string) []string {
+	input := &kinesis.GetShardIteratorInput{StreamName: aws.String("s"), ShardID: aws.String(shardID), ShardIteratorType: aws.String(iteratorType)}
+	if seq != "" {
+		input.StartingSequenceNumber = aws.String(seq)
+	}
+	it, err := k.GetShardIterator(input)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var data []string
+	iterator := it.ShardIterator
+	for iterator != nil {
+		out, err := k.GetRecords(&kinesis.GetRecordsInput{ShardIterator: iterator, Limit: aws.Long(2)})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		for _, r := range out.Records {
+			data = append(data, string(r.Data))
+		}
+		if len(out.Records) == 0 {
+			break
+		}
+		iterator = out.NextShardIterator
+	}
+	return data
+}
+
+func errorCode(err error) string {
+	if e := aws.Error(err); e != nil {
+		return e.Code
+	}
+	return fmt.Sprint(err)
+}
+
+func TestCreateStreamSplitsHashKeySpace(t *testing.T) {
+	k := newStream(t, "s", 3)
+	shards := describe(t, k, "s")
+	if len(shards) != 3 {
+		t.Fatalf("expected 3 shards, was %d", len(shards))
+	}
+	next := big.NewInt(0)
+	for _, s := range shards {
+		if *s.HashKeyRange.StartingHashKey != next.String() {
+			t.Errorf("expected shard %s to start at %s, was %s", *s.ShardID, next, *s.HashKeyRange.StartingHashKey)
+		}
+		next.SetString(*s.HashKeyRange.EndingHashKey, 10)
+		next.Add(next, big.NewInt(1))
+		if s.SequenceNumberRange.EndingSequenceNumber != nil || s.ParentShardID != nil {
+			t.Errorf("expected shard %s to be open and without parents", *s.ShardID)
+		}
+	}
+	if next.Cmp(new(big.Int).Lsh(big.NewInt(1), 128)) != 0 {
+		t.Errorf("expected the shards to cover every hash key, ended at %s", next)
+	}
+	if _, err := k.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String("s"), ShardCount: aws.Long(1)}); errorCode(err) != "ResourceInUseException" {
+		t.Errorf("expected creating the stream again to fail, was %v", err)
+	}
+}
+
+func TestPutRecordRoutesByHashKey(t *testing.T) {
+	k := newStream(t, "s", 4)
+	shards := describe(t, k, "s")
+	for _, key := range []string{"a", "b", "c", "d", "e", "f"} {
+		sum := md5.Sum([]byte(key))
+		hashKey := new(big.Int).SetBytes(sum[:])
+		out := put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String(key), Data: []byte(key)})
+		var want string
+		for _, s := range shards {
+			start, _ := new(big.Int).SetString(*s.HashKeyRange.StartingHashKey, 10)
+			end, _ := new(big.Int).SetString(*s.HashKeyRange.EndingHashKey, 10)
+			if start.Cmp(hashKey) <= 0 && hashKey.Cmp(end) <= 0 {
+				want = *s.ShardID
+			}
+		}
+		if *out.ShardID != want {
+			t.Errorf("expected key %s to go to %s, went to %s", key, want, *out.ShardID)
+		}
+	}
+	for _, s := range shards {
+		out := put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String("a"), ExplicitHashKey: s.HashKeyRange.EndingHashKey})
+		if *out.ShardID != *s.ShardID {
+			t.Errorf("expected the explicit hash key %s to go to %s, went to %s", *s.HashKeyRange.EndingHashKey, *s.ShardID, *out.ShardID)
+		}
+	}
+}
+
+func TestPutRecordsNumbersInOrder(t *testing.T) {
+	k := newStream(t, "s", 2)
+	var entries []*kinesis.PutRecordsRequestEntry
+	for i := 0; i < 20; i++ {
+		entries = append(entries, &kinesis.PutRecordsRequestEntry{PartitionKey: aws.String(fmt.Sprint(i)), Data: []byte{byte(i)}})
+	}
+	out, err := k.PutRecords(&kinesis.PutRecordsInput{StreamName: aws.String("s"), Records: entries})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if *out.FailedRecordCount != 0 || len(out.Records) != len(entries) {
+		t.Fatalf("expected every record to be accepted, was %d of %d failed", *out.FailedRecordCount, len(out.Records))
+	}
+	last := ""
+	for i, r := range out.Records {
+		if *r.SequenceNumber <= last {
+			t.Errorf("record %d: expected a sequence number above %s, was %s", i, last, *r.SequenceNumber)
+		}
+		last = *r.SequenceNumber
+	}
+
+	tests := []struct {
+		name  string
+		input *kinesis.PutRecordsInput
+		code  string
+	}{
+		{"no records", &kinesis.PutRecordsInput{StreamName: aws.String("s")}, "InvalidArgumentException"},
+		{"missing key", &kinesis.PutRecordsInput{StreamName: aws.String("s"), Records: []*kinesis.PutRecordsRequestEntry{{Data: []byte("x")}}}, "InvalidArgumentException"},
+		{"no stream", &kinesis.PutRecordsInput{StreamName: aws.String("t"), Records: entries[:1]}, "ResourceNotFoundException"},
+		{"long key", &kinesis.PutRecordsInput{StreamName: aws.String("s"), Records: []*kinesis.PutRecordsRequestEntry{{PartitionKey: aws.String(strings.Repeat("é", MaxPartitionKeyLength+1)), Data: []byte("x")}}}, "InvalidArgumentException"},
+	}
+	for _, tt := range tests {
+		if _, err := k.PutRecords(tt.input); errorCode(err) != tt.code {
+			t.Errorf("%s: expected %s, was %v", tt.name, tt.code, err)
+		}
+	}
+	// The limit is on characters, so a key of multibyte ones may run past as many bytes.
+	put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String(strings.Repeat("é", MaxPartitionKeyLength)), Data: []byte("x")})
+}
+
+func TestShardIteratorTypes(t *testing.T) {
+	k := newStream(t, "s", 1)
+	var seqs []string
+	for _, d := range []string{"a", "b", "c"} {
+		seqs = append(seqs, *put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String("k"), Data: []byte(d)}).SequenceNumber)
+	}
+	latest, err := k.GetShardIterator(&kinesis.GetShardIteratorInput{StreamName: aws.String("s"), ShardID: aws.String("shardId-000000000000"), ShardIteratorType: aws.String("LATEST")})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String("k"), Data: []byte("d")})
+
+	tests := []struct {
+		iteratorType, seq string
+		want              string
+	}{
+		{"TRIM_HORIZON", "", "abcd"},
+		{"AT_SEQUENCE_NUMBER", seqs[1], "bcd"},
+		{"AFTER_SEQUENCE_NUMBER", seqs[1], "cd"},
+		{"LATEST", "", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		for _, d := range read(t, k, "shardId-000000000000", tt.iteratorType, tt.seq) {
+			got += d
+		}
+		if got != tt.want {
+			t.Errorf("%s %s: expected %q, was %q", tt.iteratorType, tt.seq, tt.want, got)
+		}
+	}
+	out, err := k.GetRecords(&kinesis.GetRecordsInput{ShardIterator: latest.ShardIterator})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(out.Records) != 1 || string(out.Records[0].Data) != "d" {
+		t.Errorf("expected the iterator taken before the last record to return it, was %v", out.Records)
+	}
+}
+
+func TestShardIteratorRejectsUnissuedSequenceNumbers(t *testing.T) {
+	k := newStream(t, "s", 2)
+	shards := describe(t, k, "s")
+	a := put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String("k"), ExplicitHashKey: shards[0].HashKeyRange.StartingHashKey, Data: []byte("a")})
+	b := put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String("k"), ExplicitHashKey: shards[1].HashKeyRange.StartingHashKey, Data: []byte("b")})
+	tests := []struct {
+		name, seq string
+	}{
+		{"other shard", *b.SequenceNumber},
+		{"made up", "12345"},
+	}
+	for _, tt := range tests {
+		for _, iteratorType := range []string{"AT_SEQUENCE_NUMBER", "AFTER_SEQUENCE_NUMBER"} {
+			_, err := k.GetShardIterator(&kinesis.GetShardIteratorInput{StreamName: aws.String("s"), ShardID: a.ShardID, ShardIteratorType: aws.String(iteratorType), StartingSequenceNumber: aws.String(tt.seq)})
+			if errorCode(err) != "InvalidArgumentException" {
+				t.Errorf("%s, %s: expected InvalidArgumentException, was %v", tt.name, iteratorType, err)
+			}
+		}
+	}
+
+	if _, err := k.MergeShards(&kinesis.MergeShardsInput{StreamName: aws.String("s"), ShardToMerge: shards[0].ShardID, AdjacentShardToMerge: shards[1].ShardID}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	end := *describe(t, k, "s")[0].SequenceNumberRange.EndingSequenceNumber
+	_, err := k.GetShardIterator(&kinesis.GetShardIteratorInput{StreamName: aws.String("s"), ShardID: a.ShardID, ShardIteratorType: aws.String("AT_SEQUENCE_NUMBER"), StartingSequenceNumber: aws.String(end)})
+	if errorCode(err) != "InvalidArgumentException" {
+		t.Errorf("expected the end of a closed shard to be refused, was %v", err)
+	}
+	if got := read(t, k, *a.ShardID, "AT_SEQUENCE_NUMBER", *a.SequenceNumber); fmt.Sprint(got) != "[a]" {
+		t.Errorf("expected to read a, was %v", got)
+	}
+}
+
+func TestGetRecordsExpiresIterators(t *testing.T) {
+	k := newStream(t, "s", 1)
+	now := time.Unix(1000, 0)
+	k.now = func() time.Time { return now }
+	it, err := k.GetShardIterator(&kinesis.GetShardIteratorInput{StreamName: aws.String("s"), ShardID: aws.String("shardId-000000000000"), ShardIteratorType: aws.String("LATEST")})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	now = now.Add(IteratorValidity)
+	out, err := k.GetRecords(&kinesis.GetRecordsInput{ShardIterator: it.ShardIterator})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	now = now.Add(IteratorValidity)
+	if _, err := k.GetRecords(&kinesis.GetRecordsInput{ShardIterator: out.NextShardIterator}); err != nil {
+		t.Errorf("expected the next iterator to be valid for as long again, was %v", err)
+	}
+	now = now.Add(time.Second)
+	if _, err := k.GetRecords(&kinesis.GetRecordsInput{ShardIterator: out.NextShardIterator}); errorCode(err) != "ExpiredIteratorException" {
+		t.Errorf("expected the iterator to expire, was %v", err)
+	}
+	if _, err := k.GetRecords(&kinesis.GetRecordsInput{ShardIterator: aws.String("garbage")}); errorCode(err) != "InvalidArgumentException" {
+		t.Errorf("expected a malformed iterator to be refused, was %v", err)
+	}
+}
+
+func TestDescribeStreamPages(t *testing.T) {
+	k := newStream(t, "s", 5)
+	var ids []string
+	input := &kinesis.DescribeStreamInput{StreamName: aws.String("s"), Limit: aws.Long(2)}
+	pages := 0
+	for more := true; more; pages++ {
+		out, err := k.DescribeStream(input)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		for _, s := range out.StreamDescription.Shards {
+			ids = append(ids, *s.ShardID)
+			input.ExclusiveStartShardID = s.ShardID
+		}
+		more = *out.StreamDescription.HasMoreShards
+	}
+	if pages != 3 || len(ids) != 5 || ids[0] != "shardId-000000000000" || ids[4] != "shardId-000000000004" {
+		t.Errorf("expected 5 shards in order over 3 pages, was %v over %d", ids, pages)
+	}
+	if _, err := k.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String("t")}); errorCode(err) != "ResourceNotFoundException" {
+		t.Errorf("expected an unknown stream to be reported, was %v", err)
+	}
+
+	// Limits above the default page size are accepted up to the maximum of Kinesis.
+	out, err := k.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String("s"), Limit: aws.Long(1000)})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(out.StreamDescription.Shards) != 5 {
+		t.Errorf("expected every shard on one page, was %d", len(out.StreamDescription.Shards))
+	}
+	if _, err := k.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String("s"), Limit: aws.Long(10001)}); errorCode(err) != "InvalidArgumentException" {
+		t.Errorf("expected a Limit above 10000 to be refused, was %v", err)
+	}
+	if _, err := k.ListStreams(&kinesis.ListStreamsInput{Limit: aws.Long(10000)}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := k.ListStreams(&kinesis.ListStreamsInput{Limit: aws.Long(10001)}); errorCode(err) != "InvalidArgumentException" {
+		t.Errorf("expected a Limit above 10000 to be refused, was %v", err)
+	}
+}
+
+func TestSplitAndMergeShards(t *testing.T) {
+	k := newStream(t, "s", 1)
+	put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String("k"), ExplicitHashKey: aws.String("1"), Data: []byte("before")})
+	mid := new(big.Int).Lsh(big.NewInt(1), 127).String()
+	if _, err := k.SplitShard(&kinesis.SplitShardInput{StreamName: aws.String("s"), ShardToSplit: aws.String("shardId-000000000000"), NewStartingHashKey: aws.String(mid)}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	low := put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String("k"), ExplicitHashKey: aws.String("1"), Data: []byte("low")})
+	high := put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String("k"), ExplicitHashKey: aws.String(mid), Data: []byte("high")})
+	if *low.ShardID != "shardId-000000000001" || *high.ShardID != "shardId-000000000002" {
+		t.Errorf("expected the records to go to the children, went to %s and %s", *low.ShardID, *high.ShardID)
+	}
+	if got := read(t, k, "shardId-000000000000", "TRIM_HORIZON", ""); len(got) != 1 || got[0] != "before" {
+		t.Errorf("expected the parent to end with its only record, was %v", got)
+	}
+	if _, err := k.SplitShard(&kinesis.SplitShardInput{StreamName: aws.String("s"), ShardToSplit: aws.String("shardId-000000000000"), NewStartingHashKey: aws.String(mid)}); errorCode(err) != "ResourceInUseException" {
+		t.Errorf("expected splitting a closed shard to fail, was %v", err)
+	}
+	if _, err := k.SplitShard(&kinesis.SplitShardInput{StreamName: aws.String("s"), ShardToSplit: aws.String("shardId-000000000001"), NewStartingHashKey: aws.String("0")}); errorCode(err) != "InvalidArgumentException" {
+		t.Errorf("expected a split at the start of the range to fail, was %v", err)
+	}
+
+	if _, err := k.MergeShards(&kinesis.MergeShardsInput{StreamName: aws.String("s"), ShardToMerge: aws.String("shardId-000000000002"), AdjacentShardToMerge: aws.String("shardId-000000000001")}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	shards := describe(t, k, "s")
+	if len(shards) != 4 {
+		t.Fatalf("expected 4 shards, was %d", len(shards))
+	}
+	parent, child := shards[0], shards[3]
+	if parent.SequenceNumberRange.EndingSequenceNumber == nil || shards[1].SequenceNumberRange.EndingSequenceNumber == nil || shards[2].SequenceNumberRange.EndingSequenceNumber == nil {
+		t.Errorf("expected every parent to be closed")
+	}
+	if *shards[1].ParentShardID != "shardId-000000000000" || *shards[2].ParentShardID != "shardId-000000000000" {
+		t.Errorf("expected the split children to name their parent")
+	}
+	if *child.ParentShardID != "shardId-000000000002" || *child.AdjacentParentShardID != "shardId-000000000001" || child.SequenceNumberRange.EndingSequenceNumber != nil {
+		t.Errorf("expected the merged child to be open and name both parents, was %v", child)
+	}
+	if *child.HashKeyRange.StartingHashKey != "0" || *child.HashKeyRange.EndingHashKey != maxHashKey.String() {
+		t.Errorf("expected the merged child to cover every hash key, was %v", child.HashKeyRange)
+	}
+	if *child.SequenceNumberRange.StartingSequenceNumber <= *shards[2].SequenceNumberRange.EndingSequenceNumber {
+		t.Errorf("expected the child to start above where its parents ended")
+	}
+	if out := put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String("k"), Data: []byte("merged")}); *out.ShardID != *child.ShardID {
+		t.Errorf("expected the record to go to the merged child, went to %s", *out.ShardID)
+	}
+}
+
+func TestListStreamsAndTags(t *testing.T) {
+	k := New()
+	for _, name := range []string{"c", "a", "b"} {
+		if _, err := k.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String(name), ShardCount: aws.Long(1)}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if _, err := k.DeleteStream(&kinesis.DeleteStreamInput{StreamName: aws.String("b")}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	out, err := k.ListStreams(&kinesis.ListStreamsInput{Limit: aws.Long(1)})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(out.StreamNames) != 1 || *out.StreamNames[0] != "a" || !*out.HasMoreStreams {
+		t.Errorf("expected a first page holding a, was %v", out)
+	}
+	out, err = k.ListStreams(&kinesis.ListStreamsInput{ExclusiveStartStreamName: aws.String("a")})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(out.StreamNames) != 1 || *out.StreamNames[0] != "c" || *out.HasMoreStreams {
+		t.Errorf("expected a last page holding c, was %v", out)
+	}
+
+	tags := map[string]*string{"team": aws.String("x"), "env": aws.String("test")}
+	if _, err := k.AddTagsToStream(&kinesis.AddTagsToStreamInput{StreamName: aws.String("a"), Tags: &tags}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := k.RemoveTagsFromStream(&kinesis.RemoveTagsFromStreamInput{StreamName: aws.String("a"), TagKeys: []*string{aws.String("team")}}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	listed, err := k.ListTagsForStream(&kinesis.ListTagsForStreamInput{StreamName: aws.String("a")})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(listed.Tags) != 1 || *listed.Tags[0].Key != "env" || *listed.Tags[0].Value != "test" {
+		t.Errorf("expected only the env tag, was %v", listed.Tags)
+	}
+}
@@ -0,0 +1,208 @@
+package kinesisfake
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"strconv"
+	"time"
+)
+
+// formatSeq renders a sequence number zero-padded to a fixed width, so that, as with Kinesis, sequence numbers
+// of the same length sort as strings in the order they were given.
+func formatSeq(seq uint64) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
+func parseSeq(s *string) (uint64, error) {
+	seq, err := strconv.ParseUint(str(s), 10, 64)
+	if err != nil {
+		return 0, invalidArgument("StartingSequenceNumber %q is not a sequence number.", str(s))
+	}
+	return seq, nil
+}
+
+// issuedSeq parses the sequence number of a record of sh that an iterator starts from. Like Kinesis, it refuses
+// one that was never given to a record of the shard.
+func issuedSeq(sh *shard, s *string) (uint64, error) {
+	seq, err := parseSeq(s)
+	if err != nil {
+		return 0, err
+	}
+	if !sh.issued(seq) {
+		return 0, invalidArgument("StartingSequenceNumber %s is invalid because it did not come from shard %s.", str(s), sh.id)
+	}
+	return seq, nil
+}
+
+// PutRecord adds a record to the open shard its hash key falls in.
+func (k *Kinesis) PutRecord(input *kinesis.PutRecordInput) (*kinesis.PutRecordOutput, error) {
+	if len(input.Data) > MaxRecordSize {
+		return nil, invalidArgument("Data must be at most %d bytes.", MaxRecordSize)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s, err := k.lookup(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+	sh, err := s.route(input.PartitionKey, input.ExplicitHashKey)
+	if err != nil {
+		return nil, err
+	}
+	seq, err := s.put(sh, *input.PartitionKey, input.Data, k.now(), k.horizon())
+	if err != nil {
+		return nil, err
+	}
+	return &kinesis.PutRecordOutput{SequenceNumber: aws.String(seq), ShardID: aws.String(sh.id)}, nil
+}
+
+// PutRecords adds each record to the open shard its hash key falls in. Records are all refused when the request
+// itself is invalid; otherwise only those that cannot be saved fail, with the InternalFailure error code.
+func (k *Kinesis) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	if len(input.Records) == 0 || len(input.Records) > MaxRecordsPerRequest {
+		return nil, invalidArgument("Records must hold between 1 and %d entries.", MaxRecordsPerRequest)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s, err := k.lookup(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+	shards := make([]*shard, len(input.Records))
+	for i, e := range input.Records {
+		if len(e.Data) > MaxRecordSize {
+			return nil, invalidArgument("Data of record %d must be at most %d bytes.", i, MaxRecordSize)
+		}
+		if shards[i], err = s.route(e.PartitionKey, e.ExplicitHashKey); err != nil {
+			return nil, err
+		}
+	}
+	failed := int64(0)
+	results := make([]*kinesis.PutRecordsResultEntry, len(shards))
+	for i, sh := range shards {
+		seq, err := s.put(sh, *input.Records[i].PartitionKey, input.Records[i].Data, k.now(), k.horizon())
+		if err != nil {
+			failed++
+			results[i] = &kinesis.PutRecordsResultEntry{ErrorCode: aws.String("InternalFailure"), ErrorMessage: aws.String(err.Error())}
+			continue
+		}
+		results[i] = &kinesis.PutRecordsResultEntry{SequenceNumber: aws.String(seq), ShardID: aws.String(sh.id)}
+	}
+	return &kinesis.PutRecordsOutput{FailedRecordCount: aws.Long(failed), Records: results}, nil
+}
+
+// iterator is the position a shard iterator points at, handed out encoded as an opaque string.
+type iterator struct {
+	Stream  string    `json:"stream"`
+	ShardID string    `json:"shard"`
+	From    uint64    `json:"from"`
+	Issued  time.Time `json:"issued"`
+}
+
+func (it iterator) encode() *string {
+	b, _ := json.Marshal(it)
+	return aws.String(base64.URLEncoding.EncodeToString(b))
+}
+
+func decodeIterator(s *string) (iterator, error) {
+	var it iterator
+	b, err := base64.URLEncoding.DecodeString(str(s))
+	if err == nil {
+		err = json.Unmarshal(b, &it)
+	}
+	if err != nil {
+		return it, invalidArgument("ShardIterator %q is not valid.", str(s))
+	}
+	return it, nil
+}
+
+// GetShardIterator returns an iterator positioned in the shard by ShardIteratorType.
+func (k *Kinesis) GetShardIterator(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s, err := k.lookup(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+	sh, err := s.shard(input.ShardID)
+	if err != nil {
+		return nil, err
+	}
+	sh.trim(k.horizon())
+	it := iterator{Stream: s.name, ShardID: sh.id, Issued: k.now()}
+	switch str(input.ShardIteratorType) {
+	case "TRIM_HORIZON":
+		// Reading skips the records trimmed by then, so the start of the shard stands for the oldest one left.
+		it.From = sh.startSeq
+	case "LATEST":
+		it.From = s.nextSeq
+		if sh.closed {
+			it.From = sh.endSeq
+		}
+	case "AT_SEQUENCE_NUMBER":
+		it.From, err = issuedSeq(sh, input.StartingSequenceNumber)
+	case "AFTER_SEQUENCE_NUMBER":
+		it.From, err = issuedSeq(sh, input.StartingSequenceNumber)
+		it.From++
+	default:
+		err = invalidArgument("ShardIteratorType %q is not supported.", str(input.ShardIteratorType))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &kinesis.GetShardIteratorOutput{ShardIterator: it.encode()}, nil
+}
+
+// GetRecords returns the records from the iterator's position on, or from the oldest one retained if that is
+// later, and an iterator after them. Once a closed shard has been read to its end the next iterator is nil.
+func (k *Kinesis) GetRecords(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	limit := MaxGetRecordsLimit
+	if input.Limit != nil {
+		if *input.Limit < 1 || *input.Limit > MaxGetRecordsLimit {
+			return nil, invalidArgument("Limit must be between 1 and %d.", MaxGetRecordsLimit)
+		}
+		limit = int(*input.Limit)
+	}
+	it, err := decodeIterator(input.ShardIterator)
+	if err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.now().Sub(it.Issued) > IteratorValidity {
+		return nil, apiError("ExpiredIteratorException", "Iterator expired.")
+	}
+	s, err := k.lookup(&it.Stream)
+	if err != nil {
+		return nil, err
+	}
+	sh, err := s.shard(&it.ShardID)
+	if err != nil {
+		return nil, err
+	}
+	sh.trim(k.horizon())
+	out := &kinesis.GetRecordsOutput{Records: []*kinesis.Record{}}
+	i := sh.from(it.From)
+	for ; i < len(sh.records) && len(out.Records) < limit; i++ {
+		r := sh.records[i]
+		partitionKey, data, err := sh.read(r)
+		if err != nil {
+			return nil, err
+		}
+		out.Records = append(out.Records, &kinesis.Record{
+			Data:           data,
+			PartitionKey:   aws.String(partitionKey),
+			SequenceNumber: aws.String(formatSeq(r.seq)),
+		})
+		it.From = r.seq + 1
+	}
+	if sh.closed && i == len(sh.records) {
+		return out, nil
+	}
+	it.Issued = k.now()
+	out.NextShardIterator = it.encode()
+	return out, nil
+}
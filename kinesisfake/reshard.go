@@ -0,0 +1,59 @@
+package kinesisfake
+
+import (
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"math/big"
+)
+
+// SplitShard closes an open shard and opens two children in its place: one with the hash keys below
+// NewStartingHashKey and one with the rest.
+func (k *Kinesis) SplitShard(input *kinesis.SplitShardInput) (*kinesis.SplitShardOutput, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s, err := k.lookup(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+	sh, err := s.openShard(input.ShardToSplit)
+	if err != nil {
+		return nil, err
+	}
+	split, ok := new(big.Int).SetString(str(input.NewStartingHashKey), 10)
+	if !ok || split.Cmp(sh.startHashKey) <= 0 || split.Cmp(sh.endHashKey) > 0 {
+		return nil, invalidArgument("NewStartingHashKey %q is not inside the hash key range of shard %s, above its start.", str(input.NewStartingHashKey), sh.id)
+	}
+	ranges := [][2]*big.Int{{sh.startHashKey, new(big.Int).Sub(split, big.NewInt(1))}, {split, sh.endHashKey}}
+	if err := s.reshard([]*shard{sh}, ranges); err != nil {
+		return nil, err
+	}
+	return &kinesis.SplitShardOutput{}, nil
+}
+
+// MergeShards closes two open shards with adjacent hash key ranges and opens a child covering both.
+func (k *Kinesis) MergeShards(input *kinesis.MergeShardsInput) (*kinesis.MergeShardsOutput, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s, err := k.lookup(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+	sh, err := s.openShard(input.ShardToMerge)
+	if err != nil {
+		return nil, err
+	}
+	adjacent, err := s.openShard(input.AdjacentShardToMerge)
+	if err != nil {
+		return nil, err
+	}
+	lo, hi := sh, adjacent
+	if lo.startHashKey.Cmp(hi.startHashKey) > 0 {
+		lo, hi = hi, lo
+	}
+	if new(big.Int).Add(lo.endHashKey, big.NewInt(1)).Cmp(hi.startHashKey) != 0 {
+		return nil, invalidArgument("Shards %s and %s do not have adjacent hash key ranges.", sh.id, adjacent.id)
+	}
+	if err := s.reshard([]*shard{sh, adjacent}, [][2]*big.Int{{lo.startHashKey, hi.endHashKey}}); err != nil {
+		return nil, err
+	}
+	return &kinesis.MergeShardsOutput{}, nil
+}
@@ -0,0 +1,157 @@
+package kinesisfake
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/aws/credentials"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"github.com/awslabs/aws-sdk-go/service/kinesis/kinesisiface"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// TargetPrefix starts the X-Amz-Target header of every Kinesis request, which it ends with the operation name.
+const TargetPrefix = "Kinesis_20131202."
+
+// contentType is the media type of the Kinesis JSON 1.1 protocol.
+const contentType = "application/x-amz-json-1.1"
+
+// kinesisAPI is the type of kinesisiface.KinesisAPI, whose methods are the operations served.
+var kinesisAPI = reflect.TypeOf((*kinesisiface.KinesisAPI)(nil)).Elem()
+
+// handler serves the Kinesis wire protocol in front of an implementation of the API.
+type handler struct {
+	api kinesisiface.KinesisAPI
+}
+
+// NewHandler returns an http.Handler speaking the Kinesis JSON 1.1 protocol, as the unchanged SDK client does,
+// and serving every request with api: the operation is named by the X-Amz-Target header, the input and output
+// are JSON with base64 blobs, and errors carrying an AWS error code are returned in the Kinesis error shape.
+// Requests are not authenticated, so any credentials will do.
+func NewHandler(api kinesisiface.KinesisAPI) http.Handler {
+	return &handler{api}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("x-amzn-RequestId", requestID())
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowedException", "Only POST is supported.")
+		return
+	}
+	target := r.Header.Get("X-Amz-Target")
+	name := strings.TrimPrefix(target, TargetPrefix)
+	method, ok := kinesisAPI.MethodByName(name)
+	if !ok || name == target {
+		writeError(w, http.StatusBadRequest, "UnknownOperationException", fmt.Sprintf("Operation %q is not supported.", target))
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "SerializationException", err.Error())
+		return
+	}
+	// Field names are matched without regard to case, so ShardId fills ShardID.
+	input := reflect.New(method.Type.In(0).Elem())
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, input.Interface()); err != nil {
+			writeError(w, http.StatusBadRequest, "SerializationException", err.Error())
+			return
+		}
+	}
+	results := reflect.ValueOf(h.api).MethodByName(name).Call([]reflect.Value{input})
+	if err, _ := results[1].Interface().(error); err != nil {
+		if e := aws.Error(err); e != nil && e.Code != "" {
+			status := e.StatusCode
+			if status == 0 {
+				status = http.StatusBadRequest
+			}
+			writeError(w, status, e.Code, e.Message)
+		} else {
+			writeError(w, http.StatusInternalServerError, "InternalFailure", err.Error())
+		}
+		return
+	}
+	out, err := json.Marshal(wireValue(results[0]))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalFailure", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(out)
+}
+
+// writeError writes the Kinesis error shape, which the SDK turns back into an aws.APIError.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	out, _ := json.Marshal(map[string]string{"__type": code, "message": message})
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+// requestID makes up the ID Kinesis gives each request.
+func requestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// wireValue turns an SDK output into the JSON the service sends: members are named by their locationName tag
+// where they have one, unset members are left out and blobs are base64 encoded.
+func wireValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return wireValue(v.Elem())
+	case reflect.Struct:
+		m := make(map[string]interface{})
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" || f.Tag.Get("json") == "-" || f.Name == "SDKShapeTraits" {
+				continue
+			}
+			fv := v.Field(i)
+			if (fv.Kind() == reflect.Ptr || fv.Kind() == reflect.Slice || fv.Kind() == reflect.Map) && fv.IsNil() {
+				continue
+			}
+			name := f.Tag.Get("locationName")
+			if name == "" {
+				name = f.Name
+			}
+			m[name] = wireValue(fv)
+		}
+		return m
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Interface()
+		}
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			list[i] = wireValue(v.Index(i))
+		}
+		return list
+	case reflect.Map:
+		m := make(map[string]interface{}, v.Len())
+		for _, k := range v.MapKeys() {
+			m[k.String()] = wireValue(v.MapIndex(k))
+		}
+		return m
+	}
+	return v.Interface()
+}
+
+// NewClient returns an SDK client for a server at endpoint, such as "http://localhost:4567", with made up
+// credentials and region.
+func NewClient(endpoint string) *kinesis.Kinesis {
+	return kinesis.New(&aws.Config{
+		Credentials: credentials.NewStaticCredentials("local", "local", ""),
+		Endpoint:    endpoint,
+		Region:      "us-east-1",
+	})
+}
@@ -0,0 +1,79 @@
+package kinesisfake
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandlerServesSDKClient(t *testing.T) {
+	server := httptest.NewServer(NewHandler(New()))
+	defer server.Close()
+	c := NewClient(server.URL)
+
+	if _, err := c.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String("s"), ShardCount: aws.Long(2)}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	put, err := c.PutRecord(&kinesis.PutRecordInput{StreamName: aws.String("s"), PartitionKey: aws.String("k"), Data: []byte{0, 1, 0xff}})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	d, err := c.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String("s"), Limit: aws.Long(1)})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(d.StreamDescription.Shards) != 1 || !*d.StreamDescription.HasMoreShards || *d.StreamDescription.Shards[0].ShardID != "shardId-000000000000" {
+		t.Errorf("expected the first of two shards, was %v", d.StreamDescription)
+	}
+	it, err := c.GetShardIterator(&kinesis.GetShardIteratorInput{StreamName: aws.String("s"), ShardID: put.ShardID, ShardIteratorType: aws.String("TRIM_HORIZON")})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	out, err := c.GetRecords(&kinesis.GetRecordsInput{ShardIterator: it.ShardIterator})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(out.Records) != 1 || !bytes.Equal(out.Records[0].Data, []byte{0, 1, 0xff}) || *out.Records[0].SequenceNumber != *put.SequenceNumber || out.NextShardIterator == nil {
+		t.Errorf("expected the record put, was %v", out)
+	}
+
+	_, err = c.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String("missing")})
+	if e := aws.Error(err); e == nil || e.Code != "ResourceNotFoundException" || e.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a ResourceNotFoundException, was %#v", err)
+	}
+}
+
+func TestHandlerRejectsBadRequests(t *testing.T) {
+	server := httptest.NewServer(NewHandler(New()))
+	defer server.Close()
+	tests := []struct {
+		name, target, body string
+		code               string
+	}{
+		{"no target", "", "{}", "UnknownOperationException"},
+		{"unknown operation", TargetPrefix + "DescribeLimits", "{}", "UnknownOperationException"},
+		{"malformed body", TargetPrefix + "ListStreams", "{", "SerializationException"},
+		{"invalid input", TargetPrefix + "CreateStream", `{"StreamName":"s","ShardCount":0}`, "InvalidArgumentException"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", server.URL, bytes.NewBufferString(tt.body))
+		req.Header.Set("X-Amz-Target", tt.target)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", tt.name, err)
+		}
+		var shape struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&shape)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest || shape.Type != tt.code || shape.Message == "" {
+			t.Errorf("%s: expected a 400 %s, was a %d %s %q", tt.name, tt.code, resp.StatusCode, shape.Type, shape.Message)
+		}
+	}
+}
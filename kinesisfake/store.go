@@ -0,0 +1,397 @@
+package kinesisfake
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A saved Kinesis keeps each stream in a directory of its own, named after the stream with streamDirSuffix. The
+// shards and tags are described in streamFile, and each shard appends its records to segment files with an index
+// file beside each. A segment is named after its shard and the sequence number it starts at.
+const (
+	streamDirSuffix = ".stream"
+	streamFile      = "stream.json"
+	segmentSuffix   = ".log"
+	indexSuffix     = ".idx"
+)
+
+// indexEntrySize is the size of an entry of an index file: the sequence number of a record, its arrival time in
+// Unix nanoseconds and the offset and size of its frame in the segment file, all big endian.
+const indexEntrySize = 8 + 8 + 8 + 4
+
+// segmentSize is the size past which a shard starts a new segment, so that expired records are reclaimed a
+// segment at a time. It is a variable so that tests can roll segments sooner.
+var segmentSize int64 = 64 << 20
+
+// savedStream is the JSON of a stream file.
+type savedStream struct {
+	Shards []savedShard      `json:"shards"`
+	Tags   map[string]string `json:"tags,omitempty"`
+}
+
+type savedShard struct {
+	ID             string `json:"id"`
+	Parent         string `json:"parent,omitempty"`
+	AdjacentParent string `json:"adjacentParent,omitempty"`
+	StartHashKey   string `json:"startHashKey"`
+	EndHashKey     string `json:"endHashKey"`
+	StartSeq       uint64 `json:"startSeq"`
+	EndSeq         uint64 `json:"endSeq,omitempty"`
+	Closed         bool   `json:"closed,omitempty"`
+}
+
+// save writes the shards and tags of s to its stream file, unless it is kept in memory. Records are saved as
+// they are put.
+func (s *stream) save() error {
+	if s.dir == "" {
+		return nil
+	}
+	saved := savedStream{Tags: s.tags}
+	for _, sh := range s.shards {
+		saved.Shards = append(saved.Shards, savedShard{
+			ID:             sh.id,
+			Parent:         sh.parent,
+			AdjacentParent: sh.adjacentParent,
+			StartHashKey:   sh.startHashKey.String(),
+			EndHashKey:     sh.endHashKey.String(),
+			StartSeq:       sh.startSeq,
+			EndSeq:         sh.endSeq,
+			Closed:         sh.closed,
+		})
+	}
+	data, err := json.MarshalIndent(saved, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.dir, streamFile), data)
+}
+
+// loadStreams opens every stream saved in dir, trimming the records that arrived before horizon.
+func loadStreams(dir string, horizon time.Time) (map[string]*stream, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	streams := make(map[string]*stream)
+	for _, info := range infos {
+		if !info.IsDir() || !strings.HasSuffix(info.Name(), streamDirSuffix) {
+			continue
+		}
+		s, err := loadStream(filepath.Join(dir, info.Name()), strings.TrimSuffix(info.Name(), streamDirSuffix), horizon)
+		if err != nil {
+			for _, s := range streams {
+				s.closeSegments()
+			}
+			return nil, err
+		}
+		streams[s.name] = s
+	}
+	return streams, nil
+}
+
+// loadStream opens the stream saved in dir and trims the records that arrived before horizon. Its next sequence
+// number follows the highest one it has used.
+func loadStream(dir, name string, horizon time.Time) (*stream, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, streamFile))
+	if err != nil {
+		return nil, err
+	}
+	var saved savedStream
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("stream %s: %v", name, err)
+	}
+	s := &stream{name: name, tags: saved.Tags, dir: dir}
+	if s.tags == nil {
+		s.tags = make(map[string]string)
+	}
+	for _, ss := range saved.Shards {
+		sh := &shard{
+			id:             ss.ID,
+			parent:         ss.Parent,
+			adjacentParent: ss.AdjacentParent,
+			startSeq:       ss.StartSeq,
+			endSeq:         ss.EndSeq,
+			closed:         ss.Closed,
+		}
+		var ok1, ok2 bool
+		sh.startHashKey, ok1 = new(big.Int).SetString(ss.StartHashKey, 10)
+		sh.endHashKey, ok2 = new(big.Int).SetString(ss.EndHashKey, 10)
+		if !ok1 || !ok2 {
+			s.closeSegments()
+			return nil, fmt.Errorf("stream %s: shard %s has an invalid hash key range", name, ss.ID)
+		}
+		s.shards = append(s.shards, sh)
+		if err := sh.openSegments(dir, horizon); err != nil {
+			s.closeSegments()
+			return nil, err
+		}
+		// The last segment is never reclaimed, so it still holds the highest sequence number used.
+		next := sh.segs[len(sh.segs)-1].next
+		if sh.closed {
+			next = sh.endSeq + 1
+		}
+		if next > s.nextSeq {
+			s.nextSeq = next
+		}
+	}
+	return s, nil
+}
+
+// closeSegments closes the segments of every shard of s.
+func (s *stream) closeSegments() error {
+	var first error
+	for _, sh := range s.shards {
+		for _, seg := range sh.segs {
+			if err := seg.close(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// openSegments opens the segments of sh saved in dir, oldest first, then trims the records that arrived before
+// horizon and reclaims the segments left without any.
+func (sh *shard) openSegments(dir string, horizon time.Time) error {
+	logs, err := filepath.Glob(filepath.Join(dir, sh.id+"-*"+segmentSuffix))
+	if err != nil {
+		return err
+	}
+	sort.Strings(logs)
+	for _, log := range logs {
+		first, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(log), sh.id+"-"), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seg, records, err := openSegment(dir, sh.id, first)
+		if err != nil {
+			return err
+		}
+		sh.segs = append(sh.segs, seg)
+		sh.records = append(sh.records, records...)
+	}
+	if len(sh.segs) == 0 {
+		seg, err := createSegment(dir, sh.id, sh.startSeq)
+		if err != nil {
+			return err
+		}
+		sh.segs = []*segment{seg}
+	}
+	// The records of segments reclaimed before may have come from this shard.
+	sh.trimmedTo = sh.segs[0].first
+	sh.trim(horizon)
+	sh.reclaim(horizon)
+	return nil
+}
+
+// roll starts a new segment of sh at seq once the last one has reached segmentSize, and reclaims the segments
+// whose records all arrived before horizon.
+func (sh *shard) roll(dir string, seq uint64, horizon time.Time) error {
+	if sh.segs[len(sh.segs)-1].logSize < segmentSize {
+		return nil
+	}
+	seg, err := createSegment(dir, sh.id, seq)
+	if err != nil {
+		return err
+	}
+	sh.segs = append(sh.segs, seg)
+	sh.trim(horizon)
+	sh.reclaim(horizon)
+	return nil
+}
+
+// reclaim deletes the segments of sh, other than the last, that hold no retained record. trim must have dropped
+// the records that arrived before horizon.
+func (sh *shard) reclaim(horizon time.Time) {
+	i := 0
+	for i < len(sh.segs)-1 && sh.segs[i].last.Before(horizon) {
+		sh.segs[i].remove()
+		i++
+	}
+	sh.segs = sh.segs[i:]
+}
+
+// segment is an append-only file holding records of a shard, each framed as the length of its partition key in
+// two bytes, the partition key and the data, along with an index file locating them by sequence number.
+type segment struct {
+	log, index         *os.File
+	logSize, indexSize int64
+	// first is the sequence number the segment starts at, and next is above that of its last record.
+	first, next uint64
+	// last is the arrival time of its last record.
+	last time.Time
+}
+
+// segmentPath returns the path of the segment of a shard that starts at first, without a suffix.
+func segmentPath(dir, shardID string, first uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%020d", shardID, first))
+}
+
+// createSegment creates an empty segment of a shard starting at first.
+func createSegment(dir, shardID string, first uint64) (*segment, error) {
+	seg, records, err := openSegment(dir, shardID, first)
+	if err == nil && len(records) > 0 {
+		seg.close()
+		err = fmt.Errorf("segment %s of shard %s already exists", formatSeq(first), shardID)
+	}
+	if err == nil {
+		err = syncDir(dir)
+	}
+	return seg, err
+}
+
+// openSegment opens the segment of a shard starting at first and returns the records its index lists. A record
+// whose write was cut short by a crash is dropped, along with anything written after it.
+func openSegment(dir, shardID string, first uint64) (*segment, []record, error) {
+	path := segmentPath(dir, shardID, first)
+	log, err := os.OpenFile(path+segmentSuffix, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	index, err := os.OpenFile(path+indexSuffix, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		log.Close()
+		return nil, nil, err
+	}
+	seg := &segment{log: log, index: index, first: first, next: first}
+	entries, err := ioutil.ReadAll(index)
+	var info os.FileInfo
+	if err == nil {
+		info, err = log.Stat()
+	}
+	if err != nil {
+		seg.close()
+		return nil, nil, err
+	}
+	var records []record
+	for i := 0; i+indexEntrySize <= len(entries); i += indexEntrySize {
+		e := entries[i : i+indexEntrySize]
+		r := record{
+			seq:     binary.BigEndian.Uint64(e[0:]),
+			arrival: time.Unix(0, int64(binary.BigEndian.Uint64(e[8:]))),
+			offset:  int64(binary.BigEndian.Uint64(e[16:])),
+			size:    int(binary.BigEndian.Uint32(e[24:])),
+			seg:     seg,
+		}
+		if r.offset != seg.logSize || r.offset+int64(r.size) > info.Size() {
+			break
+		}
+		records = append(records, r)
+		seg.logSize += int64(r.size)
+		seg.indexSize += indexEntrySize
+		seg.next, seg.last = r.seq+1, r.arrival
+	}
+	if err := log.Truncate(seg.logSize); err != nil {
+		seg.close()
+		return nil, nil, err
+	}
+	if err := index.Truncate(seg.indexSize); err != nil {
+		seg.close()
+		return nil, nil, err
+	}
+	return seg, records, nil
+}
+
+// append writes a record to the end of the segment, then indexes it, and returns where it was written. Both are
+// synced, the record before its index entry, so that a record acknowledged to the caller survives a crash.
+func (seg *segment) append(seq uint64, arrival time.Time, partitionKey string, data []byte) (int64, int, error) {
+	frame := make([]byte, 2+len(partitionKey)+len(data))
+	binary.BigEndian.PutUint16(frame, uint16(len(partitionKey)))
+	copy(frame[2:], partitionKey)
+	copy(frame[2+len(partitionKey):], data)
+	if _, err := seg.log.WriteAt(frame, seg.logSize); err != nil {
+		return 0, 0, err
+	}
+	if err := seg.log.Sync(); err != nil {
+		return 0, 0, err
+	}
+	var e [indexEntrySize]byte
+	binary.BigEndian.PutUint64(e[0:], seq)
+	binary.BigEndian.PutUint64(e[8:], uint64(arrival.UnixNano()))
+	binary.BigEndian.PutUint64(e[16:], uint64(seg.logSize))
+	binary.BigEndian.PutUint32(e[24:], uint32(len(frame)))
+	if _, err := seg.index.WriteAt(e[:], seg.indexSize); err != nil {
+		return 0, 0, err
+	}
+	if err := seg.index.Sync(); err != nil {
+		return 0, 0, err
+	}
+	offset := seg.logSize
+	seg.logSize += int64(len(frame))
+	seg.indexSize += indexEntrySize
+	seg.next, seg.last = seq+1, arrival
+	return offset, len(frame), nil
+}
+
+// read returns the partition key and data of r.
+func (seg *segment) read(r record) (string, []byte, error) {
+	frame := make([]byte, r.size)
+	if _, err := seg.log.ReadAt(frame, r.offset); err != nil {
+		return "", nil, err
+	}
+	n := int(binary.BigEndian.Uint16(frame))
+	if 2+n > len(frame) {
+		return "", nil, errors.New("corrupt segment frame")
+	}
+	return string(frame[2 : 2+n]), frame[2+n:], nil
+}
+
+func (seg *segment) close() error {
+	err := seg.log.Close()
+	if ierr := seg.index.Close(); err == nil {
+		err = ierr
+	}
+	return err
+}
+
+// remove closes the segment and deletes its files.
+func (seg *segment) remove() {
+	seg.close()
+	os.Remove(seg.log.Name())
+	os.Remove(seg.index.Name())
+}
+
+// writeFileAtomic replaces the file at path with data, syncing both the file and its directory, so that a crash
+// leaves either the old or the new contents.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir syncs the directory dir, so that the files created, renamed or removed in it stay that way.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
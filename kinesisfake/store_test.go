@@ -0,0 +1,232 @@
+package kinesisfake
+
+import (
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openDir(t *testing.T, dir string, retention time.Duration) *Kinesis {
+	k, err := Open(Config{Dir: dir, Retention: retention})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return k
+}
+
+func readAll(t *testing.T, k *Kinesis, shardID string) string {
+	return strings.Join(read(t, k, shardID, "TRIM_HORIZON", ""), "")
+}
+
+func TestOpenResumesSavedStreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kinesis")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	k := openDir(t, dir, 0)
+	if _, err := k.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String("s"), ShardCount: aws.Long(1)}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String("k"), ExplicitHashKey: aws.String("1"), Data: []byte("a")})
+	put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String("k"), ExplicitHashKey: aws.String("1"), Data: []byte("b")})
+	split := &kinesis.SplitShardInput{StreamName: aws.String("s"), ShardToSplit: aws.String("shardId-000000000000"), NewStartingHashKey: aws.String("1000")}
+	if _, err := k.SplitShard(split); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	last := put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String("k"), ExplicitHashKey: aws.String("1"), Data: []byte("c")})
+	tags := map[string]*string{"env": aws.String("test")}
+	if _, err := k.AddTagsToStream(&kinesis.AddTagsToStreamInput{StreamName: aws.String("s"), Tags: &tags}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	before := describe(t, k, "s")
+	if err := k.Close(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	k = openDir(t, dir, 0)
+	defer k.Close()
+	after := describe(t, k, "s")
+	if len(after) != len(before) {
+		t.Fatalf("expected %d shards after reopening, was %d", len(before), len(after))
+	}
+	for i := range before {
+		if !reflect.DeepEqual(before[i], after[i]) {
+			t.Errorf("expected shard %s to be unchanged after reopening", *before[i].ShardID)
+		}
+	}
+	if got := readAll(t, k, "shardId-000000000000"); got != "ab" {
+		t.Errorf("expected the parent to hold ab, was %q", got)
+	}
+	if got := readAll(t, k, "shardId-000000000001"); got != "c" {
+		t.Errorf("expected the child to hold c, was %q", got)
+	}
+	next := put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String("k"), ExplicitHashKey: aws.String("1"), Data: []byte("d")})
+	if *next.SequenceNumber <= *last.SequenceNumber {
+		t.Errorf("expected sequence numbers to carry on above %s, was %s", *last.SequenceNumber, *next.SequenceNumber)
+	}
+	listed, err := k.ListTagsForStream(&kinesis.ListTagsForStreamInput{StreamName: aws.String("s")})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(listed.Tags) != 1 || *listed.Tags[0].Key != "env" {
+		t.Errorf("expected the tags to be kept, were %v", listed.Tags)
+	}
+
+	if _, err := k.DeleteStream(&kinesis.DeleteStreamInput{StreamName: aws.String("s")}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "s"+streamDirSuffix)); !os.IsNotExist(err) {
+		t.Errorf("expected the stream directory to be removed, was %v", err)
+	}
+}
+
+func TestOpenDropsTornWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kinesis")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	k := openDir(t, dir, 0)
+	if _, err := k.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String("s"), ShardCount: aws.Long(1)}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String("k"), Data: []byte("a")})
+	put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String("k"), Data: []byte("b")})
+	k.Close()
+
+	// A crash in the middle of a put leaves a frame without its index entry, or an index entry cut short.
+	base := segmentPath(filepath.Join(dir, "s"+streamDirSuffix), "shardId-000000000000", 0)
+	for _, torn := range []struct{ suffix, data string }{{segmentSuffix, "\x00\x01kgarbage"}, {indexSuffix, "\x00\x00\x00"}} {
+		f, err := os.OpenFile(base+torn.suffix, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		f.WriteString(torn.data)
+		f.Close()
+	}
+
+	k = openDir(t, dir, 0)
+	defer k.Close()
+	if got := readAll(t, k, "shardId-000000000000"); got != "ab" {
+		t.Errorf("expected the complete records ab, was %q", got)
+	}
+	put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String("k"), Data: []byte("c")})
+	if got := readAll(t, k, "shardId-000000000000"); got != "abc" {
+		t.Errorf("expected a record put after recovery to follow them, was %q", got)
+	}
+}
+
+func TestRetentionMovesTrimHorizon(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kinesis")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, saved := range []bool{false, true} {
+		config := Config{Retention: 3 * time.Hour}
+		if saved {
+			config.Dir = dir
+		}
+		k, err := Open(config)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		now := time.Unix(1000, 0)
+		k.now = func() time.Time { return now }
+		if _, err := k.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String("s"), ShardCount: aws.Long(1)}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		first := put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String("k"), Data: []byte("a")})
+		now = now.Add(2 * time.Hour)
+		put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String("k"), Data: []byte("b")})
+		if got := readAll(t, k, "shardId-000000000000"); got != "ab" {
+			t.Errorf("saved %v: expected ab within the retention period, was %q", saved, got)
+		}
+
+		now = now.Add(2 * time.Hour)
+		if saved {
+			k.Close()
+			if k, err = open(config, func() time.Time { return now }); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+		}
+		if got := readAll(t, k, "shardId-000000000000"); got != "b" {
+			t.Errorf("saved %v: expected TRIM_HORIZON to move past a, was %q", saved, got)
+		}
+		if got := strings.Join(read(t, k, "shardId-000000000000", "AT_SEQUENCE_NUMBER", *first.SequenceNumber), ""); got != "b" {
+			t.Errorf("saved %v: expected reading at a trimmed record to start at the oldest one left, was %q", saved, got)
+		}
+		k.Close()
+	}
+}
+
+func TestRetentionReclaimsSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kinesis")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(size int64) { segmentSize = size }(segmentSize)
+	// Every record starts a new segment.
+	segmentSize = 1
+
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+	config := Config{Dir: dir, Retention: 3 * time.Hour}
+	k, err := open(config, clock)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err := k.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String("s"), ShardCount: aws.Long(1)}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	segments := func() int {
+		logs, err := filepath.Glob(filepath.Join(dir, "s"+streamDirSuffix, "*"+segmentSuffix))
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		return len(logs)
+	}
+	first := put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String("k"), Data: []byte("a")})
+	now = now.Add(2 * time.Hour)
+	put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String("k"), Data: []byte("b")})
+	if n := segments(); n != 2 {
+		t.Errorf("expected a segment for each of a and b, was %d", n)
+	}
+	now = now.Add(2 * time.Hour)
+	last := put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String("k"), Data: []byte("c")})
+	if n := segments(); n != 2 {
+		t.Errorf("expected the segment of a to be reclaimed when rolling, was %d segments", n)
+	}
+	k.Close()
+
+	// Only the last segment is kept once b and c have expired too.
+	now = now.Add(4 * time.Hour)
+	if k, err = open(config, clock); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer k.Close()
+	if n := segments(); n != 1 {
+		t.Errorf("expected the segment of b to be reclaimed when opening, was %d segments", n)
+	}
+	if got := readAll(t, k, "shardId-000000000000"); got != "" {
+		t.Errorf("expected every record to be trimmed, was %q", got)
+	}
+	next := put(t, k, &kinesis.PutRecordInput{PartitionKey: aws.String("k"), Data: []byte("d")})
+	if *next.SequenceNumber <= *last.SequenceNumber {
+		t.Errorf("expected sequence numbers to carry on above %s, was %s", *last.SequenceNumber, *next.SequenceNumber)
+	}
+	if got := strings.Join(read(t, k, "shardId-000000000000", "AFTER_SEQUENCE_NUMBER", *first.SequenceNumber), ""); got != "d" {
+		t.Errorf("expected reading after a reclaimed record to start at the oldest one left, was %q", got)
+	}
+}
@@ -0,0 +1,221 @@
+package kinesisfake
+
+import (
+	"crypto/md5"
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"math/big"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+type stream struct {
+	name   string
+	shards []*shard
+	tags   map[string]string
+	// nextSeq is the sequence number given to the next record put in any shard of the stream.
+	nextSeq uint64
+	// dir is the directory the stream is saved in, or empty when it is kept in memory.
+	dir string
+}
+
+type shard struct {
+	id                       string
+	parent, adjacentParent   string
+	startHashKey, endHashKey *big.Int
+	startSeq                 uint64
+	// endSeq is the ending sequence number of a closed shard, above that of every record it holds.
+	endSeq uint64
+	closed bool
+	// records are the records still retained, in order. In a saved stream they only locate the partition key and
+	// data in segs, the segments of the shard from the oldest.
+	records []record
+	segs    []*segment
+	// trimmedTo is above the sequence numbers of the records trimmed from sh.
+	trimmedTo uint64
+}
+
+type record struct {
+	seq     uint64
+	arrival time.Time
+	// partitionKey and data are kept here when the shard has no segment.
+	partitionKey string
+	data         []byte
+	// seg, offset and size locate the record in a segment of the shard.
+	seg    *segment
+	offset int64
+	size   int
+}
+
+// reshard closes parents and opens a shard for each of the hash key ranges, with the parents as its own. The
+// children start above the ending sequence numbers of the parents. Nothing changes unless the segments of every
+// child can be created.
+func (s *stream) reshard(parents []*shard, ranges [][2]*big.Int) error {
+	children := make([]*shard, len(ranges))
+	for i, r := range ranges {
+		sh := &shard{id: fmt.Sprintf("shardId-%012d", len(s.shards)+i), startHashKey: r[0], endHashKey: r[1]}
+		if len(parents) > 0 {
+			sh.parent = parents[0].id
+		}
+		if len(parents) > 1 {
+			sh.adjacentParent = parents[1].id
+		}
+		if s.dir != "" {
+			// The children start at the next sequence number, which the segments are named after.
+			seg, err := createSegment(s.dir, sh.id, s.nextSeq+uint64(len(parents)))
+			if err != nil {
+				for _, c := range children[:i] {
+					c.segs[0].remove()
+				}
+				return err
+			}
+			sh.segs = []*segment{seg}
+		}
+		children[i] = sh
+	}
+	for _, p := range parents {
+		// The ending sequence number is reserved so that it stays below the starting sequence numbers of the
+		// children.
+		p.closed = true
+		p.endSeq = s.nextSeq
+		s.nextSeq++
+	}
+	for _, sh := range children {
+		sh.startSeq = s.nextSeq
+		s.shards = append(s.shards, sh)
+	}
+	return s.save()
+}
+
+// shard returns the shard called id.
+func (s *stream) shard(id *string) (*shard, error) {
+	for _, sh := range s.shards {
+		if sh.id == str(id) {
+			return sh, nil
+		}
+	}
+	return nil, apiError("ResourceNotFoundException", "Shard %s in stream %s not found.", str(id), s.name)
+}
+
+// openShard returns the open shard called id.
+func (s *stream) openShard(id *string) (*shard, error) {
+	sh, err := s.shard(id)
+	if err != nil {
+		return nil, err
+	}
+	if sh.closed {
+		return nil, apiError("ResourceInUseException", "Shard %s in stream %s is closed.", sh.id, s.name)
+	}
+	return sh, nil
+}
+
+// route returns the open shard whose hash key range holds the explicit hash key, or the MD5 hash of the partition
+// key when there is none.
+func (s *stream) route(partitionKey, explicitHashKey *string) (*shard, error) {
+	key := str(partitionKey)
+	if n := utf8.RuneCountInString(key); n == 0 || n > MaxPartitionKeyLength {
+		return nil, invalidArgument("PartitionKey must be between 1 and %d characters long.", MaxPartitionKeyLength)
+	}
+	var hashKey *big.Int
+	if explicitHashKey != nil {
+		k, ok := new(big.Int).SetString(*explicitHashKey, 10)
+		if !ok || k.Sign() < 0 || k.Cmp(maxHashKey) > 0 {
+			return nil, invalidArgument("ExplicitHashKey %q is not a hash key.", *explicitHashKey)
+		}
+		hashKey = k
+	} else {
+		sum := md5.Sum([]byte(key))
+		hashKey = new(big.Int).SetBytes(sum[:])
+	}
+	for _, sh := range s.shards {
+		if !sh.closed && sh.startHashKey.Cmp(hashKey) <= 0 && hashKey.Cmp(sh.endHashKey) <= 0 {
+			return sh, nil
+		}
+	}
+	return nil, invalidArgument("No open shard of stream %s covers hash key %s.", s.name, hashKey)
+}
+
+// put appends a record that arrived at now to sh and returns its sequence number. The records that arrived before
+// horizon are reclaimed along with their segments whenever a new segment is started.
+func (s *stream) put(sh *shard, partitionKey string, data []byte, now, horizon time.Time) (string, error) {
+	r := record{seq: s.nextSeq, arrival: now}
+	// Arrival times never go backwards within a shard, so that retention trims a prefix of it.
+	if n := len(sh.records); n > 0 && now.Before(sh.records[n-1].arrival) {
+		r.arrival = sh.records[n-1].arrival
+	}
+	if len(sh.segs) > 0 {
+		if err := sh.roll(s.dir, r.seq, horizon); err != nil {
+			return "", err
+		}
+		r.seg = sh.segs[len(sh.segs)-1]
+		var err error
+		if r.offset, r.size, err = r.seg.append(r.seq, r.arrival, partitionKey, data); err != nil {
+			return "", err
+		}
+	} else {
+		r.partitionKey, r.data = partitionKey, append([]byte(nil), data...)
+	}
+	s.nextSeq++
+	sh.records = append(sh.records, r)
+	return formatSeq(r.seq), nil
+}
+
+// read returns the partition key and a copy of the data of r, a record of sh.
+func (sh *shard) read(r record) (string, []byte, error) {
+	if r.seg != nil {
+		return r.seg.read(r)
+	}
+	return r.partitionKey, append([]byte(nil), r.data...), nil
+}
+
+// trim drops the records that arrived before horizon, which moves TRIM_HORIZON past them. Trimmed records are
+// no longer read, though a segment keeps them on disk until it is reclaimed whole.
+func (sh *shard) trim(horizon time.Time) {
+	i := sort.Search(len(sh.records), func(i int) bool { return !sh.records[i].arrival.Before(horizon) })
+	if i > 0 {
+		sh.trimmedTo = sh.records[i-1].seq + 1
+		sh.records = append([]record(nil), sh.records[i:]...)
+	}
+}
+
+// describe returns the description of sh that DescribeStream lists.
+func (sh *shard) describe() *kinesis.Shard {
+	d := &kinesis.Shard{
+		HashKeyRange: &kinesis.HashKeyRange{
+			StartingHashKey: aws.String(sh.startHashKey.String()),
+			EndingHashKey:   aws.String(sh.endHashKey.String()),
+		},
+		SequenceNumberRange: &kinesis.SequenceNumberRange{StartingSequenceNumber: aws.String(formatSeq(sh.startSeq))},
+		ShardID:             aws.String(sh.id),
+	}
+	if sh.parent != "" {
+		d.ParentShardID = aws.String(sh.parent)
+	}
+	if sh.adjacentParent != "" {
+		d.AdjacentParentShardID = aws.String(sh.adjacentParent)
+	}
+	if sh.closed {
+		d.SequenceNumberRange.EndingSequenceNumber = aws.String(formatSeq(sh.endSeq))
+	}
+	return d
+}
+
+// issued reports whether seq is the sequence number of a record put in sh. Those of trimmed records are taken
+// to be, as they can no longer be told apart from those of other shards.
+func (sh *shard) issued(seq uint64) bool {
+	if seq < sh.startSeq || (sh.closed && seq >= sh.endSeq) {
+		return false
+	}
+	if seq < sh.trimmedTo {
+		return true
+	}
+	i := sh.from(seq)
+	return i < len(sh.records) && sh.records[i].seq == seq
+}
+
+// from returns the index of the first retained record of sh whose sequence number is at least seq.
+func (sh *shard) from(seq uint64) int {
+	return sort.Search(len(sh.records), func(i int) bool { return sh.records[i].seq >= seq })
+}
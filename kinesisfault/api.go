@@ -0,0 +1,177 @@
+package kinesisfault
+
+import (
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"github.com/awslabs/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+// Wrap returns api with the faults of in injected into every call made to it. Failed calls return an
+// aws.APIError, as the SDK client does once it has spent its own retries, or ErrConnectionDropped.
+func (in *Injector) Wrap(api kinesisiface.KinesisAPI) kinesisiface.KinesisAPI {
+	return &faultyAPI{api: api, in: in}
+}
+
+type faultyAPI struct {
+	api kinesisiface.KinesisAPI
+	in  *Injector
+}
+
+var _ kinesisiface.KinesisAPI = (*faultyAPI)(nil)
+
+// do makes the call to op unless it is decided to fail before it is made, and loses its outcome if it is decided
+// to fail after.
+func (in *Injector) do(op string, call func() error) error {
+	f := in.call(op)
+	switch f {
+	case noFault:
+		return call()
+	case dropRequest:
+		return ErrConnectionDropped
+	case dropResponse:
+		call()
+		return ErrConnectionDropped
+	}
+	status, code := f.status(op)
+	return aws.APIError{StatusCode: status, Code: code, Message: message(code)}
+}
+
+func (a *faultyAPI) AddTagsToStream(input *kinesis.AddTagsToStreamInput) (*kinesis.AddTagsToStreamOutput, error) {
+	var out *kinesis.AddTagsToStreamOutput
+	if err := a.in.do("AddTagsToStream", func() (err error) { out, err = a.api.AddTagsToStream(input); return }); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (a *faultyAPI) CreateStream(input *kinesis.CreateStreamInput) (*kinesis.CreateStreamOutput, error) {
+	var out *kinesis.CreateStreamOutput
+	if err := a.in.do("CreateStream", func() (err error) { out, err = a.api.CreateStream(input); return }); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (a *faultyAPI) DeleteStream(input *kinesis.DeleteStreamInput) (*kinesis.DeleteStreamOutput, error) {
+	var out *kinesis.DeleteStreamOutput
+	if err := a.in.do("DeleteStream", func() (err error) { out, err = a.api.DeleteStream(input); return }); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (a *faultyAPI) DescribeStream(input *kinesis.DescribeStreamInput) (*kinesis.DescribeStreamOutput, error) {
+	var out *kinesis.DescribeStreamOutput
+	if err := a.in.do("DescribeStream", func() (err error) { out, err = a.api.DescribeStream(input); return }); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (a *faultyAPI) GetRecords(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	var out *kinesis.GetRecordsOutput
+	if err := a.in.do("GetRecords", func() (err error) { out, err = a.api.GetRecords(input); return }); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (a *faultyAPI) GetShardIterator(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	var out *kinesis.GetShardIteratorOutput
+	if err := a.in.do("GetShardIterator", func() (err error) { out, err = a.api.GetShardIterator(input); return }); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (a *faultyAPI) ListStreams(input *kinesis.ListStreamsInput) (*kinesis.ListStreamsOutput, error) {
+	var out *kinesis.ListStreamsOutput
+	if err := a.in.do("ListStreams", func() (err error) { out, err = a.api.ListStreams(input); return }); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (a *faultyAPI) ListTagsForStream(input *kinesis.ListTagsForStreamInput) (*kinesis.ListTagsForStreamOutput, error) {
+	var out *kinesis.ListTagsForStreamOutput
+	if err := a.in.do("ListTagsForStream", func() (err error) { out, err = a.api.ListTagsForStream(input); return }); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (a *faultyAPI) MergeShards(input *kinesis.MergeShardsInput) (*kinesis.MergeShardsOutput, error) {
+	var out *kinesis.MergeShardsOutput
+	if err := a.in.do("MergeShards", func() (err error) { out, err = a.api.MergeShards(input); return }); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (a *faultyAPI) PutRecord(input *kinesis.PutRecordInput) (*kinesis.PutRecordOutput, error) {
+	var out *kinesis.PutRecordOutput
+	if err := a.in.do("PutRecord", func() (err error) { out, err = a.api.PutRecord(input); return }); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PutRecords sends on the entries that are not decided to fail and gives the others their injected error code in
+// the output, in their place.
+func (a *faultyAPI) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	var out *kinesis.PutRecordsOutput
+	err := a.in.do("PutRecords", func() error {
+		codes := a.in.failEntries("PutRecords", len(input.Records))
+		sent := *input
+		sent.Records = nil
+		for i, e := range input.Records {
+			if codes[i] == "" {
+				sent.Records = append(sent.Records, e)
+			}
+		}
+		passed := &kinesis.PutRecordsOutput{FailedRecordCount: aws.Long(0)}
+		if len(sent.Records) > 0 {
+			var err error
+			if passed, err = a.api.PutRecords(&sent); err != nil {
+				return err
+			}
+		}
+		failed := int64(0)
+		if passed.FailedRecordCount != nil {
+			failed = *passed.FailedRecordCount
+		}
+		out = &kinesis.PutRecordsOutput{Records: make([]*kinesis.PutRecordsResultEntry, len(codes))}
+		next := 0
+		for i, code := range codes {
+			if code == "" {
+				out.Records[i] = passed.Records[next]
+				next++
+				continue
+			}
+			out.Records[i] = &kinesis.PutRecordsResultEntry{ErrorCode: aws.String(code), ErrorMessage: aws.String(message(code))}
+			failed++
+		}
+		out.FailedRecordCount = aws.Long(failed)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (a *faultyAPI) RemoveTagsFromStream(input *kinesis.RemoveTagsFromStreamInput) (*kinesis.RemoveTagsFromStreamOutput, error) {
+	var out *kinesis.RemoveTagsFromStreamOutput
+	if err := a.in.do("RemoveTagsFromStream", func() (err error) { out, err = a.api.RemoveTagsFromStream(input); return }); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (a *faultyAPI) SplitShard(input *kinesis.SplitShardInput) (*kinesis.SplitShardOutput, error) {
+	var out *kinesis.SplitShardOutput
+	if err := a.in.do("SplitShard", func() (err error) { out, err = a.api.SplitShard(input); return }); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
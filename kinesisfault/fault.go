@@ -0,0 +1,238 @@
+// Package kinesisfault injects the failures Kinesis is known for into the calls made to it: throttling,
+// PutRecords entries that fail on their own, expired shard iterators, 5xx responses, latency and dropped
+// connections.
+//
+// An Injector decides which calls fail. It can sit below the SDK client, as the transport of the HTTP client in
+// aws.Config.HTTPClient, or above it, wrapping a kinesisiface.KinesisAPI such as the client or a
+// kinesisfake.Kinesis. Decisions are drawn from a random source seeded by Config.Seed, so a scenario fails the
+// same calls every time it is run, as long as the calls are made in the same order.
+package kinesisfault
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrConnectionDropped is the error of a call whose connection was dropped. The request may or may not have
+// reached Kinesis.
+var ErrConnectionDropped = errors.New("connection dropped")
+
+// Config describes a fault scenario. Rates are the probabilities, between 0 and 1, that a call fails in the
+// given way; the zero Config injects nothing.
+type Config struct {
+	// Seed seeds the random source the faults are drawn from.
+	Seed int64
+	// Operations limits the faults to the named operations, such as "PutRecords". Nil means every operation.
+	Operations []string
+
+	// Throttle is the rate of calls being throttled, which fail with ProvisionedThroughputExceededException when
+	// they put or get records and with LimitExceededException otherwise, as they do against Kinesis.
+	Throttle float64
+	// ServerError is the rate of calls failing with a 500 InternalFailure or a 503 ServiceUnavailable.
+	ServerError float64
+	// Drop is the rate of calls whose connection is dropped, either before the request is sent or after it was
+	// handled, with the response lost.
+	Drop float64
+	// ExpireIterator is the rate of GetRecords calls failing with ExpiredIteratorException.
+	ExpireIterator float64
+
+	// FailEntry is the rate at which each entry of a PutRecords call that goes through fails on its own. Failed
+	// entries are not put.
+	FailEntry float64
+	// EntryErrorCodes are the error codes failed entries are given, picked at random. Nil means
+	// ProvisionedThroughputExceededException and InternalFailure.
+	EntryErrorCodes []string
+
+	// Latency delays every call.
+	Latency time.Duration
+	// Jitter further delays every call by up to its value.
+	Jitter time.Duration
+}
+
+// Error codes of the injected failures.
+const (
+	codeThroughputExceeded = "ProvisionedThroughputExceededException"
+	codeLimitExceeded      = "LimitExceededException"
+	codeExpiredIterator    = "ExpiredIteratorException"
+	codeInternalFailure    = "InternalFailure"
+	codeUnavailable        = "ServiceUnavailable"
+)
+
+var defaultEntryErrorCodes = []string{codeThroughputExceeded, codeInternalFailure}
+
+// dataPlane holds the operations that put and get records, which are throttled by the throughput of the shards.
+// The others are throttled by the rate limits of the account.
+var dataPlane = map[string]bool{
+	"GetRecords":       true,
+	"GetShardIterator": true,
+	"PutRecord":        true,
+	"PutRecords":       true,
+}
+
+// fault is the way a call is made to fail.
+type fault int
+
+const (
+	noFault fault = iota
+	throttle
+	expireIterator
+	internalFailure
+	unavailable
+	// dropRequest drops the connection before the request is sent and dropResponse after it was handled.
+	dropRequest
+	dropResponse
+)
+
+// Stats counts the faults an Injector has injected.
+type Stats struct {
+	Calls            int
+	Throttled        int
+	ExpiredIterators int
+	ServerErrors     int
+	Dropped          int
+	FailedEntries    int
+}
+
+// Injector decides which calls fail according to a Config. It is safe for concurrent use, though the calls only
+// fail the same way from one run to the next if they reach it in the same order.
+type Injector struct {
+	config     Config
+	operations map[string]bool
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	stats Stats
+
+	// sleep is swapped out by tests so that latency does not slow them down.
+	sleep func(time.Duration)
+}
+
+// New returns an Injector for the scenario described by config.
+func New(config Config) *Injector {
+	in := &Injector{config: config, rand: rand.New(rand.NewSource(config.Seed)), sleep: time.Sleep}
+	if config.Operations != nil {
+		in.operations = make(map[string]bool)
+		for _, op := range config.Operations {
+			in.operations[op] = true
+		}
+	}
+	if in.config.EntryErrorCodes == nil {
+		in.config.EntryErrorCodes = defaultEntryErrorCodes
+	}
+	return in
+}
+
+// Stats returns the number of calls seen and faults injected so far.
+func (in *Injector) Stats() Stats {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.stats
+}
+
+// applies reports whether faults are injected into op.
+func (in *Injector) applies(op string) bool {
+	return in.operations == nil || in.operations[op]
+}
+
+// call decides how a call to op fails and waits out its latency. Every call draws the same number of values from
+// the random source whatever is decided, so that one decision does not shift those that follow.
+func (in *Injector) call(op string) fault {
+	if !in.applies(op) {
+		return noFault
+	}
+	in.mu.Lock()
+	delay := in.config.Latency
+	jitter := in.rand.Float64()
+	kind := in.rand.Float64()
+	variant := in.rand.Intn(2)
+	if in.config.Jitter > 0 {
+		delay += time.Duration(jitter * float64(in.config.Jitter))
+	}
+	// The rates are laid end to end over [0, 1) and kind picks the fault whose stretch it falls in.
+	throttled := in.config.Throttle
+	failed := throttled + in.config.ServerError
+	dropped := failed + in.config.Drop
+	expired := dropped + in.config.ExpireIterator
+	f := noFault
+	in.stats.Calls++
+	switch {
+	case kind < throttled:
+		f = throttle
+		in.stats.Throttled++
+	case kind < failed:
+		f = internalFailure
+		if variant == 1 {
+			f = unavailable
+		}
+		in.stats.ServerErrors++
+	case kind < dropped:
+		f = dropRequest
+		if variant == 1 {
+			f = dropResponse
+		}
+		in.stats.Dropped++
+	case op == "GetRecords" && kind < expired:
+		f = expireIterator
+		in.stats.ExpiredIterators++
+	}
+	in.mu.Unlock()
+	if delay > 0 {
+		in.sleep(delay)
+	}
+	return f
+}
+
+// failEntries decides which of the n entries of a PutRecords call fail, and returns the error code of each, or
+// an empty string for those that go through.
+func (in *Injector) failEntries(op string, n int) []string {
+	codes := make([]string, n)
+	if !in.applies(op) || in.config.FailEntry <= 0 {
+		return codes
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for i := range codes {
+		fails := in.rand.Float64() < in.config.FailEntry
+		code := in.config.EntryErrorCodes[in.rand.Intn(len(in.config.EntryErrorCodes))]
+		if fails {
+			codes[i] = code
+			in.stats.FailedEntries++
+		}
+	}
+	return codes
+}
+
+// status returns the HTTP status code and error code of an injected failure of a call to op.
+func (f fault) status(op string) (int, string) {
+	switch f {
+	case throttle:
+		if !dataPlane[op] {
+			return 400, codeLimitExceeded
+		}
+		return 400, codeThroughputExceeded
+	case expireIterator:
+		return 400, codeExpiredIterator
+	case internalFailure:
+		return 500, codeInternalFailure
+	case unavailable:
+		return 503, codeUnavailable
+	}
+	return 0, ""
+}
+
+// message returns the error message of an injected failure with the given code.
+func message(code string) string {
+	switch code {
+	case codeThroughputExceeded:
+		return "Rate exceeded for shard."
+	case codeLimitExceeded:
+		return "Rate exceeded for stream."
+	case codeExpiredIterator:
+		return "Iterator expired."
+	case codeUnavailable:
+		return "Service unavailable."
+	}
+	return "Internal service failure."
+}
@@ -0,0 +1,301 @@
+package kinesisfault
+
+import (
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/aws/credentials"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"github.com/awslabs/aws-sdk-go/service/kinesis/kinesisiface"
+	"github.com/brettcannon/kinesis-experiment/kinesisfake"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newStream(t *testing.T) *kinesisfake.Kinesis {
+	k := kinesisfake.New()
+	if _, err := k.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String("s"), ShardCount: aws.Long(1)}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return k
+}
+
+// faults returns the fault decided for each of n calls to op.
+func faults(in *Injector, op string, n int) []fault {
+	var got []fault
+	for i := 0; i < n; i++ {
+		got = append(got, in.call(op))
+	}
+	return got
+}
+
+func TestInjectorIsDeterministic(t *testing.T) {
+	config := Config{Seed: 7, Throttle: 0.1, ServerError: 0.1, Drop: 0.1, ExpireIterator: 0.1}
+	first := faults(New(config), "GetRecords", 200)
+	if again := faults(New(config), "GetRecords", 200); !reflect.DeepEqual(first, again) {
+		t.Errorf("expected the same seed to inject the same faults")
+	}
+	config.Seed = 8
+	if other := faults(New(config), "GetRecords", 200); reflect.DeepEqual(first, other) {
+		t.Errorf("expected another seed to inject other faults")
+	}
+	seen := make(map[fault]bool)
+	for _, f := range first {
+		seen[f] = true
+	}
+	if len(seen) != 7 {
+		t.Errorf("expected every kind of fault in 200 calls, was %v", seen)
+	}
+}
+
+func TestInjectorRates(t *testing.T) {
+	in := New(Config{Seed: 1, Throttle: 0.2, ExpireIterator: 0.3})
+	faults(in, "GetRecords", 1000)
+	faults(in, "PutRecord", 1000)
+	stats := in.Stats()
+	if stats.Calls != 2000 {
+		t.Errorf("expected 2000 calls, was %d", stats.Calls)
+	}
+	if stats.Throttled < 350 || stats.Throttled > 450 {
+		t.Errorf("expected about 400 throttled calls, was %d", stats.Throttled)
+	}
+	if stats.ExpiredIterators < 250 || stats.ExpiredIterators > 350 {
+		t.Errorf("expected about 300 expired iterators, only from GetRecords, was %d", stats.ExpiredIterators)
+	}
+	if stats.ServerErrors != 0 || stats.Dropped != 0 {
+		t.Errorf("expected no other faults, were %+v", stats)
+	}
+}
+
+func TestInjectorLatency(t *testing.T) {
+	in := New(Config{Latency: 10 * time.Millisecond, Jitter: 5 * time.Millisecond, Operations: []string{"PutRecord"}})
+	var delays []time.Duration
+	in.sleep = func(d time.Duration) { delays = append(delays, d) }
+	faults(in, "PutRecord", 50)
+	faults(in, "GetRecords", 50)
+	if len(delays) != 50 {
+		t.Fatalf("expected only the 50 PutRecord calls to be delayed, were %d", len(delays))
+	}
+	for _, d := range delays {
+		if d < 10*time.Millisecond || d > 15*time.Millisecond {
+			t.Errorf("expected a delay between 10ms and 15ms, was %v", d)
+		}
+	}
+}
+
+func TestWrapFailsCalls(t *testing.T) {
+	for _, test := range []struct {
+		config Config
+		codes  []string
+	}{
+		{Config{Throttle: 1}, []string{"ProvisionedThroughputExceededException"}},
+		{Config{ServerError: 1}, []string{"InternalFailure", "ServiceUnavailable"}},
+		{Config{ExpireIterator: 1}, []string{"ExpiredIteratorException"}},
+	} {
+		api := New(test.config).Wrap(newStream(t))
+		it, err := api.GetShardIterator(&kinesis.GetShardIteratorInput{StreamName: aws.String("s"), ShardID: aws.String("shardId-000000000000"), ShardIteratorType: aws.String("LATEST")})
+		if test.config.ExpireIterator == 0 {
+			if e := aws.Error(err); e == nil || e.Code != test.codes[0] && e.Code != test.codes[len(test.codes)-1] {
+				t.Errorf("%+v: expected GetShardIterator to fail with %v, was %v", test.config, test.codes, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		_, err = api.GetRecords(&kinesis.GetRecordsInput{ShardIterator: it.ShardIterator})
+		if e := aws.Error(err); e == nil || e.Code != test.codes[0] {
+			t.Errorf("%+v: expected GetRecords to fail with %v, was %v", test.config, test.codes, err)
+		}
+	}
+
+	api := New(Config{Throttle: 1}).Wrap(newStream(t))
+	_, err := api.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String("s")})
+	if e := aws.Error(err); e == nil || e.Code != "LimitExceededException" {
+		t.Errorf("expected DescribeStream to be throttled with LimitExceededException, was %v", err)
+	}
+}
+
+func TestWrapDropsConnections(t *testing.T) {
+	k := newStream(t)
+	in := New(Config{Seed: 3, Drop: 1, Operations: []string{"PutRecord"}})
+	api := in.Wrap(k)
+	for i := 0; i < 20; i++ {
+		out, err := api.PutRecord(&kinesis.PutRecordInput{StreamName: aws.String("s"), PartitionKey: aws.String("k"), Data: []byte("x")})
+		if err != ErrConnectionDropped || out != nil {
+			t.Fatalf("expected the connection to be dropped, was %v, %v", out, err)
+		}
+	}
+	// Only the records whose responses were lost were put.
+	it, err := k.GetShardIterator(&kinesis.GetShardIteratorInput{StreamName: aws.String("s"), ShardID: aws.String("shardId-000000000000"), ShardIteratorType: aws.String("TRIM_HORIZON")})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	out, err := k.GetRecords(&kinesis.GetRecordsInput{ShardIterator: it.ShardIterator})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	lost := 0
+	for _, f := range faults(New(Config{Seed: 3, Drop: 1}), "PutRecord", 20) {
+		if f == dropResponse {
+			lost++
+		}
+	}
+	if lost == 0 || lost == 20 || len(out.Records) != lost {
+		t.Errorf("expected %d records put with their responses lost, was %d", lost, len(out.Records))
+	}
+}
+
+// putRecords puts n records, named by their index, through api and returns the output along with the records
+// that reached the stream.
+func putRecords(t *testing.T, api kinesisiface.KinesisAPI, k *kinesisfake.Kinesis, n int) (*kinesis.PutRecordsOutput, []string) {
+	input := &kinesis.PutRecordsInput{StreamName: aws.String("s")}
+	for i := 0; i < n; i++ {
+		input.Records = append(input.Records, &kinesis.PutRecordsRequestEntry{PartitionKey: aws.String("k"), Data: []byte(fmt.Sprint(i))})
+	}
+	out, err := api.PutRecords(input)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	it, err := k.GetShardIterator(&kinesis.GetShardIteratorInput{StreamName: aws.String("s"), ShardID: aws.String("shardId-000000000000"), ShardIteratorType: aws.String("TRIM_HORIZON")})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	got, err := k.GetRecords(&kinesis.GetRecordsInput{ShardIterator: it.ShardIterator})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var put []string
+	for _, r := range got.Records {
+		put = append(put, string(r.Data))
+	}
+	return out, put
+}
+
+// checkEntries checks that out reports the entries that failed and that exactly the others were put.
+func checkEntries(t *testing.T, out *kinesis.PutRecordsOutput, put []string, n int) {
+	var failed int64
+	var passed []string
+	for i, r := range out.Records {
+		if r.ErrorCode == nil {
+			passed = append(passed, fmt.Sprint(i))
+			continue
+		}
+		if *r.ErrorCode != "ProvisionedThroughputExceededException" && *r.ErrorCode != "InternalFailure" {
+			t.Errorf("unexpected error code %s", *r.ErrorCode)
+		}
+		failed++
+	}
+	if len(out.Records) != n || *out.FailedRecordCount != failed || failed == 0 || failed == int64(n) {
+		t.Errorf("expected some of %d entries to fail, were %d of %d", n, *out.FailedRecordCount, len(out.Records))
+	}
+	if !reflect.DeepEqual(passed, put) {
+		t.Errorf("expected the entries %v to be put, were %v", passed, put)
+	}
+}
+
+func TestWrapFailsEntries(t *testing.T) {
+	k := newStream(t)
+	in := New(Config{Seed: 5, FailEntry: 0.5})
+	out, put := putRecords(t, in.Wrap(k), k, 20)
+	checkEntries(t, out, put, 20)
+	if in.Stats().FailedEntries != int(*out.FailedRecordCount) {
+		t.Errorf("expected %d failed entries to be counted, were %d", *out.FailedRecordCount, in.Stats().FailedEntries)
+	}
+}
+
+// newClient returns an SDK client for a local server, sending its requests through in.
+func newClient(t *testing.T, in *Injector, maxRetries int) (*kinesis.Kinesis, *kinesisfake.Kinesis, func()) {
+	k := newStream(t)
+	server := httptest.NewServer(kinesisfake.NewHandler(k))
+	c := kinesis.New(&aws.Config{
+		Credentials: credentials.NewStaticCredentials("local", "local", ""),
+		Endpoint:    server.URL,
+		Region:      "us-east-1",
+		HTTPClient:  in.HTTPClient(nil),
+		MaxRetries:  maxRetries,
+	})
+	return c, k, server.Close
+}
+
+func TestTransportFailsCalls(t *testing.T) {
+	in := New(Config{Throttle: 1, Operations: []string{"DescribeStream", "GetShardIterator"}})
+	c, _, done := newClient(t, in, 2)
+	defer done()
+	_, err := c.GetShardIterator(&kinesis.GetShardIteratorInput{StreamName: aws.String("s"), ShardID: aws.String("shardId-000000000000"), ShardIteratorType: aws.String("LATEST")})
+	if e := aws.Error(err); e == nil || e.Code != "ProvisionedThroughputExceededException" {
+		t.Errorf("expected GetShardIterator to be throttled, was %v", err)
+	}
+	if calls := in.Stats().Calls; calls != 3 {
+		t.Errorf("expected the client to try 3 times, was %d", calls)
+	}
+	// Control plane calls are throttled with LimitExceededException, which the client does not retry.
+	_, err = c.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String("s")})
+	if e := aws.Error(err); e == nil || e.Code != "LimitExceededException" {
+		t.Errorf("expected DescribeStream to be throttled, was %v", err)
+	}
+	if calls := in.Stats().Calls; calls != 4 {
+		t.Errorf("expected the client to try DescribeStream once, was %d calls", calls-3)
+	}
+	if _, err := c.ListStreams(&kinesis.ListStreamsInput{}); err != nil {
+		t.Errorf("expected other operations to go through, was %v", err)
+	}
+}
+
+func TestTransportRetriedServerErrors(t *testing.T) {
+	in := New(Config{Seed: 2, ServerError: 0.3})
+	c, _, done := newClient(t, in, 5)
+	defer done()
+	for i := 0; i < 10; i++ {
+		if _, err := c.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String("s")}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if in.Stats().ServerErrors == 0 {
+		t.Errorf("expected the client to have retried server errors")
+	}
+}
+
+func TestTransportDropsConnections(t *testing.T) {
+	in := New(Config{Drop: 1})
+	c, _, done := newClient(t, in, 2)
+	defer done()
+	_, err := c.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String("s")})
+	if e, ok := err.(*url.Error); !ok || e.Err != ErrConnectionDropped {
+		t.Errorf("expected the connection to be dropped, was %v", err)
+	}
+}
+
+func TestTransportFailsEntries(t *testing.T) {
+	in := New(Config{Seed: 5, FailEntry: 0.5})
+	c, k, done := newClient(t, in, 0)
+	defer done()
+	out, put := putRecords(t, c, k, 20)
+	checkEntries(t, out, put, 20)
+
+	// An injector with the same seed fails the same entries above the client as below it.
+	k = newStream(t)
+	wrapped, _ := putRecords(t, New(Config{Seed: 5, FailEntry: 0.5}).Wrap(k), k, 20)
+	for i := range out.Records {
+		if (out.Records[i].ErrorCode == nil) != (wrapped.Records[i].ErrorCode == nil) {
+			t.Errorf("expected entry %d to fail the same way through the transport and the wrapper", i)
+		}
+	}
+}
+
+func TestTransportFailsEveryEntry(t *testing.T) {
+	in := New(Config{FailEntry: 1, EntryErrorCodes: []string{"InternalFailure"}})
+	c, k, done := newClient(t, in, 0)
+	defer done()
+	out, put := putRecords(t, c, k, 3)
+	if *out.FailedRecordCount != 3 || len(put) != 0 {
+		t.Errorf("expected every entry to fail, %d did and %d were put", *out.FailedRecordCount, len(put))
+	}
+	for _, r := range out.Records {
+		if r.ErrorCode == nil || *r.ErrorCode != "InternalFailure" {
+			t.Errorf("expected InternalFailure, was %v", r.ErrorCode)
+		}
+	}
+}
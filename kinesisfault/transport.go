@@ -0,0 +1,196 @@
+package kinesisfault
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Transport returns an http.RoundTripper that injects the faults of in into the Kinesis calls sent through base,
+// or http.DefaultTransport when base is nil. Calls are told apart by their X-Amz-Target header; requests without
+// one go through untouched. The SDK client retries throttled calls and 5xx responses itself, so they reach the
+// caller only once its retries are spent.
+//
+// Failed PutRecords entries are taken out of the request body, which leaves its signature stale. Against a
+// Kinesis that checks signatures, leave FailEntry at zero and wrap the client with Wrap for them instead.
+func (in *Injector) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &transport{in: in, base: base}
+}
+
+// HTTPClient returns a client for aws.Config.HTTPClient that sends its requests through in.Transport(base).
+func (in *Injector) HTTPClient(base http.RoundTripper) *http.Client {
+	return &http.Client{Transport: in.Transport(base)}
+}
+
+type transport struct {
+	in   *Injector
+	base http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target := req.Header.Get("X-Amz-Target")
+	if target == "" {
+		return t.base.RoundTrip(req)
+	}
+	op := target[strings.LastIndex(target, ".")+1:]
+	f := t.in.call(op)
+	switch f {
+	case noFault, dropResponse:
+	case dropRequest:
+		closeBody(req)
+		return nil, ErrConnectionDropped
+	default:
+		closeBody(req)
+		status, code := f.status(op)
+		body, _ := json.Marshal(map[string]string{"__type": code, "message": message(code)})
+		return jsonResponse(req, status, body), nil
+	}
+
+	var codes []string
+	if op == "PutRecords" {
+		var err error
+		if req, codes, err = t.failEntries(req); err != nil {
+			return nil, err
+		}
+	}
+	var resp *http.Response
+	var err error
+	if codes != nil && !anyPassed(codes) {
+		resp = jsonResponse(req, http.StatusOK, mergeEntries(codes, nil, 0))
+	} else {
+		resp, err = t.base.RoundTrip(req)
+		if err == nil && codes != nil {
+			resp, err = mergeResponse(resp, codes)
+		}
+	}
+	if f == dropResponse {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, ErrConnectionDropped
+	}
+	return resp, err
+}
+
+// failEntries decides which entries of a PutRecords request fail, and returns the request with those taken out
+// along with the error code of every entry. The codes are nil when no entry fails, or when the body is not one the
+// transport understands and is left for Kinesis to reject.
+func (t *transport) failEntries(req *http.Request) (*http.Request, []string, error) {
+	if req.Body == nil {
+		return req, nil, nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	r := new(http.Request)
+	*r = *req
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var fields map[string]json.RawMessage
+	var records []json.RawMessage
+	if json.Unmarshal(body, &fields) != nil || json.Unmarshal(fields["Records"], &records) != nil {
+		return r, nil, nil
+	}
+	codes := t.in.failEntries("PutRecords", len(records))
+	if !anyFailed(codes) {
+		return r, nil, nil
+	}
+	var sent []json.RawMessage
+	for i, record := range records {
+		if codes[i] == "" {
+			sent = append(sent, record)
+		}
+	}
+	fields["Records"], _ = json.Marshal(sent)
+	body, _ = json.Marshal(fields)
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return r, codes, nil
+}
+
+// mergeResponse puts the injected failures into the response to a PutRecords request that had them taken out.
+// Error responses are returned as they are.
+func mergeResponse(resp *http.Response, codes []string) (*http.Response, error) {
+	if resp.StatusCode != http.StatusOK {
+		return resp, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	var out struct {
+		FailedRecordCount int64
+		Records           []json.RawMessage
+	}
+	if err := json.Unmarshal(body, &out); err != nil {
+		return nil, err
+	}
+	body = mergeEntries(codes, out.Records, out.FailedRecordCount)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", fmt.Sprint(len(body)))
+	return resp, nil
+}
+
+// mergeEntries returns the body of a PutRecords response holding a failed entry for every non-empty code and,
+// in order, the entries Kinesis returned for the others.
+func mergeEntries(codes []string, passed []json.RawMessage, failed int64) []byte {
+	records := make([]json.RawMessage, len(codes))
+	for i, code := range codes {
+		if code == "" && len(passed) > 0 {
+			records[i], passed = passed[0], passed[1:]
+			continue
+		}
+		records[i], _ = json.Marshal(map[string]string{"ErrorCode": code, "ErrorMessage": message(code)})
+		failed++
+	}
+	body, _ := json.Marshal(map[string]interface{}{"FailedRecordCount": failed, "Records": records})
+	return body
+}
+
+func anyFailed(codes []string) bool {
+	for _, code := range codes {
+		if code != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func anyPassed(codes []string) bool {
+	for _, code := range codes {
+		if code == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonResponse(req *http.Request, status int, body []byte) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/x-amz-json-1.1"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
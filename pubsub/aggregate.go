@@ -0,0 +1,326 @@
+package pubsub
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"unicode/utf8"
+)
+
+// maxAggregateSize is the most an aggregated record may hold so that, with the partition key of the entry that
+// carries it, it still fits in a single Kinesis record.
+const maxAggregateSize = maxRecordSize - utf8.UTFMax*MaxPartitionKeyLength
+
+// aggregatedMagic starts every record written in the Kinesis Producer Library (KPL) aggregated format. It is
+// followed by a protobuf-encoded AggregatedRecord and the MD5 digest of that protobuf.
+var aggregatedMagic = []byte{0xF3, 0x89, 0x9A, 0xC2}
+
+// Field numbers of the KPL protobuf messages:
+//
+//	message AggregatedRecord {
+//	  repeated string partition_key_table     = 1;
+//	  repeated string explicit_hash_key_table = 2;
+//	  repeated Record records                 = 3;
+//	}
+//	message Record {
+//	  required uint64 partition_key_index     = 1;
+//	  optional uint64 explicit_hash_key_index = 2;
+//	  required bytes  data                    = 3;
+//	  repeated Tag    tags                    = 4;
+//	}
+const (
+	fieldPartitionKeyTable    = 1
+	fieldExplicitHashKeyTable = 2
+	fieldRecords              = 3
+
+	fieldPartitionKeyIndex    = 1
+	fieldExplicitHashKeyIndex = 2
+	fieldData                 = 3
+)
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// errMalformedAggregate is returned when an aggregated record's protobuf body cannot be decoded.
+var errMalformedAggregate = errors.New("malformed aggregated record")
+
+// UserRecord is a logical record as the publisher wrote it. Several of them may have been packed into a single
+// aggregated Kinesis record, in which case they share its sequence number and are told apart by their
+// SubSequenceNumber.
+type UserRecord struct {
+	PartitionKey    string
+	ExplicitHashKey string
+	Data            []byte
+
+	SequenceNumber    string
+	SubSequenceNumber int
+	// Aggregated is true when the record was unpacked from an aggregated Kinesis record.
+	Aggregated bool
+}
+
+// aggregator packs user records into KPL aggregated records.
+type aggregator struct {
+	keys    []string
+	keyIdx  map[string]int
+	records [][]byte
+	size    int
+}
+
+// aggregatedSize is the size of an aggregated record with the given protobuf body size.
+func aggregatedSize(body int) int {
+	return len(aggregatedMagic) + body + md5.Size
+}
+
+// sizeWith is the size of the aggregated record after adding a record with the given partition key and data.
+func (a *aggregator) sizeWith(partitionKey string, data []byte) int {
+	body := a.size
+	idx, ok := a.keyIdx[partitionKey]
+	if !ok {
+		body += bytesFieldSize(fieldPartitionKeyTable, len(partitionKey))
+		idx = len(a.keys)
+	}
+	body += bytesFieldSize(fieldRecords, aggregateRecordSize(uint64(idx), len(data)))
+	return aggregatedSize(body)
+}
+
+func (a *aggregator) add(partitionKey string, data []byte) {
+	idx, ok := a.keyIdx[partitionKey]
+	if !ok {
+		if a.keyIdx == nil {
+			a.keyIdx = make(map[string]int)
+		}
+		idx = len(a.keys)
+		a.keyIdx[partitionKey] = idx
+		a.keys = append(a.keys, partitionKey)
+		a.size += bytesFieldSize(fieldPartitionKeyTable, len(partitionKey))
+	}
+	r := encodeAggregateRecord(uint64(idx), data)
+	a.records = append(a.records, r)
+	a.size += bytesFieldSize(fieldRecords, len(r))
+}
+
+// bytes returns the aggregated record holding everything added so far.
+func (a *aggregator) bytes() []byte {
+	var body []byte
+	for _, k := range a.keys {
+		body = appendBytesField(body, fieldPartitionKeyTable, []byte(k))
+	}
+	for _, r := range a.records {
+		body = appendBytesField(body, fieldRecords, r)
+	}
+	sum := md5.Sum(body)
+	out := make([]byte, 0, aggregatedSize(len(body)))
+	out = append(out, aggregatedMagic...)
+	out = append(out, body...)
+	return append(out, sum[:]...)
+}
+
+// Aggregate packs user records, in order, into as few KPL aggregated records as possible without letting any of
+// them grow past maxSize bytes, or past what a Kinesis record can carry beside its partition key. A user record
+// too big to share is put in an aggregated record of its own. groups[i] lists the indexes of the user records
+// packed into aggregated record i.
+func Aggregate(records []*UserRecord, maxSize int) (aggregated [][]byte, groups [][]int) {
+	if maxSize > maxAggregateSize {
+		maxSize = maxAggregateSize
+	}
+	var a aggregator
+	var group []int
+	for i, r := range records {
+		if len(a.records) > 0 && a.sizeWith(r.PartitionKey, r.Data) > maxSize {
+			aggregated = append(aggregated, a.bytes())
+			groups = append(groups, group)
+			a = aggregator{}
+			group = nil
+		}
+		a.add(r.PartitionKey, r.Data)
+		group = append(group, i)
+	}
+	if len(a.records) > 0 {
+		aggregated = append(aggregated, a.bytes())
+		groups = append(groups, group)
+	}
+	return aggregated, groups
+}
+
+// IsAggregated reports whether data is a KPL aggregated record: it starts with the magic number and ends with
+// the MD5 digest of what lies between.
+func IsAggregated(data []byte) bool {
+	if len(data) < len(aggregatedMagic)+md5.Size || !bytes.HasPrefix(data, aggregatedMagic) {
+		return false
+	}
+	body := data[len(aggregatedMagic) : len(data)-md5.Size]
+	sum := md5.Sum(body)
+	return bytes.Equal(sum[:], data[len(data)-md5.Size:])
+}
+
+// DeaggregateRecords unpacks the user records of every aggregated record in records. Records that are not
+// aggregated, or whose aggregated body cannot be decoded, are passed through as a single user record each.
+func DeaggregateRecords(records []*kinesis.Record) []*UserRecord {
+	var out []*UserRecord
+	for _, r := range records {
+		out = append(out, deaggregate(r)...)
+	}
+	return out
+}
+
+// deaggregate unpacks a single Kinesis record.
+func deaggregate(r *kinesis.Record) []*UserRecord {
+	var seq, pk string
+	if r.SequenceNumber != nil {
+		seq = *r.SequenceNumber
+	}
+	if r.PartitionKey != nil {
+		pk = *r.PartitionKey
+	}
+	raw := []*UserRecord{{PartitionKey: pk, Data: r.Data, SequenceNumber: seq}}
+	if !IsAggregated(r.Data) {
+		return raw
+	}
+	users, err := decodeAggregate(r.Data[len(aggregatedMagic) : len(r.Data)-md5.Size])
+	if err != nil {
+		return raw
+	}
+	for i, u := range users {
+		u.SequenceNumber = seq
+		u.SubSequenceNumber = i
+		u.Aggregated = true
+	}
+	return users
+}
+
+// decodeAggregate decodes the protobuf body of an aggregated record.
+func decodeAggregate(body []byte) ([]*UserRecord, error) {
+	var keys, hashKeys []string
+	var records [][]byte
+	err := decodeFields(body, func(field int, wire int, v uint64, b []byte) {
+		if wire != wireBytes {
+			return
+		}
+		switch field {
+		case fieldPartitionKeyTable:
+			keys = append(keys, string(b))
+		case fieldExplicitHashKeyTable:
+			hashKeys = append(hashKeys, string(b))
+		case fieldRecords:
+			records = append(records, b)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]*UserRecord, len(records))
+	for i, rec := range records {
+		var u UserRecord
+		var pk, ehk uint64
+		hasPK, hasEHK, hasData := false, false, false
+		err := decodeFields(rec, func(field int, wire int, v uint64, b []byte) {
+			switch {
+			case field == fieldPartitionKeyIndex && wire == wireVarint:
+				pk, hasPK = v, true
+			case field == fieldExplicitHashKeyIndex && wire == wireVarint:
+				ehk, hasEHK = v, true
+			case field == fieldData && wire == wireBytes:
+				u.Data, hasData = b, true
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !hasPK || !hasData || pk >= uint64(len(keys)) || (hasEHK && ehk >= uint64(len(hashKeys))) {
+			return nil, errMalformedAggregate
+		}
+		u.PartitionKey = keys[pk]
+		if hasEHK {
+			u.ExplicitHashKey = hashKeys[ehk]
+		}
+		users[i] = &u
+	}
+	return users, nil
+}
+
+// encodeAggregateRecord encodes a Record message.
+func encodeAggregateRecord(partitionKeyIndex uint64, data []byte) []byte {
+	var b []byte
+	b = appendTag(b, fieldPartitionKeyIndex, wireVarint)
+	b = appendVarint(b, partitionKeyIndex)
+	return appendBytesField(b, fieldData, data)
+}
+
+// aggregateRecordSize is the encoded size of a Record message holding n bytes of data.
+func aggregateRecordSize(partitionKeyIndex uint64, n int) int {
+	return len(appendTag(nil, fieldPartitionKeyIndex, wireVarint)) + len(appendVarint(nil, partitionKeyIndex)) +
+		bytesFieldSize(fieldData, n)
+}
+
+// decodeFields calls f with every field of a protobuf message. v holds varint and fixed-width values and b holds
+// length-delimited ones.
+func decodeFields(msg []byte, f func(field int, wire int, v uint64, b []byte)) error {
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errMalformedAggregate
+		}
+		msg = msg[n:]
+		field, wire := int(tag>>3), int(tag&7)
+		switch wire {
+		case wireVarint:
+			v, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return errMalformedAggregate
+			}
+			msg = msg[n:]
+			f(field, wire, v, nil)
+		case wireFixed64:
+			if len(msg) < 8 {
+				return errMalformedAggregate
+			}
+			f(field, wire, binary.LittleEndian.Uint64(msg), nil)
+			msg = msg[8:]
+		case wireFixed32:
+			if len(msg) < 4 {
+				return errMalformedAggregate
+			}
+			f(field, wire, uint64(binary.LittleEndian.Uint32(msg)), nil)
+			msg = msg[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || l > uint64(len(msg)-n) {
+				return errMalformedAggregate
+			}
+			f(field, wire, 0, msg[n:n+int(l)])
+			msg = msg[n+int(l):]
+		default:
+			return errMalformedAggregate
+		}
+	}
+	return nil
+}
+
+func appendTag(b []byte, field, wire int) []byte {
+	return appendVarint(b, uint64(field<<3|wire))
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// bytesFieldSize is the encoded size of a length-delimited field holding n bytes.
+func bytesFieldSize(field, n int) int {
+	return len(appendTag(nil, field, wireBytes)) + len(appendVarint(nil, uint64(n))) + n
+}
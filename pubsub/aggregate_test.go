@@ -0,0 +1,157 @@
+package pubsub
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func kinesisRecord(seq string, data []byte) *kinesis.Record {
+	pk := "outer key"
+	return &kinesis.Record{Data: data, PartitionKey: &pk, SequenceNumber: &seq}
+}
+
+func TestAggregateRoundTrip(t *testing.T) {
+	want := []*UserRecord{
+		{PartitionKey: "a", Data: []byte("first")},
+		{PartitionKey: "b", Data: []byte("second")},
+		{PartitionKey: "a", Data: []byte{}},
+		{PartitionKey: "c", Data: bytes.Repeat([]byte{0xF3}, 300)},
+	}
+	aggregated, groups := Aggregate(want, maxRecordSize)
+	if len(aggregated) != 1 || fmt.Sprint(groups) != "[[0 1 2 3]]" {
+		t.Fatalf("expected a single aggregated record, was %d in groups %v", len(aggregated), groups)
+	}
+	if !IsAggregated(aggregated[0]) {
+		t.Fatal("expected the aggregated record to be recognised")
+	}
+	got := DeaggregateRecords([]*kinesis.Record{kinesisRecord("49", aggregated[0])})
+	if len(got) != len(want) {
+		t.Fatalf("expected %d user records, was %d", len(want), len(got))
+	}
+	for i, u := range got {
+		if u.PartitionKey != want[i].PartitionKey || !bytes.Equal(u.Data, want[i].Data) {
+			t.Errorf("record %d: got %q/%q, want %q/%q", i, u.PartitionKey, u.Data, want[i].PartitionKey, want[i].Data)
+		}
+		if u.SequenceNumber != "49" || u.SubSequenceNumber != i || !u.Aggregated {
+			t.Errorf("record %d: unexpected position %s/%d aggregated %v", i, u.SequenceNumber, u.SubSequenceNumber, u.Aggregated)
+		}
+	}
+}
+
+func TestAggregateMaxSize(t *testing.T) {
+	var records []*UserRecord
+	for i := 0; i < 20; i++ {
+		records = append(records, &UserRecord{PartitionKey: "key", Data: bytes.Repeat([]byte{byte(i)}, 100)})
+	}
+	records = append(records, &UserRecord{PartitionKey: "key", Data: make([]byte, 2000)})
+	aggregated, groups := Aggregate(records, 500)
+	var count int
+	for i, a := range aggregated {
+		if len(a) > 500 && len(groups[i]) > 1 {
+			t.Errorf("aggregated record %d holds %d records in %d bytes", i, len(groups[i]), len(a))
+		}
+		count += len(DeaggregateRecords([]*kinesis.Record{kinesisRecord("1", a)}))
+	}
+	if count != len(records) {
+		t.Errorf("expected %d user records, was %d", len(records), count)
+	}
+	if last := groups[len(groups)-1]; len(last) != 1 || last[0] != 20 {
+		t.Errorf("expected the oversized record alone, was %v", last)
+	}
+}
+
+func TestDeaggregateKPLRecord(t *testing.T) {
+	// A KPL record with an explicit hash key table and a tag on its only record.
+	body := []byte{
+		0x0a, 0x01, 'a', // partition_key_table: "a"
+		0x12, 0x01, '5', // explicit_hash_key_table: "5"
+		0x1a, 0x0d, // records, 13 bytes
+		0x08, 0x00, // partition_key_index: 0
+		0x10, 0x00, // explicit_hash_key_index: 0
+		0x1a, 0x02, 'h', 'i', // data: "hi"
+		0x22, 0x03, 0x0a, 0x01, 'k', // tags: {key: "k"}
+	}
+	sum := md5.Sum(body)
+	data := append(append(append([]byte{}, aggregatedMagic...), body...), sum[:]...)
+	got := DeaggregateRecords([]*kinesis.Record{kinesisRecord("7", data)})
+	if len(got) != 1 {
+		t.Fatalf("expected 1 user record, was %d", len(got))
+	}
+	u := got[0]
+	if u.PartitionKey != "a" || u.ExplicitHashKey != "5" || string(u.Data) != "hi" || !u.Aggregated {
+		t.Errorf("unexpected user record %+v", *u)
+	}
+}
+
+func TestDeaggregatePassesThroughRawRecords(t *testing.T) {
+	aggregated, _ := Aggregate([]*UserRecord{{PartitionKey: "a", Data: []byte("x")}}, maxRecordSize)
+	corrupt := append([]byte{}, aggregated[0]...)
+	corrupt[len(aggregatedMagic)] ^= 0xFF
+	badBody := append(append([]byte{}, aggregatedMagic...), 0xFF)
+	sum := md5.Sum([]byte{0xFF})
+	badBody = append(badBody, sum[:]...)
+	tests := [][]byte{
+		[]byte("plain payload"),
+		{},
+		aggregatedMagic,
+		corrupt,
+		badBody,
+	}
+	for _, data := range tests {
+		got := DeaggregateRecords([]*kinesis.Record{kinesisRecord("3", data)})
+		if len(got) != 1 || !bytes.Equal(got[0].Data, data) || got[0].Aggregated || got[0].PartitionKey != "outer key" {
+			t.Errorf("%q: expected the record to pass through unchanged, was %v", data, got)
+		}
+	}
+}
+
+func TestAggregateCapsMaxSize(t *testing.T) {
+	records := []*UserRecord{
+		{PartitionKey: "a", Data: make([]byte, 600<<10)},
+		{PartitionKey: "b", Data: make([]byte, 600<<10)},
+	}
+	aggregated, groups := Aggregate(records, 4<<20)
+	if len(aggregated) != 2 || fmt.Sprint(groups) != "[[0] [1]]" {
+		t.Fatalf("expected the records to be kept apart, were in groups %v", groups)
+	}
+	for i, a := range aggregated {
+		if len(a)+utf8.UTFMax*MaxPartitionKeyLength > maxRecordSize {
+			t.Errorf("aggregated record %d of %d bytes leaves no room for a partition key", i, len(a))
+		}
+	}
+}
+
+func TestPutMessagesAggregated(t *testing.T) {
+	c := sequencingMock()
+	long, _ := Wrap(&Message{ID: strings.Repeat("m", 300), Data: []byte("c")})
+	messages := [][]byte{[]byte("a"), []byte("b"), long}
+	results, err := PutMessages(c, "stream name", messages, &Options{AggregateSize: 1000})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(c.Requests) != 1 || len(c.Requests[0].Records) != 2 {
+		t.Fatalf("expected one record per shard, was %v", c.Requests)
+	}
+	users := DeaggregateRecords([]*kinesis.Record{kinesisRecord("1", c.Requests[0].Records[0].Data)})
+	if len(users) != 3 {
+		t.Fatalf("expected 3 user records, was %d", len(users))
+	}
+	for i, u := range users {
+		if !bytes.Equal(u.Data, messages[i]) {
+			t.Errorf("user record %d: got %q, want %q", i, u.Data, messages[i])
+		}
+		if u.PartitionKey != messageID(messages[i]) || !validPartitionKey(u.PartitionKey) {
+			t.Errorf("user record %d: expected partition key %q, was %q", i, messageID(messages[i]), u.PartitionKey)
+		}
+	}
+	for i, r := range results {
+		if len(r.Delivered) != 2 {
+			t.Errorf("message %d: expected delivery to 2 shards, was %v", i, r.Delivered)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package pubsub
+
+import (
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+)
+
+// PutMessages broadcasts several messages to every open shard of a stream at once. The N messages and M shards
+// become N×M entries packed into as few PutRecords requests as the per-request limits allow, rather than one
+// fan-out per message. Each shard receives the messages in the order given: when an entry has to be retried, the
+// entries that followed it to the same shard are sent again behind it, so they may be duplicated. When
+// opts.AggregateSize is set the messages are first packed into KPL aggregated records, so each shard receives far
+// fewer records.
+//
+// One result is returned per message, in the same order, holding the sequence number of the message on every
+// shard that accepted it and the shards that never did. ErrPartialFailure is returned if any message missed a
+// shard; MessageErr tells which ones.
+func PutMessages(c kinesisPubSub, stream string, messages [][]byte, opts *Options) ([]*PutRecordResult, error) {
+	if opts != nil && opts.AggregateSize > 0 {
+		return putAggregated(c, stream, messages, opts)
+	}
+	inputs := make([]*kinesis.PutRecordInput, len(messages))
+	for i, m := range messages {
+		inputs[i] = &kinesis.PutRecordInput{Data: m, StreamName: &stream}
+	}
+	return putRecords(c, inputs, opts)
+}
+
+// putAggregated packs messages into aggregated records, broadcasts those and hands every message the result of
+// the aggregated record that carried it. Each message is keyed by its ID in the aggregated record, so consumers
+// unpacking it see the same partition keys as MessageIDPartitionKeys would derive.
+func putAggregated(c kinesisPubSub, stream string, messages [][]byte, opts *Options) ([]*PutRecordResult, error) {
+	users := make([]*UserRecord, len(messages))
+	for i, m := range messages {
+		users[i] = &UserRecord{PartitionKey: messageID(m), Data: m}
+	}
+	aggregated, groups := Aggregate(users, opts.AggregateSize)
+	inputs := make([]*kinesis.PutRecordInput, len(aggregated))
+	for i, a := range aggregated {
+		inputs[i] = &kinesis.PutRecordInput{Data: a, StreamName: &stream}
+	}
+	results, err := putRecords(c, inputs, opts)
+	if results == nil {
+		return nil, err
+	}
+	perMessage := make([]*PutRecordResult, len(messages))
+	for i, g := range groups {
+		for _, m := range g {
+			perMessage[m] = results[i]
+		}
+	}
+	return perMessage, err
+}
+
+// MessageErr picks out the error that applies to a single message's result from the error returned by
+// PutMessages alongside all of them. It is nil when the message reached every shard.
+func MessageErr(result *PutRecordResult, err error) error {
+	if result == nil {
+		return err
+	}
+	if len(result.Failed) == 0 {
+		return nil
+	}
+	if err == nil {
+		return ErrPartialFailure
+	}
+	return err
+}
+
+// interleaveByShard merges the fan-outs of several records into a single input whose entries are grouped by
+// explicit hash key, in the order of keys, and within each key keep the order of fans. owners[i] is the index
+// of the fan-out that entry i came from.
+func interleaveByShard(fans []*kinesis.PutRecordsInput, keys []*string) (*kinesis.PutRecordsInput, []int) {
+	byKey := make([]map[string]*kinesis.PutRecordsRequestEntry, len(fans))
+	for i, f := range fans {
+		byKey[i] = make(map[string]*kinesis.PutRecordsRequestEntry, len(f.Records))
+		for _, e := range f.Records {
+			byKey[i][*e.ExplicitHashKey] = e
+		}
+	}
+	input := &kinesis.PutRecordsInput{}
+	if len(fans) > 0 {
+		input.StreamName = fans[0].StreamName
+	}
+	var owners []int
+	for _, k := range keys {
+		for i := range fans {
+			if e, ok := byKey[i][*k]; ok {
+				input.Records = append(input.Records, e)
+				owners = append(owners, i)
+			}
+		}
+	}
+	return input, owners
+}
@@ -0,0 +1,200 @@
+package pubsub
+
+import (
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"sync"
+	"testing"
+	"time"
+)
+
+// kinesisSequencingMock gives every accepted entry the next sequence number of the shard its explicit hash key
+// routes to, and remembers the data each shard accepted in order. Entries without an explicit hash key go to the
+// first shard. Entries whose "key/data" is in Reject fail, data being the payload of enveloped entries, those in
+// RejectOnce fail the first time only, and every call fails with PutErr when it is set.
+type kinesisSequencingMock struct {
+	kinesisDescribeStreamMock
+	mu         sync.Mutex
+	Routes     map[string]string
+	Reject     map[string]bool
+	RejectOnce map[string]bool
+	PutErr     error
+	Requests   []*kinesis.PutRecordsInput
+	Accepted   map[string][]string
+}
+
+func (c *kinesisSequencingMock) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	time.Sleep(time.Millisecond)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Requests = append(c.Requests, input)
+	if c.PutErr != nil {
+		return nil, c.PutErr
+	}
+	if c.Accepted == nil {
+		c.Accepted = make(map[string][]string)
+	}
+	var out kinesis.PutRecordsOutput
+	for _, e := range input.Records {
+		key := "1"
+		if e.ExplicitHashKey != nil {
+			key = *e.ExplicitHashKey
+		}
+		id := c.Routes[key]
+		if m, err := Unwrap(e.Data); err == nil && (c.Reject[key+"/"+string(m.Data)] || c.RejectOnce[key+"/"+string(m.Data)]) {
+			delete(c.RejectOnce, key+"/"+string(m.Data))
+			code := errThroughputExceeded
+			out.Records = append(out.Records, &kinesis.PutRecordsResultEntry{ErrorCode: &code})
+			continue
+		}
+		c.Accepted[id] = append(c.Accepted[id], string(e.Data))
+		seq := fmt.Sprint(len(c.Accepted[id]))
+		out.Records = append(out.Records, &kinesis.PutRecordsResultEntry{ShardID: &id, SequenceNumber: &seq})
+	}
+	return &out, nil
+}
+
+func sequencingMock() *kinesisSequencingMock {
+	c := &kinesisSequencingMock{Routes: map[string]string{"1": "shard ID 1", "2": "shard ID 2"}}
+	c.Shards = [][]*kinesis.Shard{{testShard("shard ID 1", "1"), testShard("shard ID 2", "2")}}
+	return c
+}
+
+func TestPutMessages(t *testing.T) {
+	c := sequencingMock()
+	messages := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	results, err := PutMessages(c, "stream name", messages, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(c.Requests) != 1 || len(c.Requests[0].Records) != 6 {
+		t.Fatalf("expected a single request of 6 entries, was %v", c.Requests)
+	}
+	var layout []string
+	for _, e := range c.Requests[0].Records {
+		layout = append(layout, *e.ExplicitHashKey+"/"+string(e.Data))
+	}
+	if fmt.Sprint(layout) != "[1/a 1/b 1/c 2/a 2/b 2/c]" {
+		t.Errorf("expected entries grouped by shard, was %v", layout)
+	}
+	if len(results) != len(messages) {
+		t.Fatalf("expected %d results, was %d", len(messages), len(results))
+	}
+	for i, r := range results {
+		if len(r.Delivered) != 2 || len(r.Failed) != 0 {
+			t.Errorf("message %d: expected 2 deliveries, was %v", i, r)
+			continue
+		}
+		for _, d := range r.Delivered {
+			if want := fmt.Sprint(i + 1); *d.SequenceNumber != want {
+				t.Errorf("message %d: expected sequence number %s on %s, was %s", i, want, *d.ShardID, *d.SequenceNumber)
+			}
+		}
+	}
+}
+
+func TestPutMessagesPerMessageFailure(t *testing.T) {
+	stubSleep()
+	defer restoreSleep()
+	c := sequencingMock()
+	c.Reject = map[string]bool{"2/b": true}
+	results, err := PutMessages(c, "stream name", [][]byte{[]byte("a"), []byte("b")}, &Options{Retry: RetryPolicy{MaxAttempts: 2}})
+	if err != ErrPartialFailure {
+		t.Errorf("expected %v, was %v", ErrPartialFailure, err)
+	}
+	if e := MessageErr(results[0], err); e != nil {
+		t.Errorf("message a: unexpected error %v", e)
+	}
+	if e := MessageErr(results[1], err); e != ErrPartialFailure {
+		t.Errorf("message b: expected %v, was %v", ErrPartialFailure, e)
+	}
+	if f := results[1].Failed; len(f) != 1 || f[0].ShardID != "shard ID 2" {
+		t.Errorf("message b: expected shard ID 2 to fail, was %v", f)
+	}
+	if len(results[1].Delivered) != 1 || *results[1].Delivered[0].ShardID != "shard ID 1" {
+		t.Errorf("message b: expected delivery to shard ID 1, was %v", results[1].Delivered)
+	}
+	if results[0].Attempts != 1 || results[1].Attempts != 2 {
+		t.Errorf("expected a to be sent once and b twice, were %d and %d attempts", results[0].Attempts, results[1].Attempts)
+	}
+}
+
+func TestPutMessagesKeepsShardOrderAcrossRetries(t *testing.T) {
+	stubSleep()
+	defer restoreSleep()
+	c := sequencingMock()
+	c.RejectOnce = map[string]bool{"2/a": true}
+	results, err := PutMessages(c, "stream name", [][]byte{[]byte("a"), []byte("b")}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// b overtook a on shard 2, so it is sent again behind it.
+	if got := fmt.Sprint(c.Accepted["shard ID 2"]); got != "[b a b]" {
+		t.Errorf("expected b to be re-sent after a, was %s", got)
+	}
+	if got := fmt.Sprint(c.Accepted["shard ID 1"]); got != "[a b]" {
+		t.Errorf("expected shard ID 1 to get a and b once, was %s", got)
+	}
+	for i, r := range results {
+		if len(r.Delivered) != 2 || r.Attempts != 2 {
+			t.Errorf("message %d: expected 2 deliveries in 2 attempts, was %d in %d", i, len(r.Delivered), r.Attempts)
+		}
+	}
+	if d := results[1].Delivered[1]; *d.ShardID != "shard ID 2" || *d.SequenceNumber != "3" {
+		t.Errorf("expected b to be delivered by the re-send, was %s on %s", *d.SequenceNumber, *d.ShardID)
+	}
+}
+
+func TestPutMessagesKeepsShardOrderAcrossRequests(t *testing.T) {
+	c := sequencingMock()
+	var messages [][]byte
+	for i := 0; i < 1200; i++ {
+		messages = append(messages, []byte(fmt.Sprintf("%04d", i)))
+	}
+	if _, err := PutMessages(c, "stream name", messages, &Options{Concurrency: 4}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(c.Requests) != 5 {
+		t.Errorf("expected 5 requests, was %d", len(c.Requests))
+	}
+	for id, accepted := range c.Accepted {
+		if len(accepted) != len(messages) {
+			t.Errorf("%s: expected %d messages, was %d", id, len(messages), len(accepted))
+		}
+		for i := 1; i < len(accepted); i++ {
+			if accepted[i] < accepted[i-1] {
+				t.Errorf("%s: %s written after %s", id, accepted[i], accepted[i-1])
+				break
+			}
+		}
+	}
+}
+
+func TestPutMessagesEmpty(t *testing.T) {
+	c := sequencingMock()
+	results, err := PutMessages(c, "stream name", nil, nil)
+	if results != nil || err != nil {
+		t.Errorf("expected nothing, was %v, %v", results, err)
+	}
+}
+
+func TestInterleaveByShard(t *testing.T) {
+	k1 := "1"
+	k2 := "2"
+	a := &kinesis.PutRecordsInput{Records: []*kinesis.PutRecordsRequestEntry{
+		{Data: []byte("a"), ExplicitHashKey: &k1},
+		{Data: []byte("a"), ExplicitHashKey: &k2},
+	}}
+	// b has already reached the first shard.
+	b := &kinesis.PutRecordsInput{Records: []*kinesis.PutRecordsRequestEntry{
+		{Data: []byte("b"), ExplicitHashKey: &k2},
+	}}
+	input, owners := interleaveByShard([]*kinesis.PutRecordsInput{a, b}, []*string{&k1, &k2})
+	var got []string
+	for _, e := range input.Records {
+		got = append(got, *e.ExplicitHashKey+"/"+string(e.Data))
+	}
+	if fmt.Sprint(got) != "[1/a 2/a 2/b]" || fmt.Sprint(owners) != "[0 0 1]" {
+		t.Errorf("unexpected layout %v owned by %v", got, owners)
+	}
+}
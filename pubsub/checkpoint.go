@@ -0,0 +1,133 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// CheckpointStore remembers how far each shard of a stream has been processed, so that a reader started again
+// resumes after the last record it handled instead of reading records twice or skipping some.
+type CheckpointStore interface {
+	// Checkpoint returns the sequence number of the last record processed from a shard, or "" when there is
+	// none.
+	Checkpoint(stream, shardID string) (string, error)
+	// SetCheckpoint records seq as the last record processed from a shard.
+	SetCheckpoint(stream, shardID, seq string) error
+}
+
+// checkpoints maps stream names to the last sequence number processed from each of their shards.
+type checkpoints map[string]map[string]string
+
+func (c checkpoints) get(stream, shardID string) string {
+	return c[stream][shardID]
+}
+
+func (c checkpoints) set(stream, shardID, seq string) {
+	if c[stream] == nil {
+		c[stream] = make(map[string]string)
+	}
+	c[stream][shardID] = seq
+}
+
+// MemoryCheckpointStore keeps checkpoints for the life of the process.
+type MemoryCheckpointStore struct {
+	mu          sync.Mutex
+	checkpoints checkpoints
+}
+
+// NewMemoryCheckpointStore returns an empty MemoryCheckpointStore.
+func NewMemoryCheckpointStore() *MemoryCheckpointStore {
+	return &MemoryCheckpointStore{checkpoints: make(checkpoints)}
+}
+
+// Checkpoint implements CheckpointStore.
+func (s *MemoryCheckpointStore) Checkpoint(stream, shardID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkpoints.get(stream, shardID), nil
+}
+
+// SetCheckpoint implements CheckpointStore.
+func (s *MemoryCheckpointStore) SetCheckpoint(stream, shardID, seq string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoints.set(stream, shardID, seq)
+	return nil
+}
+
+// FileCheckpointStore keeps checkpoints in a JSON file. Every update rewrites the whole file into a temporary file
+// that is synced and renamed over the old one, so a crash leaves either the old or the new checkpoints behind.
+type FileCheckpointStore struct {
+	path string
+
+	mu          sync.Mutex
+	checkpoints checkpoints
+}
+
+// NewFileCheckpointStore loads the checkpoints saved at path. A missing file holds no checkpoints.
+func NewFileCheckpointStore(path string) (*FileCheckpointStore, error) {
+	s := &FileCheckpointStore{path: path, checkpoints: make(checkpoints)}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.checkpoints); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Checkpoint implements CheckpointStore.
+func (s *FileCheckpointStore) Checkpoint(stream, shardID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.checkpoints.get(stream, shardID), nil
+}
+
+// SetCheckpoint records seq and returns once it is safely on disk. The checkpoint is kept in memory even when
+// saving it fails.
+func (s *FileCheckpointStore) SetCheckpoint(stream, shardID, seq string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkpoints.set(stream, shardID, seq)
+	b, err := json.Marshal(s.checkpoints)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, b)
+}
+
+// writeFileAtomic replaces the file at path with data, syncing both the file and its directory.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,84 @@
+package pubsub
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testCheckpointStore(t *testing.T, name string, s CheckpointStore) {
+	if seq, err := s.Checkpoint("stream", "shard 1"); seq != "" || err != nil {
+		t.Errorf("%s: expected no checkpoint, was %q, %v", name, seq, err)
+	}
+	for _, seq := range []string{"1", "2"} {
+		if err := s.SetCheckpoint("stream", "shard 1", seq); err != nil {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+	}
+	if err := s.SetCheckpoint("other stream", "shard 1", "9"); err != nil {
+		t.Fatalf("%s: unexpected error %v", name, err)
+	}
+	if seq, err := s.Checkpoint("stream", "shard 1"); seq != "2" || err != nil {
+		t.Errorf("%s: expected checkpoint 2, was %q, %v", name, seq, err)
+	}
+	if seq, _ := s.Checkpoint("stream", "shard 2"); seq != "" {
+		t.Errorf("%s: expected no checkpoint for another shard, was %q", name, seq)
+	}
+}
+
+func TestMemoryCheckpointStore(t *testing.T) {
+	testCheckpointStore(t, "memory", NewMemoryCheckpointStore())
+}
+
+func TestFileCheckpointStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoints.json")
+	s, err := NewFileCheckpointStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	testCheckpointStore(t, "file", s)
+
+	reopened, err := NewFileCheckpointStore(path)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for stream, want := range map[string]string{"stream": "2", "other stream": "9"} {
+		if seq, _ := reopened.Checkpoint(stream, "shard 1"); seq != want {
+			t.Errorf("%s: expected checkpoint %s after reopening, was %q", stream, want, seq)
+		}
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("expected only the checkpoint file to be left, was %d files", len(files))
+	}
+}
+
+func TestFileCheckpointStoreErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	corrupt := filepath.Join(dir, "corrupt.json")
+	ioutil.WriteFile(corrupt, []byte("{"), 0644)
+	if _, err := NewFileCheckpointStore(corrupt); err == nil {
+		t.Error("expected an error loading a corrupt file, was nil")
+	}
+
+	s, err := NewFileCheckpointStore(filepath.Join(dir, "missing", "checkpoints.json"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := s.SetCheckpoint("stream", "shard 1", "1"); err == nil {
+		t.Error("expected an error saving into a missing directory, was nil")
+	}
+	if seq, _ := s.Checkpoint("stream", "shard 1"); seq != "1" {
+		t.Errorf("expected the checkpoint to be kept in memory, was %q", seq)
+	}
+}
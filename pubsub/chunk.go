@@ -0,0 +1,144 @@
+package pubsub
+
+import (
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"sync"
+)
+
+// Limits Kinesis places on a single PutRecords request.
+const (
+	maxRecordsPerRequest = 500
+	maxBytesPerRequest   = 5 << 20
+	maxRecordSize        = 1 << 20
+)
+
+// DefaultConcurrency is the number of PutRecords requests a single fan-out keeps in flight when
+// Options.Concurrency is zero.
+const DefaultConcurrency = 4
+
+// errRequestFailed is the entry error code given to records whose whole PutRecords request failed without an
+// AWS error code.
+const errRequestFailed = "RequestFailed"
+
+// entrySize is the number of bytes an entry counts towards the request and record size limits.
+func entrySize(e *kinesis.PutRecordsRequestEntry) int {
+	n := len(e.Data)
+	if e.PartitionKey != nil {
+		n += len(*e.PartitionKey)
+	}
+	return n
+}
+
+// chunkEntries splits entries, in order, into groups that each fit in one PutRecords request.
+func chunkEntries(entries []*kinesis.PutRecordsRequestEntry) ([][]*kinesis.PutRecordsRequestEntry, error) {
+	var chunks [][]*kinesis.PutRecordsRequestEntry
+	var chunk []*kinesis.PutRecordsRequestEntry
+	size := 0
+	for _, e := range entries {
+		n := entrySize(e)
+		if n > maxRecordSize {
+			return nil, fmt.Errorf("record of %d bytes exceeds the %d byte limit", n, maxRecordSize)
+		}
+		if len(chunk) == maxRecordsPerRequest || size+n > maxBytesPerRequest {
+			chunks = append(chunks, chunk)
+			chunk = nil
+			size = 0
+		}
+		chunk = append(chunk, e)
+		size += n
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
+
+// putRecordsChunked sends input as however many PutRecords requests the per-request limits call for, with at
+// most concurrency of them in flight, and merges the responses into one output whose records line up with
+// input.Records. When only some requests fail, the records of the failed ones are marked with the request's error
+// so that they can be retried like any other rejected entry; when all of them fail the first error is returned.
+func putRecordsChunked(c kinesisPubSub, input *kinesis.PutRecordsInput, concurrency int) (*kinesis.PutRecordsOutput, error) {
+	chunks, err := chunkEntries(input.Records)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) == 1 {
+		return putRecordsChunk(c, input.StreamName, chunks[0])
+	}
+
+	// A chunk waits for the latest earlier chunk addressing any of the same hash keys, so that a shard's entries
+	// are written in input order even when they span requests.
+	outs := make([]*kinesis.PutRecordsOutput, len(chunks))
+	errs := make([]error, len(chunks))
+	done := make([]chan bool, len(chunks))
+	last := make(map[string]int)
+	sem := make(chan bool, concurrency)
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		done[i] = make(chan bool)
+		deps := make(map[int]bool)
+		for _, e := range chunk {
+			if e.ExplicitHashKey == nil {
+				continue
+			}
+			if j, ok := last[*e.ExplicitHashKey]; ok && j != i {
+				deps[j] = true
+			}
+			last[*e.ExplicitHashKey] = i
+		}
+		wg.Add(1)
+		go func(i int, chunk []*kinesis.PutRecordsRequestEntry, deps map[int]bool) {
+			defer wg.Done()
+			defer close(done[i])
+			for j := range deps {
+				<-done[j]
+			}
+			sem <- true
+			outs[i], errs[i] = putRecordsChunk(c, input.StreamName, chunk)
+			<-sem
+		}(i, chunk, deps)
+	}
+	wg.Wait()
+
+	merged := &kinesis.PutRecordsOutput{}
+	var failed int64
+	var firstErr error
+	for i, chunk := range chunks {
+		if errs[i] == nil {
+			for _, r := range outs[i].Records {
+				if r.ErrorCode != nil {
+					failed++
+				}
+			}
+			merged.Records = append(merged.Records, outs[i].Records...)
+			continue
+		}
+		if firstErr == nil {
+			firstErr = errs[i]
+		}
+		code, msg := errRequestFailed, errs[i].Error()
+		if e := aws.Error(errs[i]); e != nil && e.Code != "" {
+			code = e.Code
+		}
+		for range chunk {
+			merged.Records = append(merged.Records, &kinesis.PutRecordsResultEntry{ErrorCode: &code, ErrorMessage: &msg})
+			failed++
+		}
+	}
+	if failed == int64(len(merged.Records)) && firstErr != nil {
+		return nil, firstErr
+	}
+	merged.FailedRecordCount = &failed
+	return merged, nil
+}
+
+// putRecordsChunk sends one request's worth of entries.
+func putRecordsChunk(c kinesisPubSub, stream *string, chunk []*kinesis.PutRecordsRequestEntry) (*kinesis.PutRecordsOutput, error) {
+	out, err := c.PutRecords(&kinesis.PutRecordsInput{Records: chunk, StreamName: stream})
+	if err == nil && len(out.Records) != len(chunk) {
+		err = fmt.Errorf("PutRecords returned %d results for %d records", len(out.Records), len(chunk))
+	}
+	return out, err
+}
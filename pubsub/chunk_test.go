@@ -0,0 +1,167 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"sync"
+	"testing"
+	"time"
+)
+
+// kinesisConcurrentPutRecordsMock echoes every entry's explicit hash key back as its sequence number and records
+// the most requests it saw in flight at once. Requests containing the FailKey entry fail with Err.
+type kinesisConcurrentPutRecordsMock struct {
+	kinesisDescribeStreamMock
+	mu          sync.Mutex
+	inFlight    int
+	MaxInFlight int
+	Requests    int
+	FailKey     string
+	Err         error
+}
+
+func (c *kinesisConcurrentPutRecordsMock) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	c.mu.Lock()
+	c.Requests++
+	c.inFlight++
+	if c.inFlight > c.MaxInFlight {
+		c.MaxInFlight = c.inFlight
+	}
+	c.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	c.mu.Lock()
+	c.inFlight--
+	c.mu.Unlock()
+
+	var out kinesis.PutRecordsOutput
+	for _, e := range input.Records {
+		if *e.ExplicitHashKey == c.FailKey {
+			return nil, c.Err
+		}
+		out.Records = append(out.Records, &kinesis.PutRecordsResultEntry{SequenceNumber: e.ExplicitHashKey})
+	}
+	return &out, nil
+}
+
+func entries(n, size int) []*kinesis.PutRecordsRequestEntry {
+	var e []*kinesis.PutRecordsRequestEntry
+	for i := 0; i < n; i++ {
+		key := fmt.Sprint(i)
+		e = append(e, &kinesis.PutRecordsRequestEntry{Data: make([]byte, size), ExplicitHashKey: &key})
+	}
+	return e
+}
+
+func TestChunkEntries(t *testing.T) {
+	tests := []struct {
+		count, size int
+		want        []int
+	}{
+		{1, 10, []int{1}},
+		{500, 10, []int{500}},
+		{1201, 10, []int{500, 500, 201}},
+		{6, maxRecordSize, []int{5, 1}},
+		{11, maxRecordSize / 2, []int{10, 1}},
+	}
+	for _, tt := range tests {
+		chunks, err := chunkEntries(entries(tt.count, tt.size))
+		if err != nil {
+			t.Errorf("%d x %d bytes: unexpected error %v", tt.count, tt.size, err)
+			continue
+		}
+		var got []int
+		for _, c := range chunks {
+			got = append(got, len(c))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%d x %d bytes: got chunks %v, want %v", tt.count, tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestChunkEntriesCountsPartitionKey(t *testing.T) {
+	e := entries(1, maxRecordSize)
+	pk := "partition key"
+	e[0].PartitionKey = &pk
+	if _, err := chunkEntries(e); err == nil {
+		t.Error("expected an error for an oversized record, was nil")
+	}
+}
+
+func TestPutRecordsChunked(t *testing.T) {
+	c := kinesisConcurrentPutRecordsMock{}
+	s := "stream name"
+	input := &kinesis.PutRecordsInput{Records: entries(2100, 10), StreamName: &s}
+	out, err := putRecordsChunked(&c, input, 2)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if c.Requests != 5 {
+		t.Errorf("expected 5 requests, was %d", c.Requests)
+	}
+	if c.MaxInFlight > 2 {
+		t.Errorf("expected at most 2 requests in flight, was %d", c.MaxInFlight)
+	}
+	if len(out.Records) != len(input.Records) {
+		t.Fatalf("expected %d results, was %d", len(input.Records), len(out.Records))
+	}
+	for i, r := range out.Records {
+		if *r.SequenceNumber != *input.Records[i].ExplicitHashKey {
+			t.Errorf("result %d belongs to %s", i, *r.SequenceNumber)
+		}
+	}
+}
+
+func TestPutRecordsChunkedPartialFailure(t *testing.T) {
+	c := kinesisConcurrentPutRecordsMock{FailKey: "600", Err: aws.APIError{Code: errThroughputExceeded, Message: "simulated"}}
+	s := "stream name"
+	out, err := putRecordsChunked(&c, &kinesis.PutRecordsInput{Records: entries(1200, 10), StreamName: &s}, 4)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if *out.FailedRecordCount != 500 {
+		t.Errorf("expected 500 failed records, was %d", *out.FailedRecordCount)
+	}
+	for i, r := range out.Records {
+		failed := i >= 500 && i < 1000
+		if failed != (r.ErrorCode != nil) {
+			t.Errorf("record %d: expected failed %v, was %v", i, failed, r.ErrorCode)
+		}
+		if failed && *r.ErrorCode != errThroughputExceeded {
+			t.Errorf("record %d: expected error code %s, was %s", i, errThroughputExceeded, *r.ErrorCode)
+		}
+	}
+}
+
+func TestPutRecordsChunkedTotalFailure(t *testing.T) {
+	simulated := errors.New("simulated PutRecords error")
+	c := kinesisConcurrentPutRecordsMock{FailKey: "0", Err: simulated}
+	s := "stream name"
+	if _, err := putRecordsChunked(&c, &kinesis.PutRecordsInput{Records: entries(10, 10), StreamName: &s}, 4); err != simulated {
+		t.Errorf("expected error %v, was %v", simulated, err)
+	}
+}
+
+func TestPutRecordWithOptionsManyShards(t *testing.T) {
+	var c kinesisConcurrentPutRecordsMock
+	var shards []*kinesis.Shard
+	for i := 0; i < 1200; i++ {
+		id := fmt.Sprintf("shard ID %d", i)
+		key := fmt.Sprint(i)
+		shards = append(shards, &kinesis.Shard{ShardID: &id, HashKeyRange: &kinesis.HashKeyRange{StartingHashKey: &key, EndingHashKey: &key}})
+	}
+	c.Shards = [][]*kinesis.Shard{shards}
+	stream := "stream name"
+	result, err := PutRecordWithOptions(&c, &kinesis.PutRecordInput{Data: []byte("blob payload"), StreamName: &stream}, &Options{Concurrency: 2})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(result.Delivered) != 1200 {
+		t.Errorf("expected 1200 deliveries, was %d", len(result.Delivered))
+	}
+	if c.Requests != 3 || result.Attempts != 1 {
+		t.Errorf("expected 3 requests in 1 attempt, was %d in %d", c.Requests, result.Attempts)
+	}
+}
@@ -0,0 +1,291 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers stamped on the messages a Consumer publishes to its dead-letter stream.
+const (
+	// DeadLetterReasonHeader is "rejected" when the handler rejected the message, "retries exhausted" when it
+	// failed on every attempt and "decode failed" when the record could not be unwrapped, so the handler never
+	// saw it.
+	DeadLetterReasonHeader = "pubsub-dead-letter-reason"
+	// DeadLetterErrorHeader is the last error returned by the handler, or the error unwrapping the record.
+	DeadLetterErrorHeader = "pubsub-dead-letter-error"
+	// DeadLetterAttemptsHeader is the number of times the handler was called, which is 0 when decoding failed.
+	DeadLetterAttemptsHeader = "pubsub-dead-letter-attempts"
+	// DeadLetterStreamHeader, DeadLetterShardHeader and DeadLetterSequenceHeader locate the message where it
+	// was read.
+	DeadLetterStreamHeader   = "pubsub-dead-letter-stream"
+	DeadLetterShardHeader    = "pubsub-dead-letter-shard"
+	DeadLetterSequenceHeader = "pubsub-dead-letter-sequence"
+)
+
+// Dead-letter reasons.
+const (
+	reasonRejected    = "rejected"
+	reasonExhausted   = "retries exhausted"
+	reasonUndecodable = "decode failed"
+)
+
+// ErrConsumerClosed is returned by Run after Close.
+var ErrConsumerClosed = errors.New("consumer is closed")
+
+type kinesisConsume interface {
+	kinesisSubscribe
+	PutRecords(*kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error)
+}
+
+// Handler processes one message. It returns nil once the message has been handled, an error wrapped by Reject
+// for a message that can never be handled, and any other error for one worth trying again.
+type Handler func(m *Message) error
+
+// rejection marks a handler error as final.
+type rejection struct {
+	err error
+}
+
+func (r *rejection) Error() string {
+	return r.err.Error()
+}
+
+// Reject wraps err so that a Consumer sends the message straight to its dead-letter stream instead of retrying.
+func Reject(err error) error {
+	return &rejection{err}
+}
+
+// ConsumerConfig configures a Consumer.
+type ConsumerConfig struct {
+	// Stream is the stream consumed.
+	Stream string
+	// Subscribe tunes the subscription the messages are read from. It is ignored when Group is set.
+	Subscribe *SubscribeOptions
+	// Group, when set, makes the consumer a member of a consumer group and Stream is taken from it.
+	Group *GroupConfig
+	// Retry bounds the handler calls made for one message, and the attempts to publish it to DeadLetter, and sets
+	// the backoff between them.
+	Retry RetryPolicy
+	// DeadLetter is the stream messages are published to once they are rejected or their attempts run out, along
+	// with the records that cannot be decoded. When empty, they are dropped and reported to OnError.
+	DeadLetter string
+	// DeadLetterOptions tunes publishing to DeadLetter.
+	DeadLetterOptions *Options
+	// OnError, when set, is called with every read, checkpoint and dead-letter failure, and with the messages
+	// dropped without a dead-letter stream.
+	OnError func(err error)
+}
+
+// Consumer hands the messages of a stream to a Handler, one at a time and in order for each shard. A shard is
+// only checkpointed once every message read with a record has been handled, so a failing message is retried,
+// with backoff, before any message behind it and the shard resumes from it after a restart. A message that is
+// rejected, or fails on every attempt, is published to the dead-letter stream along with why it failed, and the
+// shard moves on past it; one bad message never holds up a shard for good. So is a record that cannot be decoded,
+// such as one in an envelope from a newer version, without being handed to the handler.
+type Consumer struct {
+	c           kinesisConsume
+	config      ConsumerConfig
+	deadLetters *Unicaster
+
+	mu      sync.Mutex
+	handler Handler
+	source  messageSource
+	closed  bool
+
+	closeOnce sync.Once
+	closing   chan struct{}
+}
+
+// messageSource is a Subscription or a Group.
+type messageSource interface {
+	Errors() <-chan error
+	Close() error
+}
+
+// DeadLetterError reports a message dropped by a Consumer that has no dead-letter stream, or that could not
+// publish it there.
+type DeadLetterError struct {
+	// Message is the dropped message.
+	Message *Message
+	// Reason is why it was dropped, as in DeadLetterReasonHeader.
+	Reason string
+	// Err is the last error returned by the handler, or the error decoding the record.
+	Err error
+	// PublishErr, when set, is the error that kept the message out of the dead-letter stream.
+	PublishErr error
+}
+
+func (e *DeadLetterError) Error() string {
+	if e.PublishErr != nil {
+		return fmt.Sprintf("dropped message %s/%s (%s): %v; publishing it to the dead-letter stream failed: %v",
+			e.Message.ShardID, e.Message.SequenceNumber, e.Reason, e.Err, e.PublishErr)
+	}
+	return fmt.Sprintf("dropped message %s/%s (%s): %v", e.Message.ShardID, e.Message.SequenceNumber, e.Reason, e.Err)
+}
+
+// NewConsumer returns a Consumer reading through c. Call Run to start it.
+func NewConsumer(c kinesisConsume, config ConsumerConfig) *Consumer {
+	config.Retry = config.Retry.withDefaults()
+	if config.Group != nil {
+		config.Stream = config.Group.Stream
+	}
+	consumer := &Consumer{c: c, config: config, closing: make(chan struct{})}
+	if config.DeadLetter != "" {
+		consumer.deadLetters = NewUnicaster(c, config.DeadLetter, config.DeadLetterOptions)
+	}
+	return consumer
+}
+
+// Run hands messages to h until Close is called. It returns once the consumer has stopped, or at once with the
+// error met when starting to read.
+func (c *Consumer) Run(h Handler) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrConsumerClosed
+	}
+	if c.source != nil {
+		c.mu.Unlock()
+		return errors.New("consumer is already running")
+	}
+	c.handler = h
+	var source messageSource
+	var err error
+	if c.config.Group != nil {
+		source, err = joinGroup(c.c, *c.config.Group, c.handle)
+	} else {
+		source, err = subscribe(c.c, c.config.Stream, c.config.Subscribe, c.handle)
+	}
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	c.source = source
+	c.mu.Unlock()
+	for err := range source.Errors() {
+		c.report(err)
+	}
+	return nil
+}
+
+// Close stops the consumer, waiting for the handler to return. A message being retried is given up on, without
+// a checkpoint, so it is handled again when the shard is next read.
+func (c *Consumer) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closing)
+		c.mu.Lock()
+		c.closed = true
+		source := c.source
+		c.mu.Unlock()
+		if source != nil {
+			err = source.Close()
+		}
+	})
+	return err
+}
+
+// handle calls the handler until it succeeds, then dead-letters the message if it was rejected or never
+// succeeded. A record that failed to decode with decodeErr is dead-lettered as it is. It returns false if the
+// consumer or the subscription closed first.
+func (c *Consumer) handle(m *Message, decodeErr error, closing <-chan struct{}) bool {
+	if decodeErr != nil {
+		return c.deadLetter(m, reasonUndecodable, decodeErr, 0, closing)
+	}
+	for attempt := 1; ; attempt++ {
+		err := c.handler(m)
+		if err == nil {
+			return true
+		}
+		if r, ok := err.(*rejection); ok {
+			return c.deadLetter(m, reasonRejected, r.err, attempt, closing)
+		}
+		if attempt >= c.config.Retry.MaxAttempts {
+			return c.deadLetter(m, reasonExhausted, err, attempt, closing)
+		}
+		if !c.wait(c.config.Retry.backoff(attempt), closing) {
+			return false
+		}
+	}
+}
+
+// deadLetter publishes m to the dead-letter stream with the failure headers, or reports it dropped when there is
+// no dead-letter stream. Publishing is tried up to Retry.MaxAttempts times while Kinesis throttles it or fails
+// on its side; a message it keeps out of the stream, or refuses for good, is reported dropped so that the shard
+// moves on.
+func (c *Consumer) deadLetter(m *Message, reason string, err error, attempts int, closing <-chan struct{}) bool {
+	if c.deadLetters == nil {
+		c.report(&DeadLetterError{Message: m, Reason: reason, Err: err})
+		return true
+	}
+	dead := &Message{ID: m.ID, PublisherID: m.PublisherID, PublishedAt: m.PublishedAt, Data: m.Data}
+	if !m.Enveloped {
+		dead.ID = contentID(m.Data)
+	}
+	dead.Headers = make(map[string]string, len(m.Headers)+6)
+	for k, v := range m.Headers {
+		dead.Headers[k] = v
+	}
+	dead.Headers[DeadLetterReasonHeader] = reason
+	dead.Headers[DeadLetterErrorHeader] = err.Error()
+	dead.Headers[DeadLetterAttemptsHeader] = strconv.Itoa(attempts)
+	dead.Headers[DeadLetterStreamHeader] = c.config.Stream
+	dead.Headers[DeadLetterShardHeader] = m.ShardID
+	dead.Headers[DeadLetterSequenceHeader] = m.SequenceNumber
+	// The ID is hashed as it may be longer than a partition key can be.
+	key := contentID([]byte(dead.ID))
+	for failures := 1; ; failures++ {
+		_, perr := c.deadLetters.PublishMessage(key, dead)
+		if perr == nil {
+			return true
+		}
+		if failures >= c.config.Retry.MaxAttempts || permanentError(perr) {
+			c.report(&DeadLetterError{Message: m, Reason: reason, Err: err, PublishErr: perr})
+			return true
+		}
+		c.report(perr)
+		if !c.wait(c.config.Retry.backoff(failures), closing) {
+			return false
+		}
+	}
+}
+
+// throttlingCodes are the error codes Kinesis answers with when a call is over a limit and worth making again.
+var throttlingCodes = map[string]bool{
+	errThroughputExceeded:    true,
+	"LimitExceededException": true,
+	"ThrottlingException":    true,
+	"Throttling":             true,
+}
+
+// permanentError reports whether a call that failed with err would fail the same way if it were made again: an
+// error response from Kinesis that is neither throttling nor a failure on its side.
+func permanentError(err error) bool {
+	e := aws.Error(err)
+	return e != nil && e.StatusCode < 500 && !throttlingCodes[e.Code]
+}
+
+// wait pauses for d and returns false if the consumer or the subscription closed in the meantime.
+func (c *Consumer) wait(d time.Duration, closing <-chan struct{}) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-c.closing:
+		return false
+	case <-closing:
+		return false
+	}
+}
+
+func (c *Consumer) report(err error) {
+	if c.config.OnError != nil {
+		c.config.OnError(err)
+	}
+}
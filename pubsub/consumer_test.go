@@ -0,0 +1,311 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// consumerLog records the calls made to a handler and the errors reported by a consumer.
+type consumerLog struct {
+	mu      sync.Mutex
+	handled []string
+	errs    []error
+}
+
+func (l *consumerLog) handle(m *Message) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.handled = append(l.handled, string(m.Data))
+}
+
+func (l *consumerLog) report(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errs = append(l.errs, err)
+}
+
+func (l *consumerLog) calls() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return fmt.Sprint(l.handled)
+}
+
+// runConsumer starts a consumer of the stream "in" of c, retrying three times, and returns it with a channel that
+// receives the result of Run.
+func runConsumer(c *kinesisRelayMock, config ConsumerConfig, h Handler) (*Consumer, chan error) {
+	config.Stream = "in"
+	config.Retry = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	consumer := NewConsumer(c, config)
+	done := make(chan error, 1)
+	go func() { done <- consumer.Run(h) }()
+	return consumer, done
+}
+
+func TestConsumerHandlesMessages(t *testing.T) {
+	c := relayMock("in 1")
+	for _, data := range []string{"a", "b", "c"} {
+		c.Add("in 1", data)
+	}
+	store := NewMemoryCheckpointStore()
+	var log consumerLog
+	consumer, done := runConsumer(c, ConsumerConfig{
+		Subscribe: &SubscribeOptions{ShardID: "in 1", Start: TrimHorizon, Checkpoints: store, PollInterval: time.Millisecond},
+	}, func(m *Message) error {
+		log.handle(m)
+		return nil
+	})
+	waitFor(t, "the messages to be handled", func() bool { return log.calls() == "[a b c]" })
+	waitFor(t, "the checkpoint", func() bool {
+		seq, _ := store.Checkpoint("in", "in 1")
+		return seq == "2"
+	})
+	if err := consumer.Close(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("expected Run to return nil after Close, was %v", err)
+	}
+	if err := consumer.Run(nil); err != ErrConsumerClosed {
+		t.Errorf("expected ErrConsumerClosed running a closed consumer, was %v", err)
+	}
+}
+
+func TestConsumerRetriesWithoutCheckpoint(t *testing.T) {
+	c := relayMock("in 1")
+	for _, data := range []string{"a", "b", "c"} {
+		c.Add("in 1", data)
+	}
+	store := NewMemoryCheckpointStore()
+	var log consumerLog
+	failures := 0
+	consumer, _ := runConsumer(c, ConsumerConfig{
+		Subscribe: &SubscribeOptions{ShardID: "in 1", Start: TrimHorizon, Limit: 1, Checkpoints: store, PollInterval: time.Millisecond},
+	}, func(m *Message) error {
+		log.handle(m)
+		if string(m.Data) == "b" && failures < 2 {
+			failures++
+			if seq, _ := store.Checkpoint("in", "in 1"); seq != "0" {
+				t.Errorf("expected the checkpoint to stay before b while it fails, was %q", seq)
+			}
+			return errors.New("try again")
+		}
+		return nil
+	})
+	defer consumer.Close()
+	waitFor(t, "the messages to be handled", func() bool { return log.calls() == "[a b b b c]" })
+	waitFor(t, "the checkpoint", func() bool {
+		seq, _ := store.Checkpoint("in", "in 1")
+		return seq == "2"
+	})
+}
+
+func TestConsumerDeadLetters(t *testing.T) {
+	c := relayMock("in 1")
+	bad, _ := Wrap(&Message{ID: "bad", Headers: map[string]string{"type": "text"}, Data: []byte("b")})
+	// An envelope from a newer version cannot be decoded, so it never reaches the handler.
+	newer := string(append(append([]byte{}, envelopeMagic...), EnvelopeVersion+1, 0))
+	for _, data := range []string{"a", string(bad), "c", newer, "d"} {
+		c.Add("in 1", data)
+	}
+	store := NewMemoryCheckpointStore()
+	var log consumerLog
+	consumer, _ := runConsumer(c, ConsumerConfig{
+		Subscribe:  &SubscribeOptions{ShardID: "in 1", Start: TrimHorizon, Checkpoints: store, PollInterval: time.Millisecond},
+		DeadLetter: "dead letters",
+		OnError:    log.report,
+	}, func(m *Message) error {
+		log.handle(m)
+		switch string(m.Data) {
+		case "b":
+			return errors.New("boom")
+		case "c":
+			return Reject(errors.New("malformed"))
+		}
+		return nil
+	})
+	defer consumer.Close()
+	waitFor(t, "the messages to be handled", func() bool { return log.calls() == "[a b b b c d]" })
+	waitFor(t, "the checkpoint to move past the dead letters", func() bool {
+		seq, _ := store.Checkpoint("in", "in 1")
+		return seq == "4"
+	})
+
+	c.mu.Lock()
+	dead := c.Accepted["shard ID 1"]
+	c.mu.Unlock()
+	if len(dead) != 3 {
+		t.Fatalf("expected 3 dead letters, was %d", len(dead))
+	}
+	want := []struct {
+		id, data, reason, err, attempts, seq string
+	}{
+		{"bad", "b", "retries exhausted", "boom", "3", "1"},
+		{contentID([]byte("c")), "c", "rejected", "malformed", "1", "2"},
+		{contentID([]byte(newer)), newer, "decode failed", ErrUnsupportedEnvelope.Error(), "0", "3"},
+	}
+	for i, w := range want {
+		m, err := Unwrap([]byte(dead[i]))
+		if err != nil || m.ID != w.id || string(m.Data) != w.data {
+			t.Errorf("dead letter %d: expected message %s, was %+v, %v", i, w.id, m, err)
+			continue
+		}
+		headers := map[string]string{
+			DeadLetterReasonHeader:   w.reason,
+			DeadLetterErrorHeader:    w.err,
+			DeadLetterAttemptsHeader: w.attempts,
+			DeadLetterStreamHeader:   "in",
+			DeadLetterShardHeader:    "in 1",
+			DeadLetterSequenceHeader: w.seq,
+		}
+		for k, v := range headers {
+			if m.Headers[k] != v {
+				t.Errorf("dead letter %d: expected %s %q, was %q", i, k, v, m.Headers[k])
+			}
+		}
+	}
+	if m, _ := Unwrap([]byte(dead[0])); m.Headers["type"] != "text" {
+		t.Errorf("expected the headers of the message to be kept, was %v", m.Headers)
+	}
+	if len(log.errs) != 0 {
+		t.Errorf("expected no errors, was %v", log.errs)
+	}
+}
+
+func TestConsumerDropsWhenDeadLetteringFails(t *testing.T) {
+	tests := []struct {
+		err      error
+		requests int
+	}{
+		{aws.APIError{StatusCode: 400, Code: "ResourceNotFoundException"}, 1},
+		{aws.APIError{StatusCode: 400, Code: errThroughputExceeded}, 3},
+		{aws.APIError{StatusCode: 500, Code: "InternalFailure"}, 3},
+	}
+	for _, test := range tests {
+		c := relayMock("in 1")
+		c.PutErr = test.err
+		id := strings.Repeat("x", 300)
+		bad, _ := Wrap(&Message{ID: id, Data: []byte("a")})
+		c.Add("in 1", string(bad))
+		c.Add("in 1", "b")
+		store := NewMemoryCheckpointStore()
+		var log consumerLog
+		consumer, _ := runConsumer(c, ConsumerConfig{
+			Subscribe:  &SubscribeOptions{ShardID: "in 1", Start: TrimHorizon, Checkpoints: store, PollInterval: time.Millisecond},
+			DeadLetter: "dead letters",
+			OnError:    log.report,
+		}, func(m *Message) error {
+			log.handle(m)
+			if string(m.Data) == "a" {
+				return Reject(errors.New("malformed"))
+			}
+			return nil
+		})
+		waitFor(t, "the checkpoint to move past the dropped message", func() bool {
+			seq, _ := store.Checkpoint("in", "in 1")
+			return seq == "1"
+		})
+		consumer.Close()
+
+		c.mu.Lock()
+		requests := c.Requests
+		c.mu.Unlock()
+		if len(requests) != test.requests {
+			t.Errorf("%v: expected %d attempts to dead-letter the message, was %d", test.err, test.requests, len(requests))
+		}
+		for _, r := range requests {
+			if key := *r.Records[0].PartitionKey; !validPartitionKey(key) {
+				t.Errorf("%v: expected a valid partition key, was %q", test.err, key)
+			}
+		}
+		log.mu.Lock()
+		last := log.errs[len(log.errs)-1]
+		log.mu.Unlock()
+		if e, ok := last.(*DeadLetterError); !ok || e.Message.ID != id || e.PublishErr != test.err {
+			t.Errorf("%v: expected the dropped message to be reported, was %v", test.err, last)
+		}
+	}
+}
+
+func TestConsumerDropsWithoutDeadLetterStream(t *testing.T) {
+	c := relayMock("in 1")
+	c.Add("in 1", "a")
+	c.Add("in 1", "b")
+	store := NewMemoryCheckpointStore()
+	var log consumerLog
+	consumer, _ := runConsumer(c, ConsumerConfig{
+		Subscribe: &SubscribeOptions{ShardID: "in 1", Start: TrimHorizon, Checkpoints: store, PollInterval: time.Millisecond},
+		OnError:   log.report,
+	}, func(m *Message) error {
+		log.handle(m)
+		if string(m.Data) == "a" {
+			return Reject(errors.New("malformed"))
+		}
+		return nil
+	})
+	defer consumer.Close()
+	waitFor(t, "the checkpoint", func() bool {
+		seq, _ := store.Checkpoint("in", "in 1")
+		return seq == "1"
+	})
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	if len(log.errs) != 1 {
+		t.Fatalf("expected the dropped message to be reported, was %v", log.errs)
+	}
+	if e, ok := log.errs[0].(*DeadLetterError); !ok || e.Reason != "rejected" || e.Message.SequenceNumber != "0" {
+		t.Errorf("unexpected error %v", log.errs[0])
+	}
+}
+
+func TestConsumerCloseWhileRetrying(t *testing.T) {
+	c := relayMock("in 1")
+	c.Add("in 1", "a")
+	store := NewMemoryCheckpointStore()
+	var log consumerLog
+	config := ConsumerConfig{
+		Stream:    "in",
+		Subscribe: &SubscribeOptions{ShardID: "in 1", Start: TrimHorizon, Checkpoints: store, PollInterval: time.Millisecond},
+		Retry:     RetryPolicy{MaxAttempts: 1000, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	}
+	consumer := NewConsumer(c, config)
+	done := make(chan error, 1)
+	go func() {
+		done <- consumer.Run(func(m *Message) error {
+			log.handle(m)
+			return errors.New("down")
+		})
+	}()
+	waitFor(t, "the handler to be retried", func() bool { return len(log.calls()) > len("[a a a]") })
+	consumer.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for Run to return")
+	}
+	if seq, _ := store.Checkpoint("in", "in 1"); seq != "" {
+		t.Errorf("expected no checkpoint for a message given up on, was %q", seq)
+	}
+}
+
+func TestConsumerGroup(t *testing.T) {
+	c := relayMock("in 1", "in 2")
+	c.Add("in 1", "a")
+	c.Add("in 2", "b")
+	var log consumerLog
+	consumer, _ := runConsumer(c, ConsumerConfig{
+		Group: &GroupConfig{Stream: "in", Leases: NewMemoryLeaseStore(), Start: TrimHorizon, PollInterval: time.Millisecond},
+	}, func(m *Message) error {
+		log.handle(m)
+		return nil
+	})
+	defer consumer.Close()
+	waitFor(t, "the messages to be handled", func() bool {
+		calls := log.calls()
+		return calls == "[a b]" || calls == "[b a]"
+	})
+}
@@ -0,0 +1,386 @@
+package pubsub
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultLeaseDuration is how long a lease lasts without renewal unless configured otherwise. A worker that dies
+// leaves its shards unread for up to this long.
+const DefaultLeaseDuration = 10 * time.Second
+
+// ErrLeaseLost is returned when checkpointing a shard whose lease the worker no longer holds.
+var ErrLeaseLost = errors.New("shard lease is not held by this worker")
+
+// LeaseConfig configures a LeaseCoordinator.
+type LeaseConfig struct {
+	// Stream is the stream whose shards are leased.
+	Stream string
+	// WorkerID identifies the worker in the leases it holds and must be unique in the fleet. It defaults to
+	// DefaultPublisherID.
+	WorkerID string
+	// Store holds the leases shared by the fleet.
+	Store LeaseStore
+	// Duration is how long a lease lasts without renewal. The clocks of the workers are assumed to agree to well
+	// within it.
+	Duration time.Duration
+	// RenewInterval is the time between two rounds of renewing and balancing leases; it defaults to a third of
+	// Duration.
+	RenewInterval time.Duration
+	// OnAcquire, when set, is called with every lease the worker takes. Reading the shard should resume after
+	// the lease's checkpoint.
+	OnAcquire func(l Lease)
+	// OnLose, when set, is called with the ID of every shard whose lease was taken by another worker, after
+	// which the shard should no longer be read.
+	OnLose func(shardID string)
+	// OnError, when set, is called with every error met while renewing and balancing leases. The coordinator
+	// carries on regardless and retries on the next round.
+	OnError func(err error)
+	// Clock is the time source used to set and check lease expiry; nil uses the system clock.
+	Clock Clock
+}
+
+// LeaseCoordinator shares the shards of a stream among a fleet of workers, each of which reads the shards whose
+// leases it holds. Every round it creates the leases of new shards, renews the leases it holds and takes free or
+// expired ones until it holds its fair share: the leases that can be read, divided by the workers holding any.
+// A worker still short of its share steals one lease per round from the worker holding the most, so that load
+// spreads out as workers join. The loser notices on its next renewal, so a stolen shard may briefly be read by
+// both and its records delivered twice.
+//
+// The shards created by SplitShard or MergeShards are only leased once the shards they came from are
+// checkpointed at ShardEnd, so records with the same hash key are processed in order.
+//
+// A LeaseCoordinator is also the CheckpointStore of its stream, keeping checkpoints in the leases. A checkpoint
+// is only accepted from the holder of the lease, so a worker that lost a shard cannot move it backwards.
+type LeaseCoordinator struct {
+	c      kinesisDescribeStream
+	config LeaseConfig
+
+	mu   sync.Mutex
+	held map[string]*Lease
+
+	closeOnce sync.Once
+	closing   chan struct{}
+	done      chan struct{}
+}
+
+// NewLeaseCoordinator starts coordinating the leases of config.Stream for this worker.
+func NewLeaseCoordinator(c kinesisDescribeStream, config LeaseConfig) *LeaseCoordinator {
+	lc := newLeaseCoordinator(c, config)
+	go lc.run()
+	return lc
+}
+
+func newLeaseCoordinator(c kinesisDescribeStream, config LeaseConfig) *LeaseCoordinator {
+	if config.WorkerID == "" {
+		config.WorkerID = DefaultPublisherID()
+	}
+	if config.Duration <= 0 {
+		config.Duration = DefaultLeaseDuration
+	}
+	if config.RenewInterval <= 0 {
+		config.RenewInterval = config.Duration / 3
+	}
+	return &LeaseCoordinator{
+		c:       c,
+		config:  config,
+		held:    make(map[string]*Lease),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Held returns the IDs of the shards whose leases the worker holds, in order.
+func (lc *LeaseCoordinator) Held() []string {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	ids := make([]string, 0, len(lc.held))
+	for id := range lc.held {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Checkpoint implements CheckpointStore for the coordinator's stream.
+func (lc *LeaseCoordinator) Checkpoint(stream, shardID string) (string, error) {
+	lc.mu.Lock()
+	if l, ok := lc.held[shardID]; ok {
+		lc.mu.Unlock()
+		return l.Checkpoint, nil
+	}
+	lc.mu.Unlock()
+	leases, err := lc.config.Store.Leases()
+	if err != nil {
+		return "", err
+	}
+	for _, l := range leases {
+		if l.ShardID == shardID {
+			return l.Checkpoint, nil
+		}
+	}
+	return "", nil
+}
+
+// SetCheckpoint implements CheckpointStore for the coordinator's stream. It returns ErrLeaseLost if the worker
+// does not hold the lease of the shard, or another worker has just taken it.
+func (lc *LeaseCoordinator) SetCheckpoint(stream, shardID, seq string) error {
+	lc.mu.Lock()
+	l, ok := lc.held[shardID]
+	if !ok {
+		lc.mu.Unlock()
+		return ErrLeaseLost
+	}
+	update := *l
+	update.Checkpoint = seq
+	err := lc.config.Store.UpdateLease(&update)
+	switch err {
+	case nil:
+		lc.held[shardID] = &update
+	case ErrLeaseConflict:
+		delete(lc.held, shardID)
+	}
+	lc.mu.Unlock()
+	if err == ErrLeaseConflict {
+		lc.lose(shardID)
+		return ErrLeaseLost
+	}
+	return err
+}
+
+// Close stops coordinating and hands the held leases back, free, so that other workers take them over at once
+// rather than once they expire. Stop reading and checkpoint the shards before calling it.
+func (lc *LeaseCoordinator) Close() error {
+	lc.closeOnce.Do(func() {
+		close(lc.closing)
+		<-lc.done
+	})
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	var first error
+	for id, l := range lc.held {
+		release := *l
+		release.Owner, release.Expires = "", time.Time{}
+		if err := lc.config.Store.UpdateLease(&release); err != nil && err != ErrLeaseConflict && first == nil {
+			first = err
+		}
+		delete(lc.held, id)
+	}
+	return first
+}
+
+// run balances leases every RenewInterval until the coordinator is closed.
+func (lc *LeaseCoordinator) run() {
+	defer close(lc.done)
+	ticker := time.NewTicker(lc.config.RenewInterval)
+	defer ticker.Stop()
+	for {
+		if err := lc.balance(); err != nil && lc.config.OnError != nil {
+			lc.config.OnError(err)
+		}
+		select {
+		case <-ticker.C:
+		case <-lc.closing:
+			return
+		}
+	}
+}
+
+// balance runs one round: it creates the leases of new shards, renews or gives up the held ones and takes more
+// up to the worker's fair share.
+func (lc *LeaseCoordinator) balance() error {
+	shards, err := gatherShards(lc.c, &lc.config.Stream)
+	if err != nil {
+		return err
+	}
+	leases, err := lc.config.Store.Leases()
+	if err != nil {
+		return err
+	}
+	known := make(map[string]*Lease, len(leases))
+	for _, l := range leases {
+		known[l.ShardID] = l
+	}
+	for _, s := range shards {
+		if _, ok := known[*s.ShardID]; ok {
+			continue
+		}
+		l := &Lease{ShardID: *s.ShardID, ParentShardIDs: parentIDs(s)}
+		switch err := lc.config.Store.CreateLease(l); err {
+		case nil:
+			known[l.ShardID] = l
+			leases = append(leases, l)
+		case ErrLeaseConflict:
+		default:
+			return err
+		}
+	}
+	sort.Sort(byShardID(leases))
+
+	now := lc.now()
+	var acquired []Lease
+	var lost []string
+	lc.mu.Lock()
+	first := lc.renew(known, now, &lost)
+	available := lc.available(leases, known)
+	target := fairShare(available, lc.config.WorkerID, now)
+	for _, l := range available {
+		if len(lc.held) >= target {
+			break
+		}
+		if l.held(now) {
+			continue
+		}
+		if err := lc.take(l, now, &acquired); err != nil && first == nil {
+			first = err
+		}
+	}
+	if len(lc.held) < target {
+		if l := victim(available, target, lc.config.WorkerID, now); l != nil {
+			if err := lc.take(l, now, &acquired); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	lc.mu.Unlock()
+
+	for _, id := range lost {
+		lc.lose(id)
+	}
+	if lc.config.OnAcquire != nil {
+		for _, l := range acquired {
+			lc.config.OnAcquire(l)
+		}
+	}
+	return first
+}
+
+// renew extends the held leases, gives up those checkpointed at ShardEnd and drops those taken by another
+// worker, adding their shard IDs to lost. It must be called with mu held.
+func (lc *LeaseCoordinator) renew(known map[string]*Lease, now time.Time, lost *[]string) error {
+	var first error
+	for id, h := range lc.held {
+		cur := known[id]
+		if cur == nil || cur.Owner != lc.config.WorkerID || cur.Counter != h.Counter {
+			delete(lc.held, id)
+			*lost = append(*lost, id)
+			continue
+		}
+		update := *cur
+		if update.Checkpoint == ShardEnd {
+			update.Owner, update.Expires = "", time.Time{}
+		} else {
+			update.Expires = now.Add(lc.config.Duration)
+		}
+		switch err := lc.config.Store.UpdateLease(&update); err {
+		case nil:
+			*cur = update
+			if update.Owner == "" {
+				delete(lc.held, id)
+			} else {
+				lc.held[id] = &update
+			}
+		case ErrLeaseConflict:
+			delete(lc.held, id)
+			*lost = append(*lost, id)
+		default:
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// available returns the leases whose shards can be read: not yet read to their end, and with every parent shard
+// that still has a lease read to its end.
+func (lc *LeaseCoordinator) available(leases []*Lease, known map[string]*Lease) []*Lease {
+	var available []*Lease
+	for _, l := range leases {
+		if l.Checkpoint == ShardEnd {
+			continue
+		}
+		ready := true
+		for _, p := range l.ParentShardIDs {
+			if parent, ok := known[p]; ok && parent.Checkpoint != ShardEnd {
+				ready = false
+			}
+		}
+		if ready {
+			available = append(available, l)
+		}
+	}
+	return available
+}
+
+// take makes the worker the owner of l, adding it to acquired. Losing the race to another worker is not an error.
+// It must be called with mu held.
+func (lc *LeaseCoordinator) take(l *Lease, now time.Time, acquired *[]Lease) error {
+	update := *l
+	update.Owner, update.Expires = lc.config.WorkerID, now.Add(lc.config.Duration)
+	switch err := lc.config.Store.UpdateLease(&update); err {
+	case nil:
+		*l = update
+		lc.held[l.ShardID] = &update
+		*acquired = append(*acquired, update)
+		return nil
+	case ErrLeaseConflict:
+		return nil
+	default:
+		return err
+	}
+}
+
+// lose reports that the lease of shardID was taken by another worker.
+func (lc *LeaseCoordinator) lose(shardID string) {
+	if lc.config.OnLose != nil {
+		lc.config.OnLose(shardID)
+	}
+}
+
+func (lc *LeaseCoordinator) now() time.Time {
+	if lc.config.Clock == nil {
+		return time.Now()
+	}
+	return lc.config.Clock.Now()
+}
+
+// fairShare is the number of available leases each worker should hold: their count divided by the workers
+// holding any of them, this one included, rounded up.
+func fairShare(available []*Lease, workerID string, now time.Time) int {
+	workers := map[string]bool{workerID: true}
+	for _, l := range available {
+		if l.held(now) {
+			workers[l.Owner] = true
+		}
+	}
+	return (len(available) + len(workers) - 1) / len(workers)
+}
+
+// victim picks a lease to steal from the worker holding the most available leases, provided it holds more than
+// target. Ties go to the lowest worker ID and the lease with the highest shard ID.
+func victim(available []*Lease, target int, workerID string, now time.Time) *Lease {
+	counts := make(map[string]int)
+	for _, l := range available {
+		if l.held(now) && l.Owner != workerID {
+			counts[l.Owner]++
+		}
+	}
+	busiest := ""
+	for owner, n := range counts {
+		if n > counts[busiest] || n == counts[busiest] && owner < busiest {
+			busiest = owner
+		}
+	}
+	if counts[busiest] <= target {
+		return nil
+	}
+	for i := len(available) - 1; i >= 0; i-- {
+		if l := available[i]; l.held(now) && l.Owner == busiest {
+			return l
+		}
+	}
+	return nil
+}
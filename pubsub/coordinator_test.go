@@ -0,0 +1,207 @@
+package pubsub
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// leaseWorkers returns coordinators sharing a store and a clock, for the shards of the stream "in" of c.
+func leaseWorkers(c *kinesisRelayMock, store LeaseStore, clock Clock, ids ...string) []*LeaseCoordinator {
+	var workers []*LeaseCoordinator
+	for _, id := range ids {
+		workers = append(workers, newLeaseCoordinator(c, LeaseConfig{Stream: "in", WorkerID: id, Store: store, Clock: clock}))
+	}
+	return workers
+}
+
+// rounds balances every worker in turn n times, failing the test on an error.
+func rounds(t *testing.T, n int, workers ...*LeaseCoordinator) {
+	for i := 0; i < n; i++ {
+		for _, w := range workers {
+			if err := w.balance(); err != nil {
+				t.Fatalf("%s: unexpected error %v", w.config.WorkerID, err)
+			}
+		}
+	}
+}
+
+func heldCounts(workers []*LeaseCoordinator) []int {
+	var counts []int
+	for _, w := range workers {
+		counts = append(counts, len(w.Held()))
+	}
+	return counts
+}
+
+func TestLeaseCoordinatorSharesShards(t *testing.T) {
+	c := relayMock("in 1", "in 2", "in 3", "in 4", "in 5")
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store := NewMemoryLeaseStore()
+	var acquired []string
+	workers := leaseWorkers(c, store, clock, "a", "b")
+	workers[0].config.OnAcquire = func(l Lease) { acquired = append(acquired, l.ShardID) }
+
+	rounds(t, 1, workers[0])
+	if got := workers[0].Held(); len(got) != 5 {
+		t.Fatalf("expected a lone worker to take every shard, was %v", got)
+	}
+	if len(acquired) != 5 {
+		t.Errorf("expected OnAcquire to be called for every shard, was %v", acquired)
+	}
+
+	// b steals one lease per round until it holds its share, and a lets go of them when it next renews.
+	rounds(t, 3, workers...)
+	if got := heldCounts(workers); !reflect.DeepEqual(got, []int{3, 2}) {
+		t.Fatalf("expected the shards to be shared 3-2, was %v", got)
+	}
+	seen := make(map[string]bool)
+	for _, w := range workers {
+		for _, id := range w.Held() {
+			if seen[id] {
+				t.Errorf("expected %s to be held by a single worker", id)
+			}
+			seen[id] = true
+		}
+	}
+
+	// A third worker takes one shard from a, then rounds settle without further moves.
+	workers = append(workers, leaseWorkers(c, store, clock, "c")...)
+	rounds(t, 3, workers...)
+	if got := heldCounts(workers); !reflect.DeepEqual(got, []int{2, 2, 1}) {
+		t.Errorf("expected the shards to be shared 2-2-1, was %v", got)
+	}
+}
+
+func TestLeaseCoordinatorTakesExpiredLeases(t *testing.T) {
+	c := relayMock("in 1", "in 2")
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store := NewMemoryLeaseStore()
+	workers := leaseWorkers(c, store, clock, "a", "b")
+	var lost []string
+	workers[0].config.OnLose = func(shardID string) { lost = append(lost, shardID) }
+	rounds(t, 2, workers...)
+	if got := heldCounts(workers); !reflect.DeepEqual(got, []int{1, 1}) {
+		t.Fatalf("expected one shard each, was %v", got)
+	}
+	lost = nil
+
+	// a stops renewing, so its lease runs out and b takes it over.
+	clock.Advance(DefaultLeaseDuration / 2)
+	rounds(t, 1, workers[1])
+	clock.Advance(DefaultLeaseDuration / 2)
+	rounds(t, 1, workers[1])
+	if got := workers[1].Held(); len(got) != 2 {
+		t.Fatalf("expected b to take over the expired lease, was %v", got)
+	}
+	rounds(t, 1, workers[0])
+	if !reflect.DeepEqual(lost, []string{"in 1"}) {
+		t.Errorf("expected a to lose in 1 on its next round, was %v", lost)
+	}
+	if got := workers[0].Held(); !reflect.DeepEqual(got, []string{"in 2"}) {
+		t.Errorf("expected a to steal in 2 back, was %v", got)
+	}
+	if err := workers[0].SetCheckpoint("in", lost[0], "9"); err != ErrLeaseLost {
+		t.Errorf("expected ErrLeaseLost checkpointing a lost shard, was %v", err)
+	}
+}
+
+func TestLeaseCoordinatorCheckpoints(t *testing.T) {
+	c := relayMock("in 1")
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store := NewMemoryLeaseStore()
+	workers := leaseWorkers(c, store, clock, "a", "b")
+	var lost []string
+	workers[0].config.OnLose = func(shardID string) { lost = append(lost, shardID) }
+	rounds(t, 1, workers[0])
+
+	if err := workers[0].SetCheckpoint("in", "in 1", "3"); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := workers[1].SetCheckpoint("in", "in 1", "4"); err != ErrLeaseLost {
+		t.Errorf("expected ErrLeaseLost checkpointing a shard held by another worker, was %v", err)
+	}
+	if seq, err := workers[1].Checkpoint("in", "in 1"); seq != "3" || err != nil {
+		t.Errorf("expected every worker to read checkpoint 3, was %q, %v", seq, err)
+	}
+
+	// Once the lease has expired and b has taken it, a's next checkpoint is refused.
+	clock.Advance(DefaultLeaseDuration)
+	rounds(t, 1, workers[1])
+	if err := workers[0].SetCheckpoint("in", "in 1", "5"); err != ErrLeaseLost {
+		t.Errorf("expected ErrLeaseLost checkpointing a stolen shard, was %v", err)
+	}
+	if !reflect.DeepEqual(lost, []string{"in 1"}) {
+		t.Errorf("expected OnLose to be called for in 1, was %v", lost)
+	}
+	if seq, _ := workers[1].Checkpoint("in", "in 1"); seq != "3" {
+		t.Errorf("expected the checkpoint to stay at 3, was %q", seq)
+	}
+}
+
+func TestLeaseCoordinatorFollowsLineage(t *testing.T) {
+	c := relayMock("in 1", "in 2")
+	c.Reshard("in 3", "in 1")
+	c.Reshard("in 4", "in 1")
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	workers := leaseWorkers(c, NewMemoryLeaseStore(), clock, "a")
+	rounds(t, 1, workers...)
+	if got := workers[0].Held(); !reflect.DeepEqual(got, []string{"in 1", "in 2"}) {
+		t.Fatalf("expected only the parent and unrelated shards to be leased, was %v", got)
+	}
+
+	if err := workers[0].SetCheckpoint("in", "in 1", ShardEnd); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	rounds(t, 1, workers...)
+	if got := workers[0].Held(); !reflect.DeepEqual(got, []string{"in 2", "in 3", "in 4"}) {
+		t.Errorf("expected the children to be leased once the parent ended, was %v", got)
+	}
+}
+
+func TestLeaseCoordinatorHandsOffOnClose(t *testing.T) {
+	c := relayMock("in 1", "in 2", "in 3", "in 4")
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	store := NewMemoryLeaseStore()
+	a := NewLeaseCoordinator(c, LeaseConfig{Stream: "in", WorkerID: "a", Store: store, Clock: clock, RenewInterval: time.Hour})
+	waitFor(t, "a to take the shards", func() bool { return len(a.Held()) == 4 })
+	b := leaseWorkers(c, store, clock, "b")[0]
+	rounds(t, 1, b)
+	if len(b.Held()) != 1 {
+		t.Fatalf("expected b to steal a shard, was %v", b.Held())
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got := a.Held(); len(got) != 0 {
+		t.Errorf("expected a to hold nothing after Close, was %v", got)
+	}
+	rounds(t, 1, b)
+	if got := b.Held(); len(got) != 4 {
+		t.Errorf("expected b to take the released shards before they expire, was %v", got)
+	}
+}
+
+func TestLeaseCoordinatorFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := relayMock("in 1", "in 2", "in 3")
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	var workers []*LeaseCoordinator
+	for i := 0; i < 3; i++ {
+		store := NewFileLeaseStore(filepath.Join(dir, "leases.json"))
+		workers = append(workers, leaseWorkers(c, store, clock, fmt.Sprint("worker ", i))...)
+	}
+	rounds(t, 3, workers...)
+	if got := heldCounts(workers); !reflect.DeepEqual(got, []int{1, 1, 1}) {
+		t.Errorf("expected one shard each, was %v", got)
+	}
+}
@@ -0,0 +1,162 @@
+package pubsub
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Deduplicator tells apart the first delivery of a message from its repeats. A broadcast reaches every shard, so
+// a consumer reading several shards, or following one through a reshard, receives the same message more than
+// once. Implementations are safe for concurrent use, so one can be shared by the subscriptions of a consumer.
+type Deduplicator interface {
+	// Seen records m and reports whether it had been recorded before.
+	Seen(m *Message) bool
+}
+
+// dedupKey identifies a message by its envelope ID or, when it has none, by the SHA-256 digest of its data. Raw
+// payloads with the same content are therefore taken for repeats of each other.
+func dedupKey(m *Message) [sha256.Size]byte {
+	if m.Enveloped && m.ID != "" {
+		return sha256.Sum256([]byte("id:" + m.ID))
+	}
+	return sha256.Sum256(append([]byte("data:"), m.Data...))
+}
+
+// WindowDeduplicator remembers every message for a fixed time after it was first seen. Its memory grows with the
+// rate of distinct messages times the window.
+type WindowDeduplicator struct {
+	// Window is how long a message is remembered.
+	Window time.Duration
+	// Clock is the time source; nil uses the system clock.
+	Clock Clock
+
+	mu    sync.Mutex
+	seen  map[[sha256.Size]byte]bool
+	order []windowEntry
+}
+
+// windowEntry is a message key and when it was first seen.
+type windowEntry struct {
+	key [sha256.Size]byte
+	at  time.Time
+}
+
+// NewWindowDeduplicator returns a WindowDeduplicator remembering messages for window.
+func NewWindowDeduplicator(window time.Duration) *WindowDeduplicator {
+	return &WindowDeduplicator{Window: window}
+}
+
+// Seen implements Deduplicator.
+func (d *WindowDeduplicator) Seen(m *Message) bool {
+	key := dedupKey(m)
+	now := time.Now()
+	if d.Clock != nil {
+		now = d.Clock.Now()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seen == nil {
+		d.seen = make(map[[sha256.Size]byte]bool)
+	}
+	expired := 0
+	for expired < len(d.order) && now.Sub(d.order[expired].at) >= d.Window {
+		delete(d.seen, d.order[expired].key)
+		expired++
+	}
+	d.order = d.order[expired:]
+	if d.seen[key] {
+		return true
+	}
+	d.seen[key] = true
+	d.order = append(d.order, windowEntry{key, now})
+	return false
+}
+
+// BloomDeduplicator remembers messages in a pair of Bloom filters of fixed size. Once the newer filter holds its
+// capacity, the older one is dropped and a new one started, so at least the last capacity messages are always
+// remembered and memory stays bounded whatever the message rate. In exchange a message that was never seen is
+// taken for a repeat with a small probability.
+type BloomDeduplicator struct {
+	mu       sync.Mutex
+	capacity int
+	hashes   int
+	current  *bloomFilter
+	previous *bloomFilter
+}
+
+// NewBloomDeduplicator returns a BloomDeduplicator sized so that with capacity messages per filter about
+// falsePositive of the new messages are wrongly dropped. It uses about 2 × 1.44 × capacity × log2(1/falsePositive)
+// bits. capacity must be positive and falsePositive strictly between 0 and 1.
+func NewBloomDeduplicator(capacity int, falsePositive float64) (*BloomDeduplicator, error) {
+	if capacity < 1 {
+		return nil, fmt.Errorf("bloom deduplicator capacity must be positive, was %d", capacity)
+	}
+	if !(falsePositive > 0 && falsePositive < 1) {
+		return nil, fmt.Errorf("bloom deduplicator false positive rate must be between 0 and 1, was %v", falsePositive)
+	}
+	bits := int(math.Ceil(-float64(capacity) * math.Log(falsePositive) / (math.Ln2 * math.Ln2)))
+	if bits < 64 {
+		bits = 64
+	}
+	hashes := int(float64(bits)/float64(capacity)*math.Ln2 + 0.5)
+	if hashes < 1 {
+		hashes = 1
+	}
+	return &BloomDeduplicator{
+		capacity: capacity,
+		hashes:   hashes,
+		current:  newBloomFilter(bits),
+		previous: newBloomFilter(bits),
+	}, nil
+}
+
+// Seen implements Deduplicator.
+func (d *BloomDeduplicator) Seen(m *Message) bool {
+	key := dedupKey(m)
+	h1 := binary.BigEndian.Uint64(key[0:8])
+	h2 := binary.BigEndian.Uint64(key[8:16]) | 1
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.current.contains(h1, h2, d.hashes) || d.previous.contains(h1, h2, d.hashes) {
+		return true
+	}
+	if d.current.count == d.capacity {
+		d.previous, d.current = d.current, newBloomFilter(len(d.current.bits)*64)
+	}
+	d.current.add(h1, h2, d.hashes)
+	return false
+}
+
+// bloomFilter is a set of bits addressed by double hashing.
+type bloomFilter struct {
+	bits  []uint64
+	count int
+}
+
+func newBloomFilter(bits int) *bloomFilter {
+	return &bloomFilter{bits: make([]uint64, (bits+63)/64)}
+}
+
+func (f *bloomFilter) contains(h1, h2 uint64, hashes int) bool {
+	n := uint64(len(f.bits) * 64)
+	for i := 0; i < hashes; i++ {
+		b := (h1 + uint64(i)*h2) % n
+		if f.bits[b/64]&(1<<(b%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) add(h1, h2 uint64, hashes int) {
+	n := uint64(len(f.bits) * 64)
+	for i := 0; i < hashes; i++ {
+		b := (h1 + uint64(i)*h2) % n
+		f.bits[b/64] |= 1 << (b % 64)
+	}
+	f.count++
+}
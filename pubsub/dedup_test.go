@@ -0,0 +1,151 @@
+package pubsub
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func testDeduplicator(t *testing.T, name string, d Deduplicator) {
+	tests := []struct {
+		m    *Message
+		seen bool
+	}{
+		{&Message{ID: "1", Enveloped: true, Data: []byte("a")}, false},
+		{&Message{ID: "1", Enveloped: true, Data: []byte("b")}, true},
+		{&Message{ID: "2", Enveloped: true, Data: []byte("a")}, false},
+		{&Message{Data: []byte("a")}, false},
+		{&Message{Data: []byte("a")}, true},
+		{&Message{Data: []byte("c")}, false},
+	}
+	for i, test := range tests {
+		if seen := d.Seen(test.m); seen != test.seen {
+			t.Errorf("%s: message %d: expected seen %v, was %v", name, i, test.seen, seen)
+		}
+	}
+}
+
+func TestWindowDeduplicator(t *testing.T) {
+	testDeduplicator(t, "window", NewWindowDeduplicator(time.Minute))
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	d := &WindowDeduplicator{Window: time.Minute, Clock: clock}
+	m := &Message{ID: "1", Enveloped: true}
+	d.Seen(m)
+	clock.Advance(59 * time.Second)
+	if !d.Seen(m) {
+		t.Error("expected the message to be remembered inside the window")
+	}
+	clock.Advance(time.Second)
+	if d.Seen(m) {
+		t.Error("expected the message to be forgotten after the window")
+	}
+	if len(d.seen) != 1 || len(d.order) != 1 {
+		t.Errorf("expected expired messages to be evicted, %d remain", len(d.order))
+	}
+}
+
+func newBloomDeduplicator(t *testing.T, capacity int, falsePositive float64) *BloomDeduplicator {
+	d, err := NewBloomDeduplicator(capacity, falsePositive)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return d
+}
+
+func TestBloomDeduplicator(t *testing.T) {
+	testDeduplicator(t, "bloom", newBloomDeduplicator(t, 100, 0.01))
+
+	d := newBloomDeduplicator(t, 1000, 0.01)
+	message := func(i int) *Message { return &Message{ID: fmt.Sprint(i), Enveloped: true} }
+	falsePositives := 0
+	for i := 0; i < 3000; i++ {
+		if d.Seen(message(i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 60 {
+		t.Errorf("expected about 1%% false positives, was %d of 3000", falsePositives)
+	}
+	for i := 2000; i < 3000; i++ {
+		if !d.Seen(message(i)) {
+			t.Fatalf("expected message %d of the last capacity to be remembered", i)
+		}
+	}
+	if d.Seen(message(0)) {
+		t.Error("expected the oldest messages to be forgotten")
+	}
+	if bits := len(d.current.bits) * 64; bits > 10000 {
+		t.Errorf("expected about 9600 bits per filter, was %d", bits)
+	}
+}
+
+func TestNewBloomDeduplicatorValidates(t *testing.T) {
+	for _, test := range []struct {
+		capacity      int
+		falsePositive float64
+	}{
+		{0, 0.01},
+		{-1, 0.01},
+		{100, 0},
+		{100, 1},
+		{100, -0.5},
+		{100, math.NaN()},
+	} {
+		if _, err := NewBloomDeduplicator(test.capacity, test.falsePositive); err == nil {
+			t.Errorf("expected capacity %d and false positive rate %v to be rejected", test.capacity, test.falsePositive)
+		}
+	}
+}
+
+func TestSubscribeDropsDuplicates(t *testing.T) {
+	c := relayMock("p")
+	s, err := Subscribe(c, "in", &SubscribeOptions{
+		PollInterval: time.Millisecond,
+		Dedup:        NewWindowDeduplicator(time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer s.Close()
+	waitFor(t, "the shard to be read", func() bool { return len(c.iterators()) == 1 })
+	first, _ := Wrap(&Message{ID: "first", Data: []byte("a")})
+	second, _ := Wrap(&Message{ID: "second", Data: []byte("a")})
+	c.Add("p", string(first))
+	// A publisher with a stale topology delivers to both the parent and the child.
+	c.Reshard("q", "p")
+	c.Add("q", string(first))
+	c.Add("q", string(second))
+	for _, want := range []string{"first", "second"} {
+		if m := receive(t, s, 1)[0]; m.ID != want {
+			t.Errorf("expected message %s, was %s", want, m.ID)
+		}
+	}
+}
+
+func TestBroadcasterDropsDuplicates(t *testing.T) {
+	c := relayMock("in 1", "in 2")
+	b, err := NewBroadcaster(c, BroadcastConfig{
+		In:           "in",
+		Out:          "out",
+		PollInterval: time.Millisecond,
+		Dedup:        newBloomDeduplicator(t, 1000, 0.001),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	waitFor(t, "both shards to be read", func() bool { return len(c.iterators()) == 2 })
+	a, _ := Wrap(&Message{ID: "a", Data: []byte("a")})
+	z, _ := Wrap(&Message{ID: "z", Data: []byte("z")})
+	for _, id := range []string{"in 1", "in 2"} {
+		c.Add(id, string(a))
+	}
+	waitFor(t, "the broadcast", func() bool { return len(c.accepted("shard ID 1")) >= 1 })
+	c.Add("in 2", string(z))
+	waitFor(t, "the next broadcast", func() bool { return len(c.accepted("shard ID 1")) >= 2 })
+	b.Close()
+	if got := c.accepted("shard ID 1"); fmt.Sprint(got) != "[a z]" {
+		t.Errorf("expected a once then z, was %v", got)
+	}
+}
@@ -0,0 +1,157 @@
+package pubsub
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// envelopeMagic starts every payload wrapped in a pubsub envelope. The byte that follows it is the envelope
+// version, then comes the uvarint length of a JSON header, the header itself and finally the message data.
+var envelopeMagic = []byte{0xE7, 'P', 'S'}
+
+// EnvelopeVersion is the envelope version written by Wrap.
+const EnvelopeVersion = 1
+
+// ErrUnsupportedEnvelope is returned by Unwrap for an envelope written by a newer version of pubsub.
+var ErrUnsupportedEnvelope = errors.New("unsupported envelope version")
+
+// Message is a payload together with the metadata pubsub carries alongside it in an envelope.
+type Message struct {
+	// ID identifies the message. Wrap assigns a random one when it is empty.
+	ID string
+	// PublisherID identifies the process that published the message.
+	PublisherID string
+	// PublishedAt is when the message was published. Wrap uses the current time when it is zero.
+	PublishedAt time.Time
+	// Headers holds arbitrary caller metadata, such as a content type.
+	Headers map[string]string
+	// Data is the payload.
+	Data []byte
+	// Enveloped is false when the message was read from a raw record that carried no envelope, in which case
+	// only Data is set.
+	Enveloped bool
+
+	// ShardID, SequenceNumber and SubSequenceNumber locate a received message in its stream. They are ignored
+	// when publishing.
+	ShardID           string
+	SequenceNumber    string
+	SubSequenceNumber int
+}
+
+// envelopeHeader is the JSON header of a version 1 envelope.
+type envelopeHeader struct {
+	ID          string            `json:"id"`
+	PublisherID string            `json:"pub,omitempty"`
+	PublishedAt int64             `json:"ts"`
+	Headers     map[string]string `json:"h,omitempty"`
+}
+
+// NewMessageID returns a random 128-bit message ID in hex.
+func NewMessageID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("reading random message ID: %v", err))
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// DefaultPublisherID identifies this process as host:pid.
+func DefaultPublisherID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// Wrap encodes m in an envelope, first filling in an empty ID and a zero PublishedAt.
+func Wrap(m *Message) ([]byte, error) {
+	if m.ID == "" {
+		m.ID = NewMessageID()
+	}
+	if m.PublishedAt.IsZero() {
+		m.PublishedAt = time.Now()
+	}
+	header, err := json.Marshal(envelopeHeader{
+		ID:          m.ID,
+		PublisherID: m.PublisherID,
+		PublishedAt: m.PublishedAt.UnixNano(),
+		Headers:     m.Headers,
+	})
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, len(envelopeMagic)+1+binary.MaxVarintLen64+len(header)+len(m.Data))
+	b = append(b, envelopeMagic...)
+	b = append(b, EnvelopeVersion)
+	b = appendVarint(b, uint64(len(header)))
+	b = append(b, header...)
+	return append(b, m.Data...), nil
+}
+
+// Unwrap decodes a payload written by Wrap. A payload without an envelope is returned unchanged as the Data of a
+// message that is not Enveloped, as is one that starts like an envelope but does not decode as one.
+func Unwrap(data []byte) (*Message, error) {
+	raw := &Message{Data: data}
+	if !bytes.HasPrefix(data, envelopeMagic) || len(data) == len(envelopeMagic) {
+		return raw, nil
+	}
+	rest := data[len(envelopeMagic):]
+	if rest[0] != EnvelopeVersion {
+		return nil, ErrUnsupportedEnvelope
+	}
+	rest = rest[1:]
+	n, l := binary.Uvarint(rest)
+	if l <= 0 || n > uint64(len(rest)-l) {
+		return raw, nil
+	}
+	var h envelopeHeader
+	if err := json.Unmarshal(rest[l:l+int(n)], &h); err != nil || h.ID == "" {
+		return raw, nil
+	}
+	return &Message{
+		ID:          h.ID,
+		PublisherID: h.PublisherID,
+		PublishedAt: time.Unix(0, h.PublishedAt),
+		Headers:     h.Headers,
+		Data:        rest[l+int(n):],
+		Enveloped:   true,
+	}, nil
+}
+
+// PutEnvelopes wraps messages in envelopes and broadcasts them with PutMessages. Messages without a PublisherID
+// get opts.PublisherID, or DefaultPublisherID when that is empty too. The IDs and timestamps assigned by Wrap are
+// left on the messages.
+func PutEnvelopes(c kinesisPubSub, stream string, messages []*Message, opts *Options) ([]*PutRecordResult, error) {
+	data := make([][]byte, len(messages))
+	for i, m := range messages {
+		b, err := opts.wrap(m)
+		if err != nil {
+			return nil, err
+		}
+		data[i] = b
+	}
+	return PutMessages(c, stream, data, opts)
+}
+
+// wrap wraps m in an envelope on behalf of the configured publisher.
+func (o *Options) wrap(m *Message) ([]byte, error) {
+	if m.PublisherID == "" {
+		if o != nil && o.PublisherID != "" {
+			m.PublisherID = o.PublisherID
+		} else {
+			m.PublisherID = defaultPublisherID
+		}
+	}
+	return Wrap(m)
+}
+
+// defaultPublisherID is computed once, as the host name and process ID do not change.
+var defaultPublisherID = DefaultPublisherID()
@@ -0,0 +1,123 @@
+package pubsub
+
+import (
+	"bytes"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"testing"
+	"time"
+)
+
+func TestWrapUnwrap(t *testing.T) {
+	published := time.Unix(1436000000, 123456789)
+	m := &Message{
+		ID:          "message ID",
+		PublisherID: "publisher",
+		PublishedAt: published,
+		Headers:     map[string]string{"content-type": "application/json"},
+		Data:        []byte(`{"hello": "world"}`),
+	}
+	data, err := Wrap(m)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	got, err := Unwrap(data)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !got.Enveloped || got.ID != m.ID || got.PublisherID != m.PublisherID || !got.PublishedAt.Equal(published) {
+		t.Errorf("unexpected message %+v", *got)
+	}
+	if got.Headers["content-type"] != "application/json" || !bytes.Equal(got.Data, m.Data) {
+		t.Errorf("unexpected headers %v or data %q", got.Headers, got.Data)
+	}
+}
+
+func TestWrapFillsDefaults(t *testing.T) {
+	m := &Message{Data: []byte("payload")}
+	data, err := Wrap(m)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(m.ID) != 32 || m.PublishedAt.IsZero() {
+		t.Errorf("expected an ID and timestamp to be assigned, was %q and %v", m.ID, m.PublishedAt)
+	}
+	got, _ := Unwrap(data)
+	if got.ID != m.ID || !got.PublishedAt.Equal(m.PublishedAt) {
+		t.Errorf("expected %s at %v, was %s at %v", m.ID, m.PublishedAt, got.ID, got.PublishedAt)
+	}
+	other := &Message{}
+	Wrap(other)
+	if other.ID == m.ID {
+		t.Error("expected message IDs to differ")
+	}
+}
+
+func TestUnwrapPassesThroughRawPayloads(t *testing.T) {
+	tests := [][]byte{
+		nil,
+		[]byte("plain payload"),
+		envelopeMagic,
+		append(append([]byte{}, envelopeMagic...), EnvelopeVersion, 0xFF),
+		append(append([]byte{}, envelopeMagic...), EnvelopeVersion, 2, '{', '}'),
+	}
+	for _, data := range tests {
+		got, err := Unwrap(data)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", data, err)
+			continue
+		}
+		if got.Enveloped || !bytes.Equal(got.Data, data) {
+			t.Errorf("%q: expected the payload to pass through, was %+v", data, *got)
+		}
+	}
+}
+
+func TestUnwrapUnsupportedVersion(t *testing.T) {
+	data, _ := Wrap(&Message{Data: []byte("payload")})
+	data[len(envelopeMagic)] = EnvelopeVersion + 1
+	if _, err := Unwrap(data); err != ErrUnsupportedEnvelope {
+		t.Errorf("expected %v, was %v", ErrUnsupportedEnvelope, err)
+	}
+}
+
+func TestPutEnvelopes(t *testing.T) {
+	c := sequencingMock()
+	m := &Message{Headers: map[string]string{"k": "v"}, Data: []byte("payload")}
+	if _, err := PutEnvelopes(c, "stream name", []*Message{m}, &Options{PublisherID: "publisher"}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, e := range c.Requests[0].Records {
+		got, err := Unwrap(e.Data)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if got.ID != m.ID || got.PublisherID != "publisher" || got.Headers["k"] != "v" || string(got.Data) != "payload" {
+			t.Errorf("unexpected message %+v", *got)
+		}
+	}
+}
+
+func TestPublisherPublishMessage(t *testing.T) {
+	c := publisherMock()
+	p := NewPublisher(c, PublisherConfig{Stream: "stream name"})
+	m := &Message{Data: []byte("payload")}
+	if _, err := p.PublishMessage(m).Result(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	p.Close()
+	got, _ := Unwrap(c.Puts[0].Records[0].Data)
+	if got.ID != m.ID || got.PublisherID != DefaultPublisherID() {
+		t.Errorf("unexpected message %+v", *got)
+	}
+}
+
+func TestEnvelopeInsideAggregate(t *testing.T) {
+	data, _ := Wrap(&Message{ID: "inner", Data: []byte("payload")})
+	aggregated, _ := Aggregate([]*UserRecord{{PartitionKey: "a", Data: data}}, maxRecordSize)
+	seq := "1"
+	users := DeaggregateRecords([]*kinesis.Record{{Data: aggregated[0], SequenceNumber: &seq}})
+	got, err := Unwrap(users[0].Data)
+	if err != nil || got.ID != "inner" || string(got.Data) != "payload" {
+		t.Errorf("unexpected message %+v, %v", got, err)
+	}
+}
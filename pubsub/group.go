@@ -0,0 +1,223 @@
+package pubsub
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// GroupConfig configures a Group.
+type GroupConfig struct {
+	// Stream is the stream the group consumes.
+	Stream string
+	// WorkerID identifies this member of the group and must be unique in it. It defaults to DefaultPublisherID.
+	WorkerID string
+	// Leases holds the shard leases shared by the members of the group. Each group needs a store of its own.
+	Leases LeaseStore
+	// LeaseDuration is how long a member's shards go unread after it dies.
+	LeaseDuration time.Duration
+	// Start is where reading begins for the shards that have no checkpoint yet, other than those created by a
+	// reshard, which are read from their start unless Start is a time. It defaults to Latest and cannot be a
+	// position by sequence number.
+	Start StartPosition
+	// PollInterval is the time between two reads of the same shard.
+	PollInterval time.Duration
+	// Limit caps the number of records a single read returns; zero leaves it to Kinesis.
+	Limit int64
+	// Retry sets the backoff between failed reads. Its MaxAttempts is ignored.
+	Retry RetryPolicy
+	// Clock is the time source used for leases and shard iterators; nil uses the system clock.
+	Clock Clock
+}
+
+// Group is a member of a consumer group, the counterpart of a broadcast Subscription. The members of a group
+// split the shards of a stream between them through leases, so each message published by a Unicaster is
+// received by a single member. Members can join and leave at any time: the shards are shared out again, and a
+// shard left by a member is taken over after its checkpoint.
+//
+// Each shard is read in order and checkpointed once the messages of every read have been received, so a shard
+// that changes hands may deliver the messages received since its last checkpoint again. The shards created by
+// SplitShard or MergeShards are read from their start once the shards they came from have been read to their end.
+type Group struct {
+	c        kinesisSubscribe
+	config   GroupConfig
+	leases   *LeaseCoordinator
+	messages chan *Message
+	errors   chan error
+
+	// handle, when set, is given the messages of every shard instead of Messages, as Subscription.handle is.
+	handle func(m *Message, err error, closing <-chan struct{}) bool
+
+	mu     sync.Mutex
+	subs   map[string]*Subscription
+	closed bool
+
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closing   chan struct{}
+}
+
+// JoinGroup starts consuming config.Stream as a member of the group sharing config.Leases.
+func JoinGroup(c kinesisSubscribe, config GroupConfig) (*Group, error) {
+	return joinGroup(c, config, nil)
+}
+
+// joinGroup is JoinGroup handing messages to handle, when set, rather than to Messages.
+func joinGroup(c kinesisSubscribe, config GroupConfig, handle func(*Message, error, <-chan struct{}) bool) (*Group, error) {
+	if config.Leases == nil {
+		return nil, errors.New("group has no lease store")
+	}
+	if config.Start.bySequenceNumber() {
+		return nil, errors.New("group cannot start at a sequence number")
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = DefaultPollInterval
+	}
+	config.Retry = config.Retry.withDefaults()
+	g := &Group{
+		c:        c,
+		config:   config,
+		handle:   handle,
+		messages: make(chan *Message),
+		errors:   make(chan error, errorBufferSize),
+		subs:     make(map[string]*Subscription),
+		closing:  make(chan struct{}),
+	}
+	g.leases = newLeaseCoordinator(c, LeaseConfig{
+		Stream:    config.Stream,
+		WorkerID:  config.WorkerID,
+		Store:     config.Leases,
+		Duration:  config.LeaseDuration,
+		OnAcquire: g.acquire,
+		OnLose:    g.lose,
+		OnError:   g.report,
+		Clock:     config.Clock,
+	})
+	go g.leases.run()
+	return g, nil
+}
+
+// Shards returns the IDs of the shards this member holds, in order.
+func (g *Group) Shards() []string {
+	return g.leases.Held()
+}
+
+// Messages delivers the messages of the shards this member holds, each shard in order. It is closed when the
+// member leaves the group.
+func (g *Group) Messages() <-chan *Message {
+	return g.messages
+}
+
+// Errors reports read, checkpoint and lease failures. Errors that find the channel full are dropped. It is
+// closed when the member leaves the group.
+func (g *Group) Errors() <-chan error {
+	return g.errors
+}
+
+// Close leaves the group: it stops reading, then hands the shards back so that the other members take them
+// over at once.
+func (g *Group) Close() error {
+	var err error
+	g.closeOnce.Do(func() {
+		close(g.closing)
+		g.mu.Lock()
+		g.closed = true
+		subs := g.subs
+		g.subs = nil
+		g.mu.Unlock()
+		for _, s := range subs {
+			s.Close()
+		}
+		g.wg.Wait()
+		err = g.leases.Close()
+		close(g.messages)
+		close(g.errors)
+	})
+	return err
+}
+
+// acquire starts reading a shard whose lease was taken, after its checkpoint or, without one, from its start
+// if it came from other shards and at the configured start position otherwise. A start by time applies to every
+// shard, as it finds the start of a shard created after that time.
+func (g *Group) acquire(l Lease) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed || g.subs[l.ShardID] != nil {
+		return
+	}
+	r := &shardReader{
+		c:       g.c,
+		stream:  g.config.Stream,
+		shardID: l.ShardID,
+		limit:   g.config.Limit,
+		clock:   g.config.Clock,
+		start:   g.config.Start,
+	}
+	if len(l.ParentShardIDs) > 0 && r.start.timestamp.IsZero() {
+		r.start = TrimHorizon
+	}
+	r.resumeAfter(l.Checkpoint)
+	s := newSubscription(g.c, r, SubscribeOptions{
+		PollInterval: g.config.PollInterval,
+		Limit:        g.config.Limit,
+		Retry:        g.config.Retry,
+		Checkpoints:  g.leases,
+		Clock:        g.config.Clock,
+	}, false)
+	s.handle = g.handle
+	g.subs[l.ShardID] = s
+	g.wg.Add(1)
+	go s.run()
+	go g.forward(l.ShardID, s)
+}
+
+// lose stops reading a shard whose lease was taken by another member. The subscription may be the one finding
+// out, through a refused checkpoint, so it is closed without waiting.
+func (g *Group) lose(shardID string) {
+	g.mu.Lock()
+	s := g.subs[shardID]
+	delete(g.subs, shardID)
+	g.mu.Unlock()
+	if s != nil {
+		go s.Close()
+	}
+}
+
+// forward passes on the messages and errors of the subscription to a shard until it ends.
+func (g *Group) forward(shardID string, s *Subscription) {
+	defer g.wg.Done()
+	messages, errs := s.Messages(), s.Errors()
+	for messages != nil || errs != nil {
+		select {
+		case m, ok := <-messages:
+			if !ok {
+				messages = nil
+				continue
+			}
+			select {
+			case g.messages <- m:
+			case <-g.closing:
+				go s.Close()
+			}
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			g.report(err)
+		}
+	}
+	g.mu.Lock()
+	if g.subs[shardID] == s {
+		delete(g.subs, shardID)
+	}
+	g.mu.Unlock()
+}
+
+// report hands err to Errors unless it is full.
+func (g *Group) report(err error) {
+	select {
+	case g.errors <- err:
+	default:
+	}
+}
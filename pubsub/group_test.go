@@ -0,0 +1,184 @@
+package pubsub
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// groupInbox gathers the messages received by the members of a group, by the ID of the member.
+type groupInbox struct {
+	mu       sync.Mutex
+	received map[string][]string
+}
+
+func (in *groupInbox) collect(member string, g *Group) {
+	go func() {
+		for m := range g.Messages() {
+			in.mu.Lock()
+			in.received[member] = append(in.received[member], string(m.Data))
+			in.mu.Unlock()
+		}
+	}()
+}
+
+// all returns every message received by any member, sorted.
+func (in *groupInbox) all() []string {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	var all []string
+	for _, r := range in.received {
+		all = append(all, r...)
+	}
+	sort.Strings(all)
+	return all
+}
+
+func joinTestGroup(t *testing.T, c *kinesisRelayMock, store LeaseStore, member string) *Group {
+	g, err := JoinGroup(c, GroupConfig{
+		Stream:        "in",
+		WorkerID:      member,
+		Leases:        store,
+		LeaseDuration: 150 * time.Millisecond,
+		PollInterval:  time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return g
+}
+
+// waitForReads waits until every shard has been read since the call, so that readers started at LATEST are
+// positioned before records added afterwards.
+func waitForReads(t *testing.T, c *kinesisRelayMock, shards int) {
+	c.lock.Lock()
+	start := c.Reads
+	c.lock.Unlock()
+	waitFor(t, "the shards to be read", func() bool {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return c.Reads >= start+2*shards
+	})
+}
+
+func TestGroupSharesMessages(t *testing.T) {
+	c := relayMock("in 1", "in 2", "in 3", "in 4")
+	store := NewMemoryLeaseStore()
+	inbox := &groupInbox{received: make(map[string][]string)}
+	a := joinTestGroup(t, c, store, "a")
+	defer a.Close()
+	inbox.collect("a", a)
+	waitFor(t, "a to take every shard", func() bool { return len(a.Shards()) == 4 })
+	b := joinTestGroup(t, c, store, "b")
+	defer b.Close()
+	inbox.collect("b", b)
+	waitFor(t, "the shards to be shared", func() bool {
+		leases, _ := store.Leases()
+		owners := make(map[string]int)
+		for _, l := range leases {
+			owners[l.Owner]++
+		}
+		return owners["a"] == 2 && owners["b"] == 2 && len(a.Shards()) == 2 && len(b.Shards()) == 2
+	})
+	waitForReads(t, c, 4)
+
+	var want []string
+	for _, id := range []string{"in 1", "in 2", "in 3", "in 4"} {
+		for i := 0; i < 3; i++ {
+			data := fmt.Sprintf("%s/%d", id, i)
+			c.Add(id, data)
+			want = append(want, data)
+		}
+	}
+	waitFor(t, "every message to be received", func() bool { return len(inbox.all()) >= len(want) })
+	if got := inbox.all(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected every message to be received once, was %v", got)
+	}
+	inbox.mu.Lock()
+	if len(inbox.received["a"]) != 6 || len(inbox.received["b"]) != 6 {
+		t.Errorf("expected each member to receive the messages of its two shards, was %v", inbox.received)
+	}
+	inbox.mu.Unlock()
+}
+
+func TestGroupHandsOverShards(t *testing.T) {
+	c := relayMock("in 1", "in 2")
+	store := NewMemoryLeaseStore()
+	inbox := &groupInbox{received: make(map[string][]string)}
+	a := joinTestGroup(t, c, store, "a")
+	inbox.collect("a", a)
+	b := joinTestGroup(t, c, store, "b")
+	defer b.Close()
+	inbox.collect("b", b)
+	waitFor(t, "the shards to be shared", func() bool { return len(a.Shards()) == 1 && len(b.Shards()) == 1 })
+	waitForReads(t, c, 2)
+	c.Add("in 1", "before")
+	c.Add("in 2", "before")
+	waitFor(t, "the messages to be received", func() bool { return len(inbox.all()) == 2 })
+
+	if err := a.Close(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	waitFor(t, "b to take over", func() bool { return len(b.Shards()) == 2 })
+	c.Add("in 1", "after")
+	c.Add("in 2", "after")
+	waitFor(t, "the messages to be received", func() bool { return len(inbox.all()) == 4 })
+	if got := inbox.all(); fmt.Sprint(got) != "[after after before before]" {
+		t.Errorf("expected b to resume after the checkpoints of a, was %v", got)
+	}
+}
+
+func TestGroupFollowsLineage(t *testing.T) {
+	c := relayMock("in 1")
+	store := NewMemoryLeaseStore()
+	inbox := &groupInbox{received: make(map[string][]string)}
+	g := joinTestGroup(t, c, store, "a")
+	defer g.Close()
+	inbox.collect("a", g)
+	waitFor(t, "the shard to be taken", func() bool { return len(g.Shards()) == 1 })
+	waitForReads(t, c, 1)
+
+	c.Add("in 1", "parent")
+	c.Reshard("in 2", "in 1")
+	c.Add("in 2", "child")
+	waitFor(t, "the messages to be received", func() bool { return len(inbox.all()) == 2 })
+	inbox.mu.Lock()
+	if got := inbox.received["a"]; fmt.Sprint(got) != "[parent child]" {
+		t.Errorf("expected the parent to be read before the child, was %v", got)
+	}
+	inbox.mu.Unlock()
+	waitFor(t, "the parent lease to be given up", func() bool { return fmt.Sprint(g.Shards()) == "[in 2]" })
+	if seq, _ := g.leases.Checkpoint("in", "in 1"); seq != ShardEnd {
+		t.Errorf("expected the parent to be checkpointed at its end, was %q", seq)
+	}
+}
+
+func TestJoinGroupNeedsLeases(t *testing.T) {
+	if _, err := JoinGroup(relayMock("in 1"), GroupConfig{Stream: "in"}); err == nil {
+		t.Error("expected an error without a lease store, was nil")
+	}
+}
+
+func TestGroupStartPosition(t *testing.T) {
+	c := relayMock("in 1")
+	c.Add("in 1", "old")
+	g, err := JoinGroup(c, GroupConfig{Stream: "in", Leases: NewMemoryLeaseStore(), Start: TrimHorizon, PollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer g.Close()
+	select {
+	case m := <-g.Messages():
+		if string(m.Data) != "old" {
+			t.Errorf("expected the oldest message, was %q", m.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the oldest message")
+	}
+
+	if _, err := JoinGroup(c, GroupConfig{Stream: "in", Leases: NewMemoryLeaseStore(), Start: AtSequenceNumber("0")}); err == nil {
+		t.Error("expected an error starting a group at a sequence number, was nil")
+	}
+}
@@ -0,0 +1,181 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrLeaseConflict is returned by a LeaseStore when a lease was changed by another worker since it was read.
+var ErrLeaseConflict = errors.New("lease was changed by another worker")
+
+// Lease grants one worker the right to process a shard until it expires.
+type Lease struct {
+	ShardID string
+	// ParentShardIDs are the shards the shard was split or merged from. The lease is not taken before their
+	// leases are checkpointed at ShardEnd.
+	ParentShardIDs []string `json:",omitempty"`
+	// Owner is the ID of the worker holding the lease, or empty when it is free.
+	Owner string `json:",omitempty"`
+	// Expires is when the lease lapses unless its owner renews it.
+	Expires time.Time
+	// Counter is increased on every change to the lease, so that a change made on a stale copy is refused.
+	Counter int64
+	// Checkpoint is the sequence number of the last record processed from the shard.
+	Checkpoint string `json:",omitempty"`
+}
+
+// held reports whether the lease is owned and unexpired at now.
+func (l *Lease) held(now time.Time) bool {
+	return l.Owner != "" && now.Before(l.Expires)
+}
+
+// LeaseStore keeps the leases of the shards of one stream, shared by every worker consuming it.
+type LeaseStore interface {
+	// Leases returns every lease, ordered by shard ID.
+	Leases() ([]*Lease, error)
+	// CreateLease adds a lease with a counter of zero. It returns ErrLeaseConflict if the shard already has one.
+	CreateLease(l *Lease) error
+	// UpdateLease replaces the lease of l.ShardID with l, provided its counter is still l.Counter. On success the
+	// counter is increased, in the store and in l; otherwise ErrLeaseConflict is returned.
+	UpdateLease(l *Lease) error
+}
+
+// leaseTable is the set of leases of a stream, keyed by shard ID.
+type leaseTable map[string]*Lease
+
+func (t leaseTable) list() []*Lease {
+	leases := make([]*Lease, 0, len(t))
+	for _, l := range t {
+		c := *l
+		leases = append(leases, &c)
+	}
+	sort.Sort(byShardID(leases))
+	return leases
+}
+
+func (t leaseTable) create(l *Lease) error {
+	if _, ok := t[l.ShardID]; ok {
+		return ErrLeaseConflict
+	}
+	l.Counter = 0
+	c := *l
+	t[l.ShardID] = &c
+	return nil
+}
+
+func (t leaseTable) update(l *Lease) error {
+	cur, ok := t[l.ShardID]
+	if !ok || cur.Counter != l.Counter {
+		return ErrLeaseConflict
+	}
+	l.Counter++
+	c := *l
+	t[l.ShardID] = &c
+	return nil
+}
+
+type byShardID []*Lease
+
+func (s byShardID) Len() int           { return len(s) }
+func (s byShardID) Less(i, j int) bool { return s[i].ShardID < s[j].ShardID }
+func (s byShardID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// MemoryLeaseStore keeps leases for the workers of a single process.
+type MemoryLeaseStore struct {
+	mu     sync.Mutex
+	leases leaseTable
+}
+
+// NewMemoryLeaseStore returns an empty MemoryLeaseStore.
+func NewMemoryLeaseStore() *MemoryLeaseStore {
+	return &MemoryLeaseStore{leases: make(leaseTable)}
+}
+
+// Leases implements LeaseStore.
+func (s *MemoryLeaseStore) Leases() ([]*Lease, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leases.list(), nil
+}
+
+// CreateLease implements LeaseStore.
+func (s *MemoryLeaseStore) CreateLease(l *Lease) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leases.create(l)
+}
+
+// UpdateLease implements LeaseStore.
+func (s *MemoryLeaseStore) UpdateLease(l *Lease) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leases.update(l)
+}
+
+// FileLeaseStore keeps leases in a JSON file shared by the processes of one machine. Every operation holds an
+// exclusive lock on a companion ".lock" file while it reads the leases and, for changes, rewrites the file the
+// way FileCheckpointStore does.
+type FileLeaseStore struct {
+	path string
+}
+
+// NewFileLeaseStore returns a FileLeaseStore keeping its leases at path. A missing file holds no leases.
+func NewFileLeaseStore(path string) *FileLeaseStore {
+	return &FileLeaseStore{path: path}
+}
+
+// Leases implements LeaseStore.
+func (s *FileLeaseStore) Leases() ([]*Lease, error) {
+	var leases []*Lease
+	err := s.locked(func(t leaseTable) (bool, error) {
+		leases = t.list()
+		return false, nil
+	})
+	return leases, err
+}
+
+// CreateLease implements LeaseStore.
+func (s *FileLeaseStore) CreateLease(l *Lease) error {
+	return s.locked(func(t leaseTable) (bool, error) {
+		return true, t.create(l)
+	})
+}
+
+// UpdateLease implements LeaseStore.
+func (s *FileLeaseStore) UpdateLease(l *Lease) error {
+	return s.locked(func(t leaseTable) (bool, error) {
+		return true, t.update(l)
+	})
+}
+
+// locked calls f with the leases while holding the file lock, and saves them if f reports a change without error.
+func (s *FileLeaseStore) locked(f func(t leaseTable) (changed bool, err error)) error {
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	t := make(leaseTable)
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &t); err != nil {
+			return err
+		}
+	}
+	changed, err := f(t)
+	if err != nil || !changed {
+		return err
+	}
+	if b, err = json.Marshal(t); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, b)
+}
@@ -0,0 +1,137 @@
+package pubsub
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testLeaseStore(t *testing.T, name string, s LeaseStore) {
+	if leases, err := s.Leases(); len(leases) != 0 || err != nil {
+		t.Errorf("%s: expected no leases, was %v, %v", name, leases, err)
+	}
+	for _, id := range []string{"shard 2", "shard 1"} {
+		if err := s.CreateLease(&Lease{ShardID: id, Counter: 5}); err != nil {
+			t.Fatalf("%s: unexpected error %v", name, err)
+		}
+	}
+	if err := s.CreateLease(&Lease{ShardID: "shard 1", Owner: "other"}); err != ErrLeaseConflict {
+		t.Errorf("%s: expected ErrLeaseConflict creating an existing lease, was %v", name, err)
+	}
+
+	stale := &Lease{ShardID: "shard 1"}
+	l := &Lease{ShardID: "shard 1", Owner: "worker", Expires: time.Unix(100, 0).UTC(), Checkpoint: "7"}
+	if err := s.UpdateLease(l); err != nil {
+		t.Fatalf("%s: unexpected error %v", name, err)
+	}
+	if l.Counter != 1 {
+		t.Errorf("%s: expected the counter to be increased to 1, was %d", name, l.Counter)
+	}
+	if err := s.UpdateLease(stale); err != ErrLeaseConflict {
+		t.Errorf("%s: expected ErrLeaseConflict updating a stale lease, was %v", name, err)
+	}
+	if err := s.UpdateLease(&Lease{ShardID: "shard 3"}); err != ErrLeaseConflict {
+		t.Errorf("%s: expected ErrLeaseConflict updating a missing lease, was %v", name, err)
+	}
+
+	leases, err := s.Leases()
+	if err != nil {
+		t.Fatalf("%s: unexpected error %v", name, err)
+	}
+	if len(leases) != 2 || leases[0].ShardID != "shard 1" || leases[1].ShardID != "shard 2" {
+		t.Fatalf("%s: expected leases of shards 1 and 2 in order, was %v", name, leases)
+	}
+	if got := leases[0]; got.Owner != "worker" || !got.Expires.Equal(l.Expires) || got.Counter != 1 || got.Checkpoint != "7" {
+		t.Errorf("%s: expected the updated lease, was %+v", name, got)
+	}
+	if leases[1].Counter != 0 {
+		t.Errorf("%s: expected a new lease to have a counter of 0, was %d", name, leases[1].Counter)
+	}
+	leases[0].Owner = "changed"
+	if again, _ := s.Leases(); again[0].Owner != "worker" {
+		t.Errorf("%s: expected leases to be returned as copies", name)
+	}
+}
+
+func TestMemoryLeaseStore(t *testing.T) {
+	testLeaseStore(t, "memory", NewMemoryLeaseStore())
+}
+
+func TestFileLeaseStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "leases.json")
+	testLeaseStore(t, "file", NewFileLeaseStore(path))
+
+	leases, err := NewFileLeaseStore(path).Leases()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(leases) != 2 || leases[0].Owner != "worker" || leases[0].Checkpoint != "7" {
+		t.Errorf("expected the leases to be kept in the file, was %v", leases)
+	}
+}
+
+func TestFileLeaseStoreSharedUpdates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "leases.json")
+	if err := NewFileLeaseStore(path).CreateLease(&Lease{ShardID: "shard 1"}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// Each worker has its own store on the same file and increments the counter until it has won 20 updates.
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := NewFileLeaseStore(path)
+			for won := 0; won < 20; {
+				leases, err := s.Leases()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				switch err := s.UpdateLease(leases[0]); err {
+				case nil:
+					won++
+				case ErrLeaseConflict:
+				default:
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	leases, _ := NewFileLeaseStore(path).Leases()
+	if len(leases) != 1 || leases[0].Counter != 80 {
+		t.Errorf("expected every update to be counted once, was %v", leases)
+	}
+}
+
+func TestFileLeaseStoreErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	corrupt := filepath.Join(dir, "corrupt.json")
+	ioutil.WriteFile(corrupt, []byte("{"), 0644)
+	if _, err := NewFileLeaseStore(corrupt).Leases(); err == nil {
+		t.Error("expected an error reading a corrupt file, was nil")
+	}
+	if err := NewFileLeaseStore(filepath.Join(dir, "missing", "leases.json")).CreateLease(&Lease{ShardID: "shard 1"}); err == nil {
+		t.Error("expected an error locking in a missing directory, was nil")
+	}
+}
@@ -0,0 +1,172 @@
+package pubsub
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Per-shard write limits enforced by Kinesis.
+const (
+	ShardRecordsPerSecond = 1000
+	ShardBytesPerSecond   = 1 << 20
+)
+
+// ErrRateLimited is returned by a fail-fast ShardLimiter when a write would exceed a shard's rate.
+var ErrRateLimited = errors.New("shard write rate limit reached")
+
+// Clock tells the time and waits. It is an interface so that rate limiting can be tested without sleeping.
+type Clock interface {
+	Now() time.Time
+	Sleep(time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// LimitPolicy selects what a ShardLimiter does when a write would exceed a shard's rate.
+type LimitPolicy int
+
+const (
+	// Block waits until every shard written to has capacity again.
+	Block LimitPolicy = iota
+	// FailFast writes nothing and returns ErrRateLimited.
+	FailFast
+)
+
+// ShardWrite is one record about to be written to a shard.
+type ShardWrite struct {
+	ShardID string
+	Bytes   int
+}
+
+// ShardLimiter keeps a token bucket of records and one of bytes for every shard it has seen, so that publishers
+// sharing it stay under the per-shard write limits. Every broadcast costs one record on every shard, so the
+// limits are reached at a much lower message rate than on a partitioned stream.
+//
+// A ShardLimiter is safe for concurrent use. Its zero value blocks and uses the Kinesis limits.
+type ShardLimiter struct {
+	// RecordsPerSecond and BytesPerSecond are the refill rates and capacities of each shard's buckets.
+	// Zero selects ShardRecordsPerSecond and ShardBytesPerSecond.
+	RecordsPerSecond float64
+	BytesPerSecond   float64
+	// Policy selects whether Take blocks or fails when a shard is out of capacity.
+	Policy LimitPolicy
+	// Clock is the time source; nil uses the system clock.
+	Clock Clock
+
+	mu      sync.Mutex
+	buckets map[string]*shardBucket
+}
+
+// shardBucket holds the remaining capacity of one shard. Blocking writes may drive it negative, which reserves
+// capacity that has not been refilled yet.
+type shardBucket struct {
+	records, bytes float64
+	last           time.Time
+}
+
+// NewShardLimiter creates a ShardLimiter with the Kinesis per-shard limits and the given policy.
+func NewShardLimiter(policy LimitPolicy) *ShardLimiter {
+	return &ShardLimiter{Policy: policy}
+}
+
+// Take accounts for writes to shards of a stream. With the Block policy it reserves the capacity and waits until
+// it is available; with FailFast it takes nothing and returns ErrRateLimited unless every shard has capacity now.
+func (l *ShardLimiter) Take(stream string, writes []ShardWrite) error {
+	type need struct{ records, bytes float64 }
+	needs := make(map[string]*need)
+	for _, w := range writes {
+		n, ok := needs[w.ShardID]
+		if !ok {
+			n = &need{}
+			needs[w.ShardID] = n
+		}
+		n.records++
+		n.bytes += float64(w.Bytes)
+	}
+
+	clock := l.clock()
+	recordRate, byteRate := l.rates()
+	l.mu.Lock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*shardBucket)
+	}
+	now := clock.Now()
+	for id, n := range needs {
+		b := l.bucket(stream+"/"+id, now, recordRate, byteRate)
+		if l.Policy == FailFast && (b.records < n.records || b.bytes < n.bytes) {
+			l.mu.Unlock()
+			return ErrRateLimited
+		}
+	}
+	var wait time.Duration
+	for id, n := range needs {
+		b := l.buckets[stream+"/"+id]
+		b.records -= n.records
+		b.bytes -= n.bytes
+		if d := deficit(b.records, recordRate); d > wait {
+			wait = d
+		}
+		if d := deficit(b.bytes, byteRate); d > wait {
+			wait = d
+		}
+	}
+	l.mu.Unlock()
+
+	if wait > 0 {
+		clock.Sleep(wait)
+	}
+	return nil
+}
+
+// bucket returns the named bucket refilled up to now. l.mu must be held.
+func (l *ShardLimiter) bucket(key string, now time.Time, recordRate, byteRate float64) *shardBucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &shardBucket{records: recordRate, bytes: byteRate, last: now}
+		l.buckets[key] = b
+		return b
+	}
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.records = minFloat(recordRate, b.records+elapsed*recordRate)
+		b.bytes = minFloat(byteRate, b.bytes+elapsed*byteRate)
+		b.last = now
+	}
+	return b
+}
+
+func (l *ShardLimiter) rates() (float64, float64) {
+	records, bytes := l.RecordsPerSecond, l.BytesPerSecond
+	if records <= 0 {
+		records = ShardRecordsPerSecond
+	}
+	if bytes <= 0 {
+		bytes = ShardBytesPerSecond
+	}
+	return records, bytes
+}
+
+func (l *ShardLimiter) clock() Clock {
+	if l.Clock == nil {
+		return realClock{}
+	}
+	return l.Clock
+}
+
+// deficit is how long a bucket left at level takes to refill back to zero.
+func deficit(level, rate float64) time.Duration {
+	if level >= 0 {
+		return 0
+	}
+	return time.Duration(-level / rate * float64(time.Second))
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
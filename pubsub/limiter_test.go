@@ -0,0 +1,122 @@
+package pubsub
+
+import (
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only moves when it is slept on.
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	slept []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.slept = append(c.slept, d)
+	c.now = c.now.Add(d)
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func writes(bytes int, shardIDs ...string) []ShardWrite {
+	var w []ShardWrite
+	for _, id := range shardIDs {
+		w = append(w, ShardWrite{ShardID: id, Bytes: bytes})
+	}
+	return w
+}
+
+func TestShardLimiterFailFast(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	l := ShardLimiter{RecordsPerSecond: 2, Policy: FailFast, Clock: clock}
+	for i := 0; i < 2; i++ {
+		if err := l.Take("stream", writes(1, "a", "b")); err != nil {
+			t.Fatalf("take %d: unexpected error %v", i, err)
+		}
+	}
+	if err := l.Take("stream", writes(1, "a", "c")); err != ErrRateLimited {
+		t.Errorf("expected %v, was %v", ErrRateLimited, err)
+	}
+	// Nothing was taken from shard c by the refused write, and other streams have their own buckets.
+	if err := l.Take("stream", writes(1, "c", "c")); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err := l.Take("other stream", writes(1, "a")); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	clock.Advance(500 * time.Millisecond)
+	if err := l.Take("stream", writes(1, "a")); err != nil {
+		t.Errorf("unexpected error after refill %v", err)
+	}
+	if len(clock.slept) != 0 {
+		t.Errorf("expected fail-fast limiter not to sleep, slept %v", clock.slept)
+	}
+}
+
+func TestShardLimiterBlocks(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	l := ShardLimiter{RecordsPerSecond: 10, BytesPerSecond: 100, Clock: clock}
+	tests := []struct {
+		writes []ShardWrite
+		wait   time.Duration
+	}{
+		// A full bucket absorbs a burst of its capacity.
+		{writes(10, "a", "a", "a", "a", "a", "a", "a", "a", "a", "a"), 0},
+		// One more record waits for a tenth of a second of refill.
+		{writes(1, "a"), 100 * time.Millisecond},
+		// The byte bucket can be the tighter limit.
+		{writes(50, "b", "b", "b"), 500 * time.Millisecond},
+	}
+	for i, tt := range tests {
+		clock.slept = nil
+		if err := l.Take("stream", tt.writes); err != nil {
+			t.Fatalf("take %d: unexpected error %v", i, err)
+		}
+		var slept time.Duration
+		for _, d := range clock.slept {
+			slept += d
+		}
+		if slept != tt.wait {
+			t.Errorf("take %d: slept %v, want %v", i, slept, tt.wait)
+		}
+	}
+}
+
+func TestPutRecordWithOptionsRateLimited(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	var c kinesisPutRecordsMock
+	c.Shards = [][]*kinesis.Shard{{testShard("shard ID 1", "1"), testShard("shard ID 2", "2")}}
+	opts := Options{Limiter: &ShardLimiter{RecordsPerSecond: 1, Policy: FailFast, Clock: clock}}
+	stream := "stream name"
+	input := kinesis.PutRecordInput{Data: []byte("blob payload"), StreamName: &stream}
+	if _, err := PutRecordWithOptions(&c, &input, &opts); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	c.Index = 0
+	c.PutRecordsInput = nil
+	result, err := PutRecordWithOptions(&c, &input, &opts)
+	if err != ErrRateLimited {
+		t.Errorf("expected %v, was %v", ErrRateLimited, err)
+	}
+	if c.PutRecordsInput != nil {
+		t.Error("expected no PutRecords call once rate limited")
+	}
+	if len(result.Failed) != 2 {
+		t.Errorf("expected both shards to be reported as failed, was %v", result.Failed)
+	}
+}
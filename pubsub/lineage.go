@@ -0,0 +1,156 @@
+package pubsub
+
+import (
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+)
+
+// ShardEnd is the checkpoint of a shard that has been read to its end. A reader resuming from it moves straight on
+// to the shards the stream was resharded into.
+const ShardEnd = "SHARD_END"
+
+// parentIDs returns the IDs of the shards s was split or merged from.
+func parentIDs(s *kinesis.Shard) []string {
+	var ids []string
+	for _, id := range []*string{s.ParentShardID, s.AdjacentParentShardID} {
+		if id != nil {
+			ids = append(ids, *id)
+		}
+	}
+	return ids
+}
+
+// childShards returns the shards that were split or merged from the shard with the given ID.
+func childShards(shards []*kinesis.Shard, id string) []*kinesis.Shard {
+	var children []*kinesis.Shard
+	for _, s := range shards {
+		for _, p := range parentIDs(s) {
+			if p == id {
+				children = append(children, s)
+			}
+		}
+	}
+	return children
+}
+
+// Lineage states of a shard.
+const (
+	// shardWaiting shards wait for their parents to be read to their end.
+	shardWaiting = iota + 1
+	shardReading
+	// shardFinished shards have been read to their end.
+	shardFinished
+	// shardSkipped shards were closed before they were ever read, so they hold nothing newer to read.
+	shardSkipped
+)
+
+// shardStart is a shard that is ready to be read, after checkpoint if there is one and otherwise from its start
+// position.
+type shardStart struct {
+	shardID    string
+	start      StartPosition
+	checkpoint string
+}
+
+// shardLineage decides when each shard of a stream is read, so that a shard created by SplitShard or MergeShards
+// is only read once every shard it came from has been read to its end. Records of one hash key therefore come
+// out in the order they were written, even across a reshard.
+type shardLineage struct {
+	stream      string
+	checkpoints CheckpointStore
+	shards      map[string]*kinesis.Shard
+	states      map[string]int
+}
+
+func newShardLineage(stream string, checkpoints CheckpointStore) *shardLineage {
+	return &shardLineage{
+		stream:      stream,
+		checkpoints: checkpoints,
+		shards:      make(map[string]*kinesis.Shard),
+		states:      make(map[string]int),
+	}
+}
+
+// add takes in the shards not seen before and returns those that can be read now.
+func (l *shardLineage) add(shards []*kinesis.Shard) ([]shardStart, error) {
+	for _, s := range shards {
+		if _, ok := l.shards[*s.ShardID]; !ok {
+			l.shards[*s.ShardID] = s
+		}
+	}
+	return l.settle()
+}
+
+// finish records that a shard has been read to its end and returns the shards that can be read now.
+func (l *shardLineage) finish(shardID string) ([]shardStart, error) {
+	l.states[shardID] = shardFinished
+	return l.settle()
+}
+
+// settle decides the state of every shard that is new or waiting, parents first, and returns those that have
+// become ready to be read.
+func (l *shardLineage) settle() ([]shardStart, error) {
+	var starts []shardStart
+	for changed := true; changed; {
+		changed = false
+		for id, s := range l.shards {
+			state := l.states[id]
+			if state != 0 && state != shardWaiting {
+				continue
+			}
+			start, next, err := l.decide(s, state)
+			if err != nil {
+				return starts, err
+			}
+			if next == state {
+				continue
+			}
+			l.states[id] = next
+			changed = true
+			if next == shardReading {
+				starts = append(starts, start)
+			}
+		}
+	}
+	return starts, nil
+}
+
+// decide works out the state of a new or waiting shard. A shard whose parents are undecided stays as it is.
+func (l *shardLineage) decide(s *kinesis.Shard, state int) (shardStart, int, error) {
+	start := shardStart{shardID: *s.ShardID}
+	active, finished := false, false
+	for _, p := range parentIDs(s) {
+		if _, known := l.shards[p]; !known {
+			continue
+		}
+		switch l.states[p] {
+		case 0:
+			return start, state, nil
+		case shardWaiting, shardReading:
+			active = true
+		case shardFinished:
+			finished = true
+		}
+	}
+	if l.checkpoints != nil {
+		seq, err := l.checkpoints.Checkpoint(l.stream, *s.ShardID)
+		if err != nil {
+			return start, state, err
+		}
+		start.checkpoint = seq
+	}
+	switch {
+	case start.checkpoint == ShardEnd:
+		return start, shardFinished, nil
+	case start.checkpoint != "":
+		return start, shardReading, nil
+	case active:
+		return start, shardWaiting, nil
+	case finished:
+		start.start = TrimHorizon
+		return start, shardReading, nil
+	case s.SequenceNumberRange == nil || s.SequenceNumberRange.EndingSequenceNumber == nil:
+		start.start = Latest
+		return start, shardReading, nil
+	}
+	return start, shardSkipped, nil
+}
@@ -0,0 +1,233 @@
+package pubsub
+
+import (
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"github.com/brettcannon/kinesis-experiment/kinesisfake"
+	"sort"
+	"testing"
+	"time"
+)
+
+// lineageShard makes a shard with the given parents that is closed when closed is set.
+func lineageShard(id string, closed bool, parents ...string) *kinesis.Shard {
+	s := testShard(id, "0")
+	if closed {
+		start, end := "0", "9"
+		s.SequenceNumberRange = &kinesis.SequenceNumberRange{StartingSequenceNumber: &start, EndingSequenceNumber: &end}
+	}
+	if len(parents) > 0 {
+		s.ParentShardID = &parents[0]
+	}
+	if len(parents) > 1 {
+		s.AdjacentParentShardID = &parents[1]
+	}
+	return s
+}
+
+func formatStarts(starts []shardStart) string {
+	var out []string
+	for _, st := range starts {
+		if st.checkpoint != "" {
+			out = append(out, st.shardID+" after "+st.checkpoint)
+		} else {
+			out = append(out, st.shardID+" "+st.start.String())
+		}
+	}
+	sort.Strings(out)
+	return fmt.Sprint(out)
+}
+
+func TestShardLineage(t *testing.T) {
+	tests := []struct {
+		name        string
+		shards      []*kinesis.Shard
+		checkpoints map[string]string
+		want        string
+		finish      string
+		then        string
+	}{
+		{
+			name:   "split before the first start",
+			shards: []*kinesis.Shard{lineageShard("p", true), lineageShard("a", false, "p"), lineageShard("b", false, "p")},
+			want:   "[a LATEST b LATEST]",
+		},
+		{
+			name:        "split of a checkpointed shard",
+			shards:      []*kinesis.Shard{lineageShard("p", true), lineageShard("a", false, "p"), lineageShard("b", false, "p")},
+			checkpoints: map[string]string{"p": "5"},
+			want:        "[p after 5]",
+			finish:      "p",
+			then:        "[a TRIM_HORIZON b TRIM_HORIZON]",
+		},
+		{
+			name: "merge of a finished and a checkpointed shard",
+			shards: []*kinesis.Shard{
+				lineageShard("c", false, "p1", "p2"), lineageShard("p1", true), lineageShard("p2", true),
+			},
+			checkpoints: map[string]string{"p1": "3", "p2": ShardEnd},
+			want:        "[p1 after 3]",
+			finish:      "p1",
+			then:        "[c TRIM_HORIZON]",
+		},
+		{
+			name: "resume below finished ancestors",
+			shards: []*kinesis.Shard{
+				lineageShard("g", true), lineageShard("p", true, "g"), lineageShard("a", false, "p"), lineageShard("b", false, "p"),
+			},
+			checkpoints: map[string]string{"g": ShardEnd, "p": ShardEnd, "a": "7"},
+			want:        "[a after 7 b TRIM_HORIZON]",
+		},
+		{
+			name:   "parent outside the stream",
+			shards: []*kinesis.Shard{lineageShard("a", false, "trimmed")},
+			want:   "[a LATEST]",
+		},
+	}
+	for _, test := range tests {
+		checkpoints := NewMemoryCheckpointStore()
+		for id, seq := range test.checkpoints {
+			checkpoints.SetCheckpoint("stream", id, seq)
+		}
+		l := newShardLineage("stream", checkpoints)
+		starts, err := l.add(test.shards)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if got := formatStarts(starts); got != test.want {
+			t.Errorf("%s: expected %s, was %s", test.name, test.want, got)
+		}
+		if test.finish == "" {
+			continue
+		}
+		if starts, _ = l.finish(test.finish); formatStarts(starts) != test.then {
+			t.Errorf("%s: after finishing %s expected %s, was %s", test.name, test.finish, test.then, formatStarts(starts))
+		}
+	}
+}
+
+func TestSubscriptionFollowsReshards(t *testing.T) {
+	tests := []struct {
+		name    string
+		shards  []string
+		reshard func(c *kinesisRelayMock)
+		follow  []string
+	}{
+		{"split", []string{"p"}, func(c *kinesisRelayMock) {
+			c.Reshard("a", "p")
+			c.Reshard("b", "p")
+		}, []string{"a", "b"}},
+		{"merge", []string{"p", "q"}, func(c *kinesisRelayMock) { c.Reshard("c", "p", "q") }, []string{"c"}},
+	}
+	for _, test := range tests {
+		c := relayMock(test.shards...)
+		checkpoints := NewMemoryCheckpointStore()
+		s, err := Subscribe(c, "in", &SubscribeOptions{ShardID: "p", PollInterval: time.Millisecond, Checkpoints: checkpoints})
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", test.name, err)
+		}
+		waitFor(t, "the shard to be read", func() bool { return len(c.iterators()) == 1 })
+		c.Add("p", "before")
+		test.reshard(c)
+		for _, id := range test.follow {
+			c.Add(id, "after")
+		}
+		got := receive(t, s, 2)
+		s.Close()
+		if got[0].ShardID != "p" || string(got[0].Data) != "before" || string(got[1].Data) != "after" {
+			t.Errorf("%s: expected before then after, was %q on %s then %q on %s", test.name, got[0].Data, got[0].ShardID, got[1].Data, got[1].ShardID)
+		}
+		if seq, _ := checkpoints.Checkpoint("in", "p"); seq != ShardEnd {
+			t.Errorf("%s: expected the parent to be checkpointed at its end, was %q", test.name, seq)
+		}
+		its := c.iterators()
+		if last := its[len(its)-1]; *last.ShardIteratorType != "TRIM_HORIZON" || *last.ShardID != got[1].ShardID {
+			t.Errorf("%s: expected to read the child from its start, was %s from %s", test.name, *last.ShardID, *last.ShardIteratorType)
+		}
+	}
+}
+
+// TestSubscriptionFollowsSplitOnFake publishes and subscribes through the in-memory Kinesis, across a split of the
+// shard being read.
+func TestSubscriptionFollowsSplitOnFake(t *testing.T) {
+	c := kinesisfake.New()
+	if _, err := c.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String("in"), ShardCount: aws.Long(2)}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	publish := func(data string) {
+		if _, err := PutRecord(c, &kinesis.PutRecordInput{StreamName: aws.String("in"), Data: []byte(data)}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	s, err := Subscribe(c, "in", &SubscribeOptions{ShardID: "shardId-000000000000", Start: TrimHorizon, PollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer s.Close()
+	publish("before")
+	split := &kinesis.SplitShardInput{StreamName: aws.String("in"), ShardToSplit: aws.String("shardId-000000000000"), NewStartingHashKey: aws.String("1000")}
+	if _, err := c.SplitShard(split); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	publish("after")
+
+	got := receive(t, s, 2)
+	if string(got[0].Data) != "before" || got[0].ShardID != "shardId-000000000000" {
+		t.Errorf("expected before on the parent, was %q on %s", got[0].Data, got[0].ShardID)
+	}
+	if string(got[1].Data) != "after" || got[1].ShardID == "shardId-000000000000" || got[1].ShardID == "shardId-000000000001" {
+		t.Errorf("expected after on a child, was %q on %s", got[1].Data, got[1].ShardID)
+	}
+}
+
+func TestBroadcasterFollowsReshards(t *testing.T) {
+	c := relayMock("p", "q")
+	checkpoints := NewMemoryCheckpointStore()
+	config := BroadcastConfig{In: "in", Out: "out", PollInterval: time.Millisecond, Checkpoints: checkpoints}
+	b, err := NewBroadcaster(c, config)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	waitFor(t, "both shards to be read", func() bool { return len(c.iterators()) == 2 })
+	c.Add("p", "p1")
+	c.Add("q", "q1")
+	c.Add("p", "p2")
+	c.Reshard("a", "p")
+	c.Reshard("b", "p")
+	c.Add("a", "a1")
+	c.Add("b", "b1")
+	waitFor(t, "the split to be relayed", func() bool { return len(c.accepted("shard ID 1")) == 5 })
+	c.Reshard("m", "a", "q")
+	c.Add("m", "m1")
+	waitFor(t, "the merge to be relayed", func() bool { return len(c.accepted("shard ID 1")) == 6 })
+	b.Close()
+
+	got := c.accepted("shard ID 1")
+	index := make(map[string]int)
+	for i, data := range got {
+		index[data] = i
+	}
+	for _, order := range [][2]string{{"p1", "p2"}, {"p2", "a1"}, {"p2", "b1"}, {"a1", "m1"}, {"q1", "m1"}} {
+		if index[order[0]] > index[order[1]] {
+			t.Errorf("expected %s before %s, was %v", order[0], order[1], got)
+		}
+	}
+	for _, id := range []string{"p", "a", "q"} {
+		if seq, _ := checkpoints.Checkpoint("in", id); seq != ShardEnd {
+			t.Errorf("expected %s to be checkpointed at its end, was %q", id, seq)
+		}
+	}
+
+	// A relay started again only reads the shards that are still open, from where it left off.
+	c.Add("m", "m2")
+	if b, err = NewBroadcaster(c, config); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	waitFor(t, "the restart", func() bool { return len(c.accepted("shard ID 1")) == 7 })
+	b.Close()
+	if got := c.accepted("shard ID 1"); got[6] != "m2" {
+		t.Errorf("expected m2 to be relayed once after the restart, was %v", got)
+	}
+}
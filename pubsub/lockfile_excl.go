@@ -0,0 +1,26 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package pubsub
+
+import (
+	"os"
+	"time"
+)
+
+// lockFile takes an exclusive lock by creating the file at path, waiting while another process holds it, and
+// returns the function that releases it by removing the file. It serves the systems without syscall.Flock; unlike
+// a flock, a lock left behind by a process that died must be removed by hand.
+func lockFile(path string) (func(), error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,86 @@
+package pubsub
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"unicode/utf8"
+)
+
+// MaxPartitionKeyLength is the longest partition key, in Unicode characters, that Kinesis accepts.
+const MaxPartitionKeyLength = 256
+
+// maxKeyedIDLength is the longest message ID used in partition keys as it is, which leaves room for the shard
+// index MessageIDPartitionKeys appends. Longer IDs are hashed.
+const maxKeyedIDLength = MaxPartitionKeyLength - 16
+
+var (
+	// ErrInvalidPartitionKey is returned when a strategy produces an empty partition key or one longer than
+	// MaxPartitionKeyLength.
+	ErrInvalidPartitionKey = errors.New("partition key must be between 1 and 256 characters")
+	// ErrMissingPartitionKey is returned by CallerPartitionKeys for a record without a partition key.
+	ErrMissingPartitionKey = errors.New("record has no partition key")
+)
+
+// PartitionKeyStrategy picks the partition keys of the entries a record is fanned out to. Kinesis requires a
+// partition key on every entry even though the explicit hash key decides the shard. The strategy is called once
+// per record and returns the key of the entry sent to the shard at each index of the fan-out.
+type PartitionKeyStrategy func(input *kinesis.PutRecordInput) (key func(shard int) string, err error)
+
+// MessageIDPartitionKeys derives every key from the message ID and the shard index, so the same message always
+// gets the same keys. The ID of an enveloped message is used as is unless it is too long to fit in a key, when its
+// SHA-256 digest is used instead; a raw record is identified by the MD5 digest of its data.
+func MessageIDPartitionKeys(input *kinesis.PutRecordInput) (func(int) string, error) {
+	id := messageID(input.Data)
+	return func(shard int) string {
+		return fmt.Sprintf("%s-%d", id, shard)
+	}, nil
+}
+
+// messageID identifies the message in data by its envelope ID or, for a raw record, the MD5 digest of its data.
+// An ID longer than maxKeyedIDLength characters is replaced by its digest, so that it always fits in a partition
+// key.
+func messageID(data []byte) string {
+	if m, err := Unwrap(data); err == nil && m.Enveloped && m.ID != "" {
+		if utf8.RuneCountInString(m.ID) > maxKeyedIDLength {
+			return contentID([]byte(m.ID))
+		}
+		return m.ID
+	}
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// CallerPartitionKeys uses the PartitionKey of the record for every entry.
+func CallerPartitionKeys(input *kinesis.PutRecordInput) (func(int) string, error) {
+	if input.PartitionKey == nil {
+		return nil, ErrMissingPartitionKey
+	}
+	key := *input.PartitionKey
+	return func(int) string {
+		return key
+	}, nil
+}
+
+// RandomPartitionKeys gives every entry a fresh random key.
+func RandomPartitionKeys(input *kinesis.PutRecordInput) (func(int) string, error) {
+	return func(int) string {
+		return NewMessageID()
+	}, nil
+}
+
+// defaultPartitionKeys uses the caller's key when the record has one and falls back on MessageIDPartitionKeys.
+func defaultPartitionKeys(input *kinesis.PutRecordInput) (func(int) string, error) {
+	if input.PartitionKey != nil {
+		return CallerPartitionKeys(input)
+	}
+	return MessageIDPartitionKeys(input)
+}
+
+// validPartitionKey reports whether Kinesis accepts key.
+func validPartitionKey(key string) bool {
+	n := utf8.RuneCountInString(key)
+	return n > 0 && n <= MaxPartitionKeyLength
+}
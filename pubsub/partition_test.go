@@ -0,0 +1,125 @@
+package pubsub
+
+import (
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"strings"
+	"testing"
+)
+
+func validate(params interface{}) error {
+	r := &aws.Request{Params: params}
+	aws.ValidateParameters(r)
+	return r.Error
+}
+
+func TestFanOutPassesParameterValidation(t *testing.T) {
+	s := "stream name"
+	pk := "caller key"
+	envelope, _ := Wrap(&Message{ID: "message", Data: []byte("payload")})
+	tests := []struct {
+		name     string
+		input    kinesis.PutRecordInput
+		strategy PartitionKeyStrategy
+		want     []string
+	}{
+		{"default raw", kinesis.PutRecordInput{Data: []byte("payload"), StreamName: &s}, nil,
+			[]string{"321c3cf486ed509164edec1e1981fec8-0", "321c3cf486ed509164edec1e1981fec8-1"}},
+		{"default envelope", kinesis.PutRecordInput{Data: envelope, StreamName: &s}, nil,
+			[]string{"message-0", "message-1"}},
+		{"default caller", kinesis.PutRecordInput{Data: envelope, StreamName: &s, PartitionKey: &pk}, nil,
+			[]string{pk, pk}},
+		{"message ID", kinesis.PutRecordInput{Data: envelope, StreamName: &s, PartitionKey: &pk}, MessageIDPartitionKeys,
+			[]string{"message-0", "message-1"}},
+		{"caller", kinesis.PutRecordInput{Data: envelope, StreamName: &s, PartitionKey: &pk}, CallerPartitionKeys,
+			[]string{pk, pk}},
+		{"random", kinesis.PutRecordInput{Data: envelope, StreamName: &s}, RandomPartitionKeys, nil},
+	}
+	k1, k2 := "0", "100"
+	for _, test := range tests {
+		fan, err := fanOutPutRecordInput(&test.input, []*string{&k1, &k2}, test.strategy)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if err := validate(fan); err != nil {
+			t.Errorf("%s: unexpected validation error %v", test.name, err)
+		}
+		for i, e := range fan.Records {
+			if test.want != nil && *e.PartitionKey != test.want[i] {
+				t.Errorf("%s: entry %d: expected partition key %s, was %s", test.name, i, test.want[i], *e.PartitionKey)
+			}
+		}
+	}
+}
+
+func TestValidationRejectsEntryWithoutPartitionKey(t *testing.T) {
+	s := "stream name"
+	k := "0"
+	input := &kinesis.PutRecordsInput{
+		Records:    []*kinesis.PutRecordsRequestEntry{{Data: []byte("payload"), ExplicitHashKey: &k}},
+		StreamName: &s,
+	}
+	if err := validate(input); err == nil {
+		t.Error("expected a validation error, was nil")
+	}
+}
+
+func TestPartitionKeyLength(t *testing.T) {
+	s := "stream name"
+	k := "0"
+	tests := []struct {
+		key  string
+		want error
+	}{
+		{strings.Repeat("a", MaxPartitionKeyLength), nil},
+		{strings.Repeat("é", MaxPartitionKeyLength), nil},
+		{strings.Repeat("a", MaxPartitionKeyLength+1), ErrInvalidPartitionKey},
+		{"", ErrInvalidPartitionKey},
+	}
+	for _, test := range tests {
+		key := test.key
+		input := &kinesis.PutRecordInput{Data: []byte("payload"), StreamName: &s, PartitionKey: &key}
+		if _, err := fanOutPutRecordInput(input, []*string{&k}, CallerPartitionKeys); err != test.want {
+			t.Errorf("%d characters: expected %v, was %v", len([]rune(key)), test.want, err)
+		}
+	}
+	// A message ID too long to fit in a key is hashed.
+	for _, n := range []int{maxKeyedIDLength + 1, 255, 1000} {
+		long := &Message{ID: strings.Repeat("m", n), Data: []byte("payload")}
+		data, _ := Wrap(long)
+		out, err := fanOutPutRecordInput(&kinesis.PutRecordInput{Data: data, StreamName: &s}, []*string{&k}, nil)
+		if err != nil {
+			t.Fatalf("%d character ID: unexpected error %v", n, err)
+		}
+		if key, want := *out.Records[0].PartitionKey, contentID([]byte(long.ID))+"-0"; key != want {
+			t.Errorf("%d character ID: expected key %s, was %s", n, want, key)
+		}
+	}
+}
+
+func TestCallerPartitionKeysMissing(t *testing.T) {
+	s := "stream name"
+	k := "0"
+	input := &kinesis.PutRecordInput{Data: []byte("payload"), StreamName: &s}
+	if _, err := fanOutPutRecordInput(input, []*string{&k}, CallerPartitionKeys); err != ErrMissingPartitionKey {
+		t.Errorf("expected %v, was %v", ErrMissingPartitionKey, err)
+	}
+}
+
+func TestResendKeepsPartitionKeys(t *testing.T) {
+	c := &kinesisTopologyMock{
+		Shards: []*kinesis.Shard{testShard("shardId-0", "0"), testShard("shardId-1", "100")},
+		Routes: map[string]string{"0": "shardId-0", "100": "shardId-1"},
+	}
+	s := "stream name"
+	input := &kinesis.PutRecordInput{Data: []byte("payload"), StreamName: &s}
+	skip := []map[string]bool{{"shardId-0": true}}
+	if _, err := putRecordsToShards(c, []*kinesis.PutRecordInput{input}, c.Shards, skip, &Options{}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	records := c.Puts[0].Records
+	if len(records) != 1 || *records[0].PartitionKey != "321c3cf486ed509164edec1e1981fec8-1" {
+		t.Errorf("expected only the second shard's entry, was %v", records)
+	}
+}
@@ -0,0 +1,266 @@
+package pubsub
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Defaults for the zero fields of a PublisherConfig.
+const (
+	DefaultBatchSize     = 100
+	DefaultBatchInterval = 50 * time.Millisecond
+	DefaultQueueSize     = 10000
+)
+
+var (
+	// ErrPublisherFull is the result of a Publish call made while the publisher's queue is full.
+	ErrPublisherFull = errors.New("publisher queue is full")
+	// ErrPublisherClosed is the result of a Publish call made after Close.
+	ErrPublisherClosed = errors.New("publisher is closed")
+)
+
+// PublisherConfig configures a Publisher.
+type PublisherConfig struct {
+	// Stream is the stream every message is broadcast to.
+	Stream string
+	// Options tunes each fan-out. It is shared by every batch, so a ShardCache or ShardLimiter in it is too.
+	Options *Options
+	// BatchSize is the number of queued messages that triggers a send.
+	BatchSize int
+	// BatchInterval is the longest a queued message waits for its batch to fill up.
+	BatchInterval time.Duration
+	// QueueSize is the number of messages that can wait to be batched before Publish reports ErrPublisherFull.
+	QueueSize int
+	// OnResult, when set, is called with the outcome of every message, in publish order.
+	OnResult func(data []byte, result *PutRecordResult, err error)
+}
+
+// Future is the eventual outcome of publishing one message.
+type Future struct {
+	done   chan struct{}
+	result *PutRecordResult
+	err    error
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+func (f *Future) resolve(result *PutRecordResult, err error) {
+	f.result, f.err = result, err
+	close(f.done)
+}
+
+// Done is closed once the message has been acknowledged or has failed.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Result waits for the message to be acknowledged and returns the outcome of its fan-out.
+func (f *Future) Result() (*PutRecordResult, error) {
+	<-f.done
+	return f.result, f.err
+}
+
+// publishRequest is a message waiting to be sent.
+type publishRequest struct {
+	data   []byte
+	future *Future
+}
+
+// publishBatch is a group of messages sent together. A batch with an ack channel marks a Flush; the channel is
+// closed once every batch ahead of it has been acknowledged.
+type publishBatch struct {
+	requests []*publishRequest
+	ack      chan struct{}
+}
+
+// Publisher broadcasts messages to every shard of a stream in the background. Messages are queued by Publish or
+// the Input channel, gathered into batches that are sent with PutMessages when BatchSize messages are waiting or
+// BatchInterval has passed, and acknowledged through a Future or the OnResult callback. Batches are sent one at
+// a time, so messages reach each shard in the order they were published, though retries may repeat some.
+type Publisher struct {
+	c      kinesisPubSub
+	config PublisherConfig
+
+	mu     sync.RWMutex
+	closed bool
+
+	queue   chan *publishRequest
+	input   chan []byte
+	flushes chan chan struct{}
+	closing chan struct{}
+	batches chan publishBatch
+	done    chan struct{}
+}
+
+// NewPublisher starts a Publisher that sends through c. Close it to release its goroutines.
+func NewPublisher(c kinesisPubSub, config PublisherConfig) *Publisher {
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultBatchSize
+	}
+	if config.BatchInterval <= 0 {
+		config.BatchInterval = DefaultBatchInterval
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultQueueSize
+	}
+	p := &Publisher{
+		c:       c,
+		config:  config,
+		queue:   make(chan *publishRequest, config.QueueSize),
+		input:   make(chan []byte),
+		flushes: make(chan chan struct{}),
+		closing: make(chan struct{}),
+		batches: make(chan publishBatch, 1),
+		done:    make(chan struct{}),
+	}
+	go p.batch()
+	go p.send()
+	return p
+}
+
+// Publish queues data for broadcast without blocking. The returned Future fails with ErrPublisherFull or
+// ErrPublisherClosed if the message could not be queued.
+func (p *Publisher) Publish(data []byte) *Future {
+	f := newFuture()
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		f.resolve(nil, ErrPublisherClosed)
+		return f
+	}
+	select {
+	case p.queue <- &publishRequest{data, f}:
+	default:
+		f.resolve(nil, ErrPublisherFull)
+	}
+	return f
+}
+
+// PublishMessage wraps m in an envelope and queues it like Publish. The ID and timestamp given to the message
+// are left on m.
+func (p *Publisher) PublishMessage(m *Message) *Future {
+	data, err := p.config.Options.wrap(m)
+	if err != nil {
+		f := newFuture()
+		f.resolve(nil, err)
+		return f
+	}
+	return p.Publish(data)
+}
+
+// Input returns a channel that messages can be sent on instead of calling Publish. Their outcomes are only
+// reported to OnResult. Stop sending on it before calling Close.
+func (p *Publisher) Input() chan<- []byte {
+	return p.input
+}
+
+// Flush sends whatever is waiting to be batched and waits until every message queued before the call has been
+// acknowledged.
+func (p *Publisher) Flush() {
+	ack := make(chan struct{})
+	select {
+	case p.flushes <- ack:
+		<-ack
+	case <-p.done:
+	}
+}
+
+// Close stops accepting messages, sends everything already queued and waits for it to be acknowledged.
+func (p *Publisher) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		<-p.done
+		return nil
+	}
+	p.closed = true
+	p.mu.Unlock()
+	close(p.closing)
+	<-p.done
+	return nil
+}
+
+// batch gathers queued messages into batches and hands them to send.
+func (p *Publisher) batch() {
+	var requests []*publishRequest
+	timer := time.NewTimer(p.config.BatchInterval)
+	timer.Stop()
+	cut := func(ack chan struct{}) {
+		timer.Stop()
+		if len(requests) > 0 || ack != nil {
+			p.batches <- publishBatch{requests, ack}
+		}
+		requests = nil
+	}
+	add := func(r *publishRequest) {
+		if len(requests) == 0 {
+			timer.Reset(p.config.BatchInterval)
+		}
+		requests = append(requests, r)
+		if len(requests) >= p.config.BatchSize {
+			cut(nil)
+		}
+	}
+
+	for {
+		select {
+		case r := <-p.queue:
+			add(r)
+		case data := <-p.input:
+			add(&publishRequest{data: data})
+		case <-timer.C:
+			cut(nil)
+		case ack := <-p.flushes:
+			p.drain(add)
+			cut(ack)
+		case <-p.closing:
+			p.drain(add)
+			cut(nil)
+			close(p.batches)
+			return
+		}
+	}
+}
+
+// drain adds every message that is already queued.
+func (p *Publisher) drain(add func(*publishRequest)) {
+	for {
+		select {
+		case r := <-p.queue:
+			add(r)
+		default:
+			return
+		}
+	}
+}
+
+// send broadcasts batches one at a time and acknowledges their messages.
+func (p *Publisher) send() {
+	defer close(p.done)
+	for b := range p.batches {
+		messages := make([][]byte, len(b.requests))
+		for i, r := range b.requests {
+			messages[i] = r.data
+		}
+		results, err := PutMessages(p.c, p.config.Stream, messages, p.config.Options)
+		for i, r := range b.requests {
+			var result *PutRecordResult
+			if results != nil {
+				result = results[i]
+			}
+			rerr := MessageErr(result, err)
+			if r.future != nil {
+				r.future.resolve(result, rerr)
+			}
+			if p.config.OnResult != nil {
+				p.config.OnResult(r.data, result, rerr)
+			}
+		}
+		if b.ack != nil {
+			close(b.ack)
+		}
+	}
+}
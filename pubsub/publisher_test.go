@@ -0,0 +1,171 @@
+package pubsub
+
+import (
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"github.com/brettcannon/kinesis-experiment/kinesisfake"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func publisherMock() *kinesisTopologyMock {
+	return &kinesisTopologyMock{
+		Shards: []*kinesis.Shard{testShard("shard ID 1", "1"), testShard("shard ID 2", "2")},
+		Routes: map[string]string{"1": "shard ID 1", "2": "shard ID 2"},
+	}
+}
+
+func resolved(f *Future) bool {
+	select {
+	case <-f.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+func TestPublisherSizeTrigger(t *testing.T) {
+	c := publisherMock()
+	p := NewPublisher(c, PublisherConfig{Stream: "stream name", BatchSize: 2, BatchInterval: time.Hour})
+	defer p.Close()
+	f1 := p.Publish([]byte("message 1"))
+	f2 := p.Publish([]byte("message 2"))
+	for _, f := range []*Future{f1, f2} {
+		result, err := f.Result()
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if len(result.Delivered) != 2 {
+			t.Errorf("expected delivery to 2 shards, was %d", len(result.Delivered))
+		}
+	}
+}
+
+func TestPublisherTimeTrigger(t *testing.T) {
+	c := publisherMock()
+	p := NewPublisher(c, PublisherConfig{Stream: "stream name", BatchSize: 100, BatchInterval: 5 * time.Millisecond})
+	defer p.Close()
+	select {
+	case <-p.Publish([]byte("message")).Done():
+	case <-time.After(time.Second):
+		t.Error("expected the batch interval to send the message")
+	}
+}
+
+func TestPublisherFlush(t *testing.T) {
+	c := publisherMock()
+	p := NewPublisher(c, PublisherConfig{Stream: "stream name", BatchInterval: time.Hour})
+	defer p.Close()
+	var futures []*Future
+	for i := 0; i < 3; i++ {
+		futures = append(futures, p.Publish([]byte("message")))
+	}
+	p.Flush()
+	for i, f := range futures {
+		if !resolved(f) {
+			t.Errorf("future %d unresolved after Flush", i)
+		}
+	}
+	// Flushing with nothing queued returns too.
+	p.Flush()
+}
+
+func TestPublisherClose(t *testing.T) {
+	c := publisherMock()
+	p := NewPublisher(c, PublisherConfig{Stream: "stream name", BatchInterval: time.Hour})
+	f := p.Publish([]byte("message"))
+	if err := p.Close(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !resolved(f) {
+		t.Error("future unresolved after Close")
+	}
+	if _, err := p.Publish([]byte("late message")).Result(); err != ErrPublisherClosed {
+		t.Errorf("expected %v, was %v", ErrPublisherClosed, err)
+	}
+	if err := p.Close(); err != nil {
+		t.Errorf("unexpected error closing twice %v", err)
+	}
+	p.Flush()
+}
+
+func TestPublisherInputAndCallback(t *testing.T) {
+	c := publisherMock()
+	var mu sync.Mutex
+	var got []string
+	p := NewPublisher(c, PublisherConfig{
+		Stream:        "stream name",
+		BatchSize:     2,
+		BatchInterval: time.Hour,
+		OnResult: func(data []byte, result *PutRecordResult, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+			got = append(got, string(data))
+		},
+	})
+	want := []string{"a", "b", "c", "d", "e"}
+	for _, m := range want {
+		p.Input() <- []byte(m)
+	}
+	p.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, was %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("result %d was for %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestPublisherFull(t *testing.T) {
+	p := &Publisher{queue: make(chan *publishRequest, 1)}
+	if resolved(p.Publish([]byte("message 1"))) {
+		t.Error("expected the first message to be queued")
+	}
+	if _, err := p.Publish([]byte("message 2")).Result(); err != ErrPublisherFull {
+		t.Errorf("expected %v, was %v", ErrPublisherFull, err)
+	}
+}
+
+// TestPublishSubscribeOverLocalServer runs the publish and subscribe path through the SDK client, talking to the
+// local Kinesis server over HTTP.
+func TestPublishSubscribeOverLocalServer(t *testing.T) {
+	server := httptest.NewServer(kinesisfake.NewHandler(kinesisfake.New()))
+	defer server.Close()
+	c := kinesisfake.NewClient(server.URL)
+	if _, err := c.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String("stream"), ShardCount: aws.Long(2)}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	s, err := Subscribe(c, "stream", &SubscribeOptions{Start: TrimHorizon, PollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer s.Close()
+	p := NewPublisher(c, PublisherConfig{Stream: "stream", BatchInterval: time.Millisecond})
+	defer p.Close()
+	var ids []string
+	for _, data := range []string{"first", "second"} {
+		m := &Message{Data: []byte(data), Headers: map[string]string{"h": data}}
+		result, err := p.PublishMessage(m).Result()
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if len(result.Delivered) != 2 {
+			t.Errorf("expected delivery to 2 shards, was %d", len(result.Delivered))
+		}
+		ids = append(ids, m.ID)
+	}
+	for i, m := range receive(t, s, 2) {
+		if m.ID != ids[i] || m.Headers["h"] != string(m.Data) || m.ShardID != s.ShardID() {
+			t.Errorf("message %d: expected %s, was %s %q with headers %v on %s", i, ids[i], m.ID, m.Data, m.Headers, m.ShardID)
+		}
+	}
+}
@@ -2,7 +2,10 @@ package pubsub
 
 import (
 	"errors"
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/aws"
 	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"math/big"
 )
 
 type kinesisDescribeStream interface {
@@ -25,76 +28,310 @@ func gatherShards(c kinesisDescribeStream, streamName *string) ([]*kinesis.Shard
 			return nil, err
 		}
 		s = append(s, d.StreamDescription.Shards...)
-		r.ExclusiveStartShardID = s[len(s)-1].ShardID
+		if len(s) > 0 {
+			r.ExclusiveStartShardID = s[len(s)-1].ShardID
+		}
 		more = *d.StreamDescription.HasMoreShards
 	}
 	return s, nil
 }
 
-// explicitHashKeys collects explicit hash keys for all provided shards.
-func explicitHashKeys(shards []*kinesis.Shard) []*string {
-	var k []*string
+// openShards filters out the shards that no longer accept writes. A shard closed by SplitShard or MergeShards
+// has an ending sequence number; its hash key range now belongs to its child shards.
+func openShards(shards []*kinesis.Shard) []*kinesis.Shard {
+	var open []*kinesis.Shard
 	for _, s := range shards {
-		// Shard.HashKeyRange.StaringHashKey and all intermediate values are required, so no need to check for existence.
-		k = append(k, s.HashKeyRange.StartingHashKey)
+		if s.SequenceNumberRange == nil || s.SequenceNumberRange.EndingSequenceNumber == nil {
+			open = append(open, s)
+		}
 	}
-	return k
+	return open
+}
+
+// hashKeyRange is a parsed kinesis.HashKeyRange.
+type hashKeyRange struct {
+	start, end *big.Int
+}
+
+func (r hashKeyRange) contains(k *big.Int) bool {
+	return r.start.Cmp(k) <= 0 && k.Cmp(r.end) <= 0
+}
+
+// parseHashKeyRange parses the decimal hash keys bounding a shard.
+func parseHashKeyRange(s *kinesis.Shard) (hashKeyRange, error) {
+	// Shard.HashKeyRange and both of its keys are required, so no need to check for existence.
+	start, ok := new(big.Int).SetString(*s.HashKeyRange.StartingHashKey, 10)
+	if !ok {
+		return hashKeyRange{}, fmt.Errorf("shard %s has invalid starting hash key %q", *s.ShardID, *s.HashKeyRange.StartingHashKey)
+	}
+	end, ok := new(big.Int).SetString(*s.HashKeyRange.EndingHashKey, 10)
+	if !ok {
+		return hashKeyRange{}, fmt.Errorf("shard %s has invalid ending hash key %q", *s.ShardID, *s.HashKeyRange.EndingHashKey)
+	}
+	return hashKeyRange{start, end}, nil
+}
+
+// explicitHashKeys picks one explicit hash key for each of the provided open shards and maps every key back to
+// the shard it routes to. The key is the lowest one in the shard's range that no other shard's range covers, so
+// it reaches that shard even when the ranges overlap. Shards whose range is covered entirely by others cannot be
+// addressed and get no key; gaps between ranges need no special handling.
+func explicitHashKeys(shards []*kinesis.Shard) ([]*string, map[string]string, error) {
+	ranges := make([]hashKeyRange, len(shards))
+	for i, s := range shards {
+		r, err := parseHashKeyRange(s)
+		if err != nil {
+			return nil, nil, err
+		}
+		ranges[i] = r
+	}
+
+	var k []*string
+	ids := make(map[string]string, len(shards))
+	one := big.NewInt(1)
+	for i, r := range ranges {
+		key := new(big.Int).Set(r.start)
+		for moved := true; moved && r.contains(key); {
+			moved = false
+			for j, other := range ranges {
+				if j != i && other.contains(key) {
+					key.Add(other.end, one)
+					moved = true
+				}
+			}
+		}
+		if !r.contains(key) {
+			continue
+		}
+		hashKey := key.String()
+		k = append(k, &hashKey)
+		ids[hashKey] = *shards[i].ShardID
+	}
+	return k, ids, nil
 }
 
 // fanOutPutRecordInput transforms a PutRecordInput to a PutRecordsInput which sends the same data to all explicit hash keys specified.
-func fanOutPutRecordInput(input *kinesis.PutRecordInput, keys []*string) (*kinesis.PutRecordsInput, error) {
+// The partition key of the entry for keys[i] is picked by partitionKeys for shard index i; nil selects the caller's
+// partition key when the record has one and one derived from its message ID otherwise.
+func fanOutPutRecordInput(input *kinesis.PutRecordInput, keys []*string, partitionKeys PartitionKeyStrategy) (*kinesis.PutRecordsInput, error) {
 	// kinesis.PutRecordInput.SequenceNumberForOrdering not supported by PutRecords.
 	if input.SequenceNumberForOrdering != nil {
 		return nil, errors.New("PutRecords does not support SequenceNumberForOrdering")
 	}
+	if partitionKeys == nil {
+		partitionKeys = defaultPartitionKeys
+	}
+	partitionKey, err := partitionKeys(input)
+	if err != nil {
+		return nil, err
+	}
 	var requests []*kinesis.PutRecordsRequestEntry
-	for _, key := range keys {
-		r := &kinesis.PutRecordsRequestEntry{Data: input.Data, ExplicitHashKey: key, /* XXX PartitionKey still required? */}
+	for i, key := range keys {
+		pk := partitionKey(i)
+		if !validPartitionKey(pk) {
+			return nil, ErrInvalidPartitionKey
+		}
+		r := &kinesis.PutRecordsRequestEntry{Data: input.Data, ExplicitHashKey: key, PartitionKey: &pk}
 		requests = append(requests, r)
 	}
 	return &kinesis.PutRecordsInput{Records: requests, StreamName: input.StreamName}, nil
 }
 
 // PutRecord takes in kinesis.PutRecordInput request and sends it to all shards in the Kinesis stream.
-func PutRecord(c kinesisPubSub, input *kinesis.PutRecordInput) (*kinesis.PutRecordsOutput, error) {
-	// XXX Does the caller worry about the transaction rate or this function?
-	s, err := gatherShards(c, input.StreamName)
+// Shards that reject the record are retried according to DefaultRetryPolicy; any shard that never
+// accepted it is listed in the result and ErrPartialFailure is returned alongside it.
+func PutRecord(c kinesisPubSub, input *kinesis.PutRecordInput) (*PutRecordResult, error) {
+	return PutRecordWithOptions(c, input, nil)
+}
+
+// Options tunes how PutRecordWithOptions and PutMessages fan records out. Zero values select the defaults.
+type Options struct {
+	// Retry bounds how often entries rejected by PutRecords are re-sent.
+	Retry RetryPolicy
+	// Shards, when set, supplies stream topologies instead of calling DescribeStream on every publish.
+	Shards *ShardCache
+	// Concurrency is the most PutRecords requests one fan-out keeps in flight when a stream needs more than one.
+	Concurrency int
+	// Limiter, when set, keeps every attempt under the per-shard write limits. Share one between publishers
+	// writing to the same streams.
+	Limiter *ShardLimiter
+	// AggregateSize, when positive, makes PutMessages pack messages into KPL aggregated records of at most this
+	// many bytes, so that a shard receives one record per batch instead of one per message. Sizes past what a
+	// Kinesis record can carry beside its partition key are capped.
+	AggregateSize int
+	// PublisherID is stamped into the envelopes of messages published without one.
+	PublisherID string
+	// PartitionKeys picks the partition keys of fanned out entries. When nil, a record's own PartitionKey is
+	// used if it has one and MessageIDPartitionKeys otherwise.
+	PartitionKeys PartitionKeyStrategy
+}
+
+// PutRecordWithOptions is PutRecord with its behaviour tuned by opts. A nil opts uses the defaults.
+func PutRecordWithOptions(c kinesisPubSub, input *kinesis.PutRecordInput, opts *Options) (*PutRecordResult, error) {
+	results, err := putRecords(c, []*kinesis.PutRecordInput{input}, opts)
+	if results == nil {
+		return nil, err
+	}
+	return results[0], err
+}
+
+// putRecords sends every input, all addressed to the same stream, to all of its open shards and returns one
+// result per input.
+func putRecords(c kinesisPubSub, inputs []*kinesis.PutRecordInput, opts *Options) ([]*PutRecordResult, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if len(inputs) == 0 {
+		return nil, nil
+	}
+	stream := inputs[0].StreamName
+	s, err := opts.shards(c, stream)
 	if err != nil {
 		return nil, err
 	}
-	k := explicitHashKeys(s)
-	p, err := fanOutPutRecordInput(input, k)
+	results, err := putRecordsToShards(c, inputs, s, nil, opts)
+	if opts.Shards == nil {
+		return results, err
+	}
+	if isResourceNotFound(err) {
+		opts.Shards.Invalidate(*stream)
+		return results, err
+	}
+	if results == nil || !reachedUnknownShard(results, s) {
+		return results, err
+	}
+	// A record landed on a shard the cached topology does not know, so the stream was resharded since it was
+	// described. Refresh it and send each record to every open shard that has not received it yet.
+	refreshed, err := opts.Shards.Refresh(c, *stream)
+	if err != nil {
+		return results, err
+	}
+	skip := make([]map[string]bool, len(results))
+	for i, r := range results {
+		skip[i] = deliveredShardIDs(r)
+	}
+	more, err := putRecordsToShards(c, inputs, openShards(refreshed), skip, opts)
+	if more == nil {
+		return results, err
+	}
+	failed := false
+	for i, r := range results {
+		r.Delivered = append(r.Delivered, more[i].Delivered...)
+		r.Failed = mergeFailures(r.Failed, more[i].Failed)
+		r.Attempts += more[i].Attempts
+		failed = failed || len(r.Failed) > 0
+	}
+	if err == nil && failed {
+		err = ErrPartialFailure
+	}
+	return results, err
+}
+
+// mergeFailures combines the failures of a record's first send with those of its send after the topology was
+// refreshed. A failure on a shard is dropped: the refreshed open shards cover every hash key, and the record was
+// sent again to each of them that had not received it, so the second send reports whether it reached the range
+// of a shard that is still open, or of one the reshard closed and handed over to its children. Only failures
+// that name no shard cannot be matched to a range that was sent to again, and they are kept.
+func mergeFailures(first, second []*ShardFailure) []*ShardFailure {
+	var merged []*ShardFailure
+	for _, f := range first {
+		if f.ShardID == "" {
+			merged = append(merged, f)
+		}
+	}
+	return append(merged, second...)
+}
+
+// shards returns the open shards of a stream, from the cache when one is configured.
+func (o *Options) shards(c kinesisDescribeStream, stream *string) ([]*kinesis.Shard, error) {
+	var s []*kinesis.Shard
+	var err error
+	if o.Shards == nil {
+		s, err = gatherShards(c, stream)
+	} else {
+		s, err = o.Shards.Shards(c, *stream)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return c.PutRecords(p)
+	return openShards(s), nil
 }
 
-/*type kinesisBroadcast interface {
-	kinesisPubSub
-	GetShardIterator(*kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error)
-	GetRecords(*kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error)
+func (o *Options) concurrency() int {
+	if o.Concurrency <= 0 {
+		return DefaultConcurrency
+	}
+	return o.Concurrency
 }
 
-// Broadcast takes records from the in stream and sends them to all shards in the out stream.
-// XXX This should probably be written as a goroutine with a specified query rate so that
-// ShardIterator objects can be reused during the 5 minute validity widow and the fanout is
-// continual instead of a manual call.
-func Broadcast(c kinesisBroadcast, in, out string) (*kinesis.PutRecordsOutput, error) {
-	var result kinesis.PutRecordsOutput
-	inShards, err := gatherShards(c, &in)
+// takeCapacity reserves room on the limiter, if any, for entries addressed to the shards in shardIDs.
+func (o *Options) takeCapacity(stream string, entries []*kinesis.PutRecordsRequestEntry, shardIDs map[string]string) error {
+	if o.Limiter == nil {
+		return nil
+	}
+	writes := make([]ShardWrite, len(entries))
+	for i, e := range entries {
+		writes[i] = ShardWrite{ShardID: shardIDs[*e.ExplicitHashKey], Bytes: entrySize(e)}
+	}
+	return o.Limiter.Take(stream, writes)
+}
+
+// putRecordsToShards fans every input out to the given open shards, skipping for input i any shard whose ID is
+// in skip[i]. The entries are laid out shard by shard, so each shard receives the inputs in order.
+func putRecordsToShards(c kinesisPubSub, inputs []*kinesis.PutRecordInput, s []*kinesis.Shard, skip []map[string]bool, opts *Options) ([]*PutRecordResult, error) {
+	k, ids, err := explicitHashKeys(s)
 	if err != nil {
 		return nil, err
 	}
+	fans := make([]*kinesis.PutRecordsInput, len(inputs))
+	for i, input := range inputs {
+		// Fan out to every shard before dropping the skipped ones, so that a shard keeps its index and with it
+		// the partition key it is sent.
+		if fans[i], err = fanOutPutRecordInput(input, k, opts.PartitionKeys); err != nil {
+			return nil, err
+		}
+		if skip != nil && len(skip[i]) > 0 {
+			var records []*kinesis.PutRecordsRequestEntry
+			for _, e := range fans[i].Records {
+				if !skip[i][ids[*e.ExplicitHashKey]] {
+					records = append(records, e)
+				}
+			}
+			fans[i].Records = records
+		}
+	}
+	p, owners := interleaveByShard(fans, k)
+	return putRecordsWithRetry(c, p, owners, len(inputs), ids, opts)
+}
+
+// reachedUnknownShard reports whether any delivered entry was routed to a shard outside of shards.
+func reachedUnknownShard(results []*PutRecordResult, shards []*kinesis.Shard) bool {
+	known := make(map[string]bool, len(shards))
+	for _, s := range shards {
+		known[*s.ShardID] = true
+	}
+	for _, result := range results {
+		for _, r := range result.Delivered {
+			if r.ShardID != nil && !known[*r.ShardID] {
+				return true
+			}
+		}
+	}
+	return false
+}
 
-	//for _, s = range inShards {
-		// XXX c.GetShardIterator, but need some way to prevent rebroadcast of previously-seen messages.
-		// XXX c.GetRecords
-		// XXX for _, record := range records {
-			// XXX create kinesis.PutRecordInput
-			// XXX PutRecord(c, &putRecord)
-		//}
-	//}
-	// XXX put the records into the output
-	return &result, nil
-}*/
\ No newline at end of file
+// deliveredShardIDs returns the set of shards that accepted the record according to result.
+func deliveredShardIDs(result *PutRecordResult) map[string]bool {
+	delivered := make(map[string]bool, len(result.Delivered))
+	for _, r := range result.Delivered {
+		if r.ShardID != nil {
+			delivered[*r.ShardID] = true
+		}
+	}
+	return delivered
+}
+
+// isResourceNotFound reports whether err is the error Kinesis returns for a stream that does not exist.
+func isResourceNotFound(err error) bool {
+	e := aws.Error(err)
+	return e != nil && e.Code == "ResourceNotFoundException"
+}
@@ -3,7 +3,11 @@ package pubsub
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/aws"
 	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"github.com/brettcannon/kinesis-experiment/kinesiscassette"
+	"path/filepath"
 	"testing"
 )
 
@@ -83,32 +87,148 @@ func TestGatherShards(t *testing.T) {
 		for i, expected := range tt.expected {
 			shardResult := result[i]
 			if *shardResult != *expected {
-				t.Errorf("expected[%i] %v, was %v", i, *expected, *shardResult)
+				t.Errorf("expected[%d] %v, was %v", i, *expected, *shardResult)
 			}
 		}
 	}
 }
 
+// replay returns a client that answers from the cassette in testdata called name.
+func replay(t *testing.T, name string) (*kinesis.Kinesis, *kinesiscassette.Player) {
+	cassette, err := kinesiscassette.Load(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return kinesiscassette.NewClient(cassette)
+}
+
+// TestGatherShardsErrorShapes replays the error responses of DescribeStream: a 500 the client retries, a
+// throttle it does not, and a missing stream.
+func TestGatherShardsErrorShapes(t *testing.T) {
+	c, p := replay(t, "describe-stream-errors.json")
+	_, err := gatherShards(c, aws.String("events"))
+	if e := aws.Error(err); e == nil || e.StatusCode != 400 || e.Code != "LimitExceededException" {
+		t.Errorf("expected LimitExceededException once the server error was retried, was %v", err)
+	}
+	if _, err := gatherShards(c, aws.String("missing")); !isResourceNotFound(err) {
+		t.Errorf("expected the stream not to be found, was %v", err)
+	}
+	if err := p.Check(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
 func TestExplicitHashKeys(t *testing.T) {
-	k1 := "key 1"
-	k2 := "key 2"
-	k3 := "key 3"
+	k1 := "100"
+	k2 := "200"
+	k3 := "300"
 	want := []*string{&k1, &k2, &k3}
 	var input []*kinesis.Shard
-	for _, k := range want {
-		input = append(input, &kinesis.Shard{HashKeyRange: &kinesis.HashKeyRange{StartingHashKey: k, EndingHashKey: k}})
+	for i, k := range want {
+		id := fmt.Sprintf("shard ID %d", i)
+		input = append(input, &kinesis.Shard{ShardID: &id, HashKeyRange: &kinesis.HashKeyRange{StartingHashKey: k, EndingHashKey: k}})
+	}
+	got, ids, err := explicitHashKeys(input)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
 	}
-	got := explicitHashKeys(input)
 	if len(got) != len(want) {
 		t.Errorf("got %v, want %v", want, got)
 	}
 	for index := range want {
 		if *got[index] != *want[index] {
-			t.Errorf("got[%i] == %v, want %v", index, *got[index], *want[index])
+			t.Errorf("got[%d] == %v, want %v", index, *got[index], *want[index])
+		}
+		if id := fmt.Sprintf("shard ID %d", index); ids[*want[index]] != id {
+			t.Errorf("ids[%s] == %v, want %v", *want[index], ids[*want[index]], id)
 		}
 	}
 }
 
+func TestExplicitHashKeysRouting(t *testing.T) {
+	tests := []struct {
+		ranges [][2]string
+		want   []string
+	}{
+		{
+			// Contiguous ranges use their starting hash keys.
+			[][2]string{{"0", "99"}, {"100", "199"}},
+			[]string{"0", "100"},
+		},
+		{
+			// Gaps between ranges do not matter.
+			[][2]string{{"0", "49"}, {"100", "199"}},
+			[]string{"0", "100"},
+		},
+		{
+			// An overlapped start moves past the other range.
+			[][2]string{{"0", "149"}, {"100", "199"}},
+			[]string{"0", "150"},
+		},
+		{
+			// A key is pushed past several overlapping ranges listed in any order.
+			[][2]string{{"50", "300"}, {"81", "120"}, {"40", "80"}},
+			[]string{"121", "40"},
+		},
+		{
+			// A range covered entirely by another gets no key.
+			[][2]string{{"0", "199"}, {"50", "60"}},
+			[]string{"0"},
+		},
+		{
+			// Full 128-bit hash keys.
+			[][2]string{{"0", "170141183460469231731687303715884105727"}, {"170141183460469231731687303715884105728", "340282366920938463463374607431768211455"}},
+			[]string{"0", "170141183460469231731687303715884105728"},
+		},
+	}
+	for _, tt := range tests {
+		var shards []*kinesis.Shard
+		for i := range tt.ranges {
+			id := fmt.Sprintf("shard ID %d", i)
+			shards = append(shards, &kinesis.Shard{ShardID: &id, HashKeyRange: &kinesis.HashKeyRange{StartingHashKey: &tt.ranges[i][0], EndingHashKey: &tt.ranges[i][1]}})
+		}
+		got, _, err := explicitHashKeys(shards)
+		if err != nil {
+			t.Errorf("%v: unexpected error %v", tt.ranges, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%v: got %d keys, want %v", tt.ranges, len(got), tt.want)
+			continue
+		}
+		for i := range tt.want {
+			if *got[i] != tt.want[i] {
+				t.Errorf("%v: got[%d] == %v, want %v", tt.ranges, i, *got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestExplicitHashKeysInvalid(t *testing.T) {
+	id := "shard ID 1"
+	k := "not a number"
+	shards := []*kinesis.Shard{{ShardID: &id, HashKeyRange: &kinesis.HashKeyRange{StartingHashKey: &k, EndingHashKey: &k}}}
+	if _, _, err := explicitHashKeys(shards); err == nil {
+		t.Error("expected an error, was nil")
+	}
+}
+
+func TestOpenShards(t *testing.T) {
+	open := "open"
+	closed := "closed"
+	legacy := "no sequence number range"
+	end := "49"
+	shards := []*kinesis.Shard{
+		{ShardID: &closed, SequenceNumberRange: &kinesis.SequenceNumberRange{EndingSequenceNumber: &end}},
+		{ShardID: &open, SequenceNumberRange: &kinesis.SequenceNumberRange{}},
+		{ShardID: &legacy},
+	}
+	got := openShards(shards)
+	if len(got) != 2 || *got[0].ShardID != open || *got[1].ShardID != legacy {
+		t.Errorf("expected [%s %s], was %v", open, legacy, got)
+	}
+}
+
 func TestFanOutPutRecordInput(t *testing.T) {
 	s := "stream name"
 	d := []byte("blob payload")
@@ -117,7 +237,7 @@ func TestFanOutPutRecordInput(t *testing.T) {
 	k3 := "key 3"
 	keys := []*string{&k1, &k2, &k3}
 	input := kinesis.PutRecordInput{Data: d, StreamName: &s}
-	result, err := fanOutPutRecordInput(&input, keys)
+	result, err := fanOutPutRecordInput(&input, keys, nil)
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
 	}
@@ -142,7 +262,7 @@ func TestFanOutPutRecordInputFailure(t *testing.T) {
 	k1 := "key 1"
 	keys := []*string{&k1}
 	input := kinesis.PutRecordInput{Data: d, StreamName: &s, SequenceNumberForOrdering: &num}
-	_, err := fanOutPutRecordInput(&input, keys)
+	_, err := fanOutPutRecordInput(&input, keys, nil)
 	if err == nil {
 		t.Error("expected an error, was nil")
 	}
@@ -155,7 +275,11 @@ type kinesisPutRecordsMock struct {
 
 func (c *kinesisPutRecordsMock) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
 	c.PutRecordsInput = input
-	return nil, nil
+	var out kinesis.PutRecordsOutput
+	for range input.Records {
+		out.Records = append(out.Records, &kinesis.PutRecordsResultEntry{})
+	}
+	return &out, nil
 }
 
 func TestPutRecord(t *testing.T) {
@@ -164,10 +288,10 @@ func TestPutRecord(t *testing.T) {
 	id2 := "shard ID 2"
 	id3 := "shard ID 3"
 	id4 := "shard ID 4"
-	k1 := "shard key 1"
-	k2 := "shard key 2"
-	k3 := "shard key 3"
-	k4 := "shard key 4"
+	k1 := "100"
+	k2 := "200"
+	k3 := "300"
+	k4 := "400"
 	expectedKeys := []*string{&k1, &k2, &k3, &k4}
 	s1 := kinesis.Shard{ShardID: &id1, HashKeyRange: &kinesis.HashKeyRange{StartingHashKey: &k1, EndingHashKey: &k1}}
 	s2 := kinesis.Shard{ShardID: &id2, HashKeyRange: &kinesis.HashKeyRange{StartingHashKey: &k2, EndingHashKey: &k2}}
@@ -209,7 +333,7 @@ func TestPutRecordFailsGatherShards(t *testing.T) {
 func TestPutRecordFailsFanOutPutRecordInput(t *testing.T) {
 	var c kinesisPutRecordsMock
 	id1 := "shard ID 1"
-	k1 := "shard key 1"
+	k1 := "100"
 	s1 := kinesis.Shard{ShardID: &id1, HashKeyRange: &kinesis.HashKeyRange{StartingHashKey: &k1, EndingHashKey: &k1}}
 	c.Shards = [][]*kinesis.Shard{[]*kinesis.Shard{&s1}}
 	stream := "stream name"
@@ -220,3 +344,35 @@ func TestPutRecordFailsFanOutPutRecordInput(t *testing.T) {
 		t.Errorf("expected an error, was %s", err)
 	}
 }
+
+func TestPutRecordSkipsClosedShards(t *testing.T) {
+	var c kinesisPutRecordsMock
+	parent := "parent"
+	child1 := "child 1"
+	child2 := "child 2"
+	end := "49"
+	k1 := "0"
+	k2 := "100"
+	k3 := "199"
+	closed := kinesis.SequenceNumberRange{EndingSequenceNumber: &end}
+	c.Shards = [][]*kinesis.Shard{{
+		{ShardID: &parent, HashKeyRange: &kinesis.HashKeyRange{StartingHashKey: &k1, EndingHashKey: &k3}, SequenceNumberRange: &closed},
+		{ShardID: &child1, HashKeyRange: &kinesis.HashKeyRange{StartingHashKey: &k1, EndingHashKey: &k2}, ParentShardID: &parent},
+		{ShardID: &child2, HashKeyRange: &kinesis.HashKeyRange{StartingHashKey: &k2, EndingHashKey: &k3}, ParentShardID: &parent},
+	}}
+	stream := "stream name"
+	if _, err := PutRecord(&c, &kinesis.PutRecordInput{Data: []byte("blob payload"), StreamName: &stream}); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// The children overlap on key 100, so the second child is addressed just past the first.
+	want := []string{"0", "101"}
+	records := c.PutRecordsInput.Records
+	if len(records) != len(want) {
+		t.Fatalf("expected %d records, was %d", len(want), len(records))
+	}
+	for i, e := range records {
+		if *e.ExplicitHashKey != want[i] {
+			t.Errorf("expected explicit hash key %s, was %s", want[i], *e.ExplicitHashKey)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package pubsub
+
+import (
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"time"
+)
+
+// iteratorValidity is how long a shard iterator can be used after Kinesis returned it.
+const iteratorValidity = 5 * time.Minute
+
+type kinesisSubscribe interface {
+	kinesisDescribeStream
+	GetShardIterator(*kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error)
+	GetRecords(*kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error)
+}
+
+// shardReader reads the records of one shard in order. It reuses the iterator returned by each read for as long
+// as it is valid and gets a new one, positioned after the last record read, once it has expired.
+type shardReader struct {
+	c       kinesisSubscribe
+	stream  string
+	shardID string
+	// limit caps the number of records a single read returns; zero leaves it to Kinesis.
+	limit int64
+	// clock is the time source used to age iterators; nil uses the system clock.
+	clock Clock
+	// start is the position read from before any record has been read.
+	start StartPosition
+
+	// iterator is the next position to read from, obtained at issued.
+	iterator *string
+	issued   time.Time
+	// last is the sequence number of the last record read, from which a new iterator resumes.
+	last *string
+	// closed is set once a closed shard has been read to its end.
+	closed bool
+}
+
+// resume positions the reader after the checkpoint of its shard, if there is one.
+func (r *shardReader) resume(checkpoints CheckpointStore) error {
+	if checkpoints == nil {
+		return nil
+	}
+	seq, err := checkpoints.Checkpoint(r.stream, r.shardID)
+	if err != nil {
+		return err
+	}
+	r.resumeAfter(seq)
+	return nil
+}
+
+// resumeAfter positions the reader after the checkpoint seq, if it is not empty.
+func (r *shardReader) resumeAfter(seq string) {
+	switch seq {
+	case "":
+	case ShardEnd:
+		r.closed = true
+	default:
+		r.last = &seq
+	}
+}
+
+// read returns the next records of the shard, getting a new iterator when there is none or it has expired.
+func (r *shardReader) read() ([]*kinesis.Record, error) {
+	if r.iterator == nil || r.now().Sub(r.issued) >= iteratorValidity {
+		if err := r.renew(); err != nil {
+			return nil, err
+		}
+	}
+	out, err := r.c.GetRecords(r.getRecordsInput())
+	if isExpiredIterator(err) {
+		if err = r.renew(); err != nil {
+			return nil, err
+		}
+		out, err = r.c.GetRecords(r.getRecordsInput())
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.iterator, r.issued = out.NextShardIterator, r.now()
+	if r.iterator == nil {
+		r.closed = true
+	}
+	if n := len(out.Records); n > 0 {
+		r.last = out.Records[n-1].SequenceNumber
+	}
+	return out.Records, nil
+}
+
+func (r *shardReader) getRecordsInput() *kinesis.GetRecordsInput {
+	input := &kinesis.GetRecordsInput{ShardIterator: r.iterator}
+	if r.limit > 0 {
+		input.Limit = &r.limit
+	}
+	return input
+}
+
+// renew gets an iterator positioned after the last record read, or at the start position before the first read.
+// A start position by time is first searched for and replaced by the position found.
+func (r *shardReader) renew() error {
+	input := &kinesis.GetShardIteratorInput{ShardID: &r.shardID, StreamName: &r.stream}
+	if r.last != nil {
+		input.ShardIteratorType = aws.String("AFTER_SEQUENCE_NUMBER")
+		input.StartingSequenceNumber = r.last
+	} else {
+		if !r.start.timestamp.IsZero() {
+			p, err := seekTimestamp(r.c, r.stream, r.shardID, r.start.timestamp)
+			if err != nil {
+				return err
+			}
+			r.start = p
+		}
+		r.start.iteratorInput(input)
+	}
+	out, err := r.c.GetShardIterator(input)
+	if err != nil {
+		return err
+	}
+	r.iterator, r.issued = out.ShardIterator, r.now()
+	return nil
+}
+
+func (r *shardReader) now() time.Time {
+	if r.clock == nil {
+		return time.Now()
+	}
+	return r.clock.Now()
+}
+
+// isExpiredIterator reports whether err is the error Kinesis returns for a shard iterator used too late.
+func isExpiredIterator(err error) bool {
+	e := aws.Error(err)
+	return e != nil && e.Code == "ExpiredIteratorException"
+}
@@ -0,0 +1,406 @@
+package pubsub
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultPollInterval is how often a Broadcaster reads each input shard unless configured otherwise. Kinesis
+// allows five GetRecords calls per shard per second, shared by every reader of the stream.
+const DefaultPollInterval = time.Second
+
+// DefaultMaxHops is the number of relays a message may pass through unless configured otherwise.
+const DefaultMaxHops = 8
+
+// Size of the Bloom filters a Broadcaster deduplicates its input with unless configured otherwise: each holds
+// relayDedupCapacity messages, and about one new message in a million is wrongly dropped.
+const (
+	relayDedupCapacity      = 100000
+	relayDedupFalsePositive = 1e-6
+)
+
+// Envelope headers stamped by every relay a message passes through.
+const (
+	// HopsHeader counts the relays that have forwarded the message.
+	HopsHeader = "pubsub-hops"
+	// RelaysHeader lists the IDs of those relays, separated by commas.
+	RelaysHeader = "pubsub-relays"
+)
+
+type kinesisBroadcast interface {
+	kinesisSubscribe
+	PutRecords(*kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error)
+}
+
+// BroadcastConfig configures a Broadcaster.
+type BroadcastConfig struct {
+	// In is the stream records are read from.
+	In string
+	// Out is the stream every record is re-published to, on all of its open shards.
+	Out string
+	// Options tunes the fan-out to Out.
+	Options *Options
+	// PollInterval is the time between two reads of the same input shard.
+	PollInterval time.Duration
+	// Limit caps the number of records a single read returns; zero leaves it to Kinesis.
+	Limit int64
+	// OnError, when set, is called with every error met while reading a shard or re-publishing its records. The
+	// relay carries on regardless and retries on the next poll.
+	OnError func(shardID string, err error)
+	// RelayID identifies the relay in the RelaysHeader of the messages it forwards and must not contain a comma.
+	// It defaults to "In>Out", which stays the same across restarts.
+	RelayID string
+	// MaxHops is the most relays a message may pass through, this one included.
+	MaxHops int
+	// WrapRaw makes the relay wrap records without an envelope in one, identified by their content, so that their
+	// hops are counted like those of enveloped messages. Left unset, raw records are forwarded unchanged and only
+	// Dedup keeps them from going round a loop of relays.
+	WrapRaw bool
+	// Dedup drops the input records seen before. Reading a broadcast stream, whose every shard carries every
+	// record, it keeps the relay from re-publishing each record once per input shard, and it stops raw records
+	// that come back round a loop of relays. Enveloped records are told apart by message ID and others by content.
+	// It defaults to a BloomDeduplicator remembering at least the last 100000 messages.
+	Dedup Deduplicator
+	// Checkpoints, when set, records the last input record relayed from each shard, and the relay resumes after
+	// it when started again. Records are checkpointed once they have reached every output shard, so a restart
+	// may broadcast records again but never skips one.
+	Checkpoints CheckpointStore
+	// Clock is the time source used to age shard iterators; nil uses the system clock.
+	Clock Clock
+}
+
+// Broadcaster relays a stream into another one, continually re-publishing each record read from any shard of the
+// input stream to every open shard of the output stream. Every input shard is polled by its own goroutine, which
+// keeps reusing the iterator Kinesis returned with the previous read for as long as it is valid. Reading starts
+// after the checkpoint of each shard, or without one at its tip, so only records added after the relay first
+// started are broadcast.
+//
+// The relay follows the input stream through resharding: the shards created by SplitShard or MergeShards are
+// read from their start once the shards they came from have been read to their end, so that records with the
+// same hash key keep their order.
+//
+// Every forwarded message is stamped with a hop count and the ID of the relay, in an envelope whose ID, publisher
+// and timestamp are kept. Raw records are forwarded unchanged, or with WrapRaw in a new envelope identified by
+// their content, and aggregated records are forwarded one user record at a time. A message that has already
+// passed through this relay, or through MaxHops relays, is dropped rather than forwarded, and so is a raw record
+// forwarded unchanged that the relay has seen before, so that relays chained into a cycle cannot amplify traffic
+// without end; DroppedLoops counts them.
+//
+// A record whose fan-out misses some shards is re-sent to just those shards on the following polls, ahead of any
+// newer record, so relayed records may be duplicated but reach each output shard in their input order.
+type Broadcaster struct {
+	c      kinesisBroadcast
+	config BroadcastConfig
+
+	mu      sync.Mutex
+	lineage *shardLineage
+
+	droppedLoops int64
+
+	closeOnce sync.Once
+	closing   chan struct{}
+	wg        sync.WaitGroup
+}
+
+// shardRelay reads one input shard and holds its undelivered records.
+type shardRelay struct {
+	*shardReader
+	// pending holds the records read but not yet delivered to every output shard; delivered[i] lists the
+	// output shards pending[i] has reached.
+	pending   []*kinesis.Record
+	delivered []map[string]bool
+}
+
+// Broadcast starts relaying records from the in stream to every shard of the out stream with the default
+// settings.
+func Broadcast(c kinesisBroadcast, in, out string) (*Broadcaster, error) {
+	return NewBroadcaster(c, BroadcastConfig{In: in, Out: out})
+}
+
+// NewBroadcaster describes the input stream and starts polling each of its shards. Close the Broadcaster to stop
+// it.
+func NewBroadcaster(c kinesisBroadcast, config BroadcastConfig) (*Broadcaster, error) {
+	if config.PollInterval <= 0 {
+		config.PollInterval = DefaultPollInterval
+	}
+	if config.RelayID == "" {
+		config.RelayID = config.In + ">" + config.Out
+	}
+	if config.MaxHops <= 0 {
+		config.MaxHops = DefaultMaxHops
+	}
+	if config.Dedup == nil {
+		d, err := NewBloomDeduplicator(relayDedupCapacity, relayDedupFalsePositive)
+		if err != nil {
+			return nil, err
+		}
+		config.Dedup = d
+	}
+	shards, err := gatherShards(c, &config.In)
+	if err != nil {
+		return nil, err
+	}
+	b := &Broadcaster{
+		c:       c,
+		config:  config,
+		lineage: newShardLineage(config.In, config.Checkpoints),
+		closing: make(chan struct{}),
+	}
+	starts, err := b.lineage.add(shards)
+	if err != nil {
+		return nil, err
+	}
+	b.start(starts)
+	return b, nil
+}
+
+// start launches a relay for each shard that is ready to be read, unless the Broadcaster is closing.
+func (b *Broadcaster) start(starts []shardStart) {
+	select {
+	case <-b.closing:
+		return
+	default:
+	}
+	for _, st := range starts {
+		r := &shardRelay{shardReader: &shardReader{
+			c:       b.c,
+			stream:  b.config.In,
+			shardID: st.shardID,
+			limit:   b.config.Limit,
+			clock:   b.config.Clock,
+			start:   st.start,
+		}}
+		r.resumeAfter(st.checkpoint)
+		b.wg.Add(1)
+		go b.relay(r)
+	}
+}
+
+// finish records that a shard has been read to its end and starts reading the shards it was resharded into once
+// they are ready.
+func (b *Broadcaster) finish(r *shardRelay) error {
+	if b.config.Checkpoints != nil {
+		if err := b.config.Checkpoints.SetCheckpoint(b.config.In, r.shardID, ShardEnd); err != nil {
+			return err
+		}
+	}
+	shards, err := gatherShards(b.c, &b.config.In)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	starts, err := b.lineage.add(shards)
+	b.start(starts)
+	if err != nil {
+		return err
+	}
+	starts, err = b.lineage.finish(r.shardID)
+	b.start(starts)
+	return err
+}
+
+// DroppedLoops is the number of messages dropped because they had already passed through this relay or through too
+// many relays, along with the raw records dropped as repeats because they could not be stamped.
+func (b *Broadcaster) DroppedLoops() int64 {
+	return atomic.LoadInt64(&b.droppedLoops)
+}
+
+// Close stops reading and waits for the reads and fan-outs in progress to finish. Records still waiting to reach
+// some output shards are abandoned.
+func (b *Broadcaster) Close() error {
+	b.closeOnce.Do(func() { close(b.closing) })
+	b.wg.Wait()
+	return nil
+}
+
+// relay polls a shard until it is read to its end and its children are under way, or the Broadcaster is closed.
+func (b *Broadcaster) relay(r *shardRelay) {
+	defer b.wg.Done()
+	ticker := time.NewTicker(b.config.PollInterval)
+	defer ticker.Stop()
+	for {
+		if err := b.poll(r); err != nil && b.config.OnError != nil {
+			b.config.OnError(r.shardID, err)
+		}
+		if r.closed && len(r.pending) == 0 {
+			err := b.finish(r)
+			if err == nil {
+				return
+			}
+			if b.config.OnError != nil {
+				b.config.OnError(r.shardID, err)
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-b.closing:
+			return
+		}
+	}
+}
+
+// poll delivers the records left over from earlier polls and, once there are none, reads and relays the next
+// records of the shard.
+func (b *Broadcaster) poll(r *shardRelay) error {
+	if len(r.pending) > 0 {
+		if err := b.publish(r); err != nil {
+			return err
+		}
+	}
+	if r.closed {
+		return nil
+	}
+	records, err := r.read()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	if records = b.forward(records); len(records) == 0 {
+		return b.checkpoint(r)
+	}
+	r.pending = records
+	r.delivered = make([]map[string]bool, len(records))
+	return b.publish(r)
+}
+
+// publish fans the pending records out to the output shards they have not reached yet and keeps those that still
+// missed some.
+func (b *Broadcaster) publish(r *shardRelay) error {
+	inputs := make([]*kinesis.PutRecordInput, len(r.pending))
+	for i, rec := range r.pending {
+		inputs[i] = &kinesis.PutRecordInput{Data: rec.Data, PartitionKey: rec.PartitionKey, StreamName: &b.config.Out}
+	}
+	opts := b.config.Options
+	if opts == nil {
+		opts = &Options{}
+	}
+	var results []*PutRecordResult
+	var err error
+	if r.delivered[0] == nil {
+		results, err = putRecords(b.c, inputs, opts)
+	} else {
+		var s []*kinesis.Shard
+		if s, err = opts.shards(b.c, &b.config.Out); err != nil {
+			return err
+		}
+		results, err = putRecordsToShards(b.c, inputs, s, r.delivered, opts)
+	}
+	if results == nil {
+		return err
+	}
+	var pending []*kinesis.Record
+	var delivered []map[string]bool
+	for i, result := range results {
+		if len(result.Failed) == 0 {
+			continue
+		}
+		d := r.delivered[i]
+		if d == nil {
+			d = make(map[string]bool)
+		}
+		for id := range deliveredShardIDs(result) {
+			d[id] = true
+		}
+		pending = append(pending, r.pending[i])
+		delivered = append(delivered, d)
+	}
+	r.pending, r.delivered = pending, delivered
+	if len(pending) == 0 {
+		if cerr := b.checkpoint(r); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// checkpoint records the last record read from the shard, once everything read has been delivered.
+func (b *Broadcaster) checkpoint(r *shardRelay) error {
+	if b.config.Checkpoints == nil || r.last == nil {
+		return nil
+	}
+	return b.config.Checkpoints.SetCheckpoint(b.config.In, r.shardID, *r.last)
+}
+
+// forward turns the records read into the records to relay: one per message, stamped with this relay's hop.
+// Records without an envelope are passed on unchanged unless WrapRaw is set. Loops and messages seen before are
+// left out.
+func (b *Broadcaster) forward(records []*kinesis.Record) []*kinesis.Record {
+	var out []*kinesis.Record
+	for _, rec := range records {
+		for _, u := range deaggregate(rec) {
+			pk := u.PartitionKey
+			m, err := Unwrap(u.Data)
+			if err != nil {
+				// An envelope from a newer version cannot be stamped, so it is passed on as it is.
+				out = append(out, &kinesis.Record{Data: u.Data, PartitionKey: &pk, SequenceNumber: rec.SequenceNumber})
+				continue
+			}
+			raw := !m.Enveloped
+			if raw {
+				m = &Message{ID: contentID(u.Data), Data: u.Data}
+			}
+			if b.config.Dedup.Seen(m) {
+				// Nothing else keeps a raw record forwarded unchanged from going round a loop.
+				if raw && !b.config.WrapRaw {
+					atomic.AddInt64(&b.droppedLoops, 1)
+				}
+				continue
+			}
+			if raw && !b.config.WrapRaw {
+				out = append(out, &kinesis.Record{Data: u.Data, PartitionKey: &pk, SequenceNumber: rec.SequenceNumber})
+				continue
+			}
+			if !b.stamp(m) {
+				atomic.AddInt64(&b.droppedLoops, 1)
+				continue
+			}
+			data, err := Wrap(m)
+			if err != nil {
+				continue
+			}
+			out = append(out, &kinesis.Record{Data: data, PartitionKey: &pk, SequenceNumber: rec.SequenceNumber})
+		}
+	}
+	return out
+}
+
+// stamp adds this relay's hop to the headers of m, or returns false if m must not be forwarded.
+func (b *Broadcaster) stamp(m *Message) bool {
+	hops, _ := strconv.Atoi(m.Headers[HopsHeader])
+	var relays []string
+	if r := m.Headers[RelaysHeader]; r != "" {
+		relays = strings.Split(r, ",")
+	}
+	if hops >= b.config.MaxHops {
+		return false
+	}
+	for _, id := range relays {
+		if id == b.config.RelayID {
+			return false
+		}
+	}
+	headers := make(map[string]string, len(m.Headers)+2)
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	headers[HopsHeader] = strconv.Itoa(hops + 1)
+	headers[RelaysHeader] = strings.Join(append(relays, b.config.RelayID), ",")
+	m.Headers = headers
+	return true
+}
+
+// contentID is the message ID given to a raw record, derived from its content so that copies of the record read
+// from different shards get the same ID.
+func contentID(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
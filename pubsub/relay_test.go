@@ -0,0 +1,534 @@
+package pubsub
+
+import (
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"github.com/brettcannon/kinesis-experiment/kinesisfake"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// kinesisRelayMock serves the shards of the stream "in" from In, where the sequence number of a record is its
+// index in the shard, and hands every PutRecords call to the embedded sequencing mock. Every other stream has the
+// two shards the sequencing mock routes to. Reads return at most Limit records, and PageSize when it is set,
+// closed shards end once read and Parents lists the shards each shard was split or merged from.
+type kinesisRelayMock struct {
+	*kinesisSequencingMock
+	lock      sync.Mutex
+	In        map[string][]string
+	Closed    map[string]bool
+	Parents   map[string][]string
+	ReadErrs  []error
+	PageSize  int
+	Iterators []*kinesis.GetShardIteratorInput
+	Reads     int
+}
+
+func relayMock(shardIDs ...string) *kinesisRelayMock {
+	c := &kinesisRelayMock{kinesisSequencingMock: sequencingMock(), In: make(map[string][]string)}
+	for _, id := range shardIDs {
+		c.In[id] = nil
+	}
+	return c
+}
+
+func (c *kinesisRelayMock) DescribeStream(input *kinesis.DescribeStreamInput) (*kinesis.DescribeStreamOutput, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var shards []*kinesis.Shard
+	if *input.StreamName == "in" {
+		var ids []string
+		for id := range c.In {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			s := testShard(id, "0")
+			start := "0"
+			s.SequenceNumberRange = &kinesis.SequenceNumberRange{StartingSequenceNumber: &start}
+			if c.Closed[id] {
+				end := fmt.Sprint(len(c.In[id]))
+				s.SequenceNumberRange.EndingSequenceNumber = &end
+			}
+			if p := c.Parents[id]; len(p) > 0 {
+				s.ParentShardID = &p[0]
+				if len(p) > 1 {
+					s.AdjacentParentShardID = &p[1]
+				}
+			}
+			shards = append(shards, s)
+		}
+	} else {
+		shards = []*kinesis.Shard{testShard("shard ID 1", "1"), testShard("shard ID 2", "2")}
+	}
+	more := false
+	return &kinesis.DescribeStreamOutput{StreamDescription: &kinesis.StreamDescription{
+		HasMoreShards: &more,
+		Shards:        shards,
+		StreamName:    input.StreamName,
+	}}, nil
+}
+
+func (c *kinesisRelayMock) GetShardIterator(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Iterators = append(c.Iterators, input)
+	var pos int
+	switch *input.ShardIteratorType {
+	case "LATEST":
+		pos = len(c.In[*input.ShardID])
+	case "AT_SEQUENCE_NUMBER":
+		pos, _ = strconv.Atoi(*input.StartingSequenceNumber)
+	case "AFTER_SEQUENCE_NUMBER":
+		n, _ := strconv.Atoi(*input.StartingSequenceNumber)
+		pos = n + 1
+	}
+	it := fmt.Sprintf("%s/%d", *input.ShardID, pos)
+	return &kinesis.GetShardIteratorOutput{ShardIterator: &it}, nil
+}
+
+func (c *kinesisRelayMock) GetRecords(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.Reads++
+	if len(c.ReadErrs) > 0 {
+		err := c.ReadErrs[0]
+		c.ReadErrs = c.ReadErrs[1:]
+		return nil, err
+	}
+	i := strings.LastIndex(*input.ShardIterator, "/")
+	id := (*input.ShardIterator)[:i]
+	pos, _ := strconv.Atoi((*input.ShardIterator)[i+1:])
+	var out kinesis.GetRecordsOutput
+	for ; pos < len(c.In[id]) && (input.Limit == nil || int64(len(out.Records)) < *input.Limit); pos++ {
+		if c.PageSize > 0 && len(out.Records) == c.PageSize {
+			break
+		}
+		pk, seq := "partition key", fmt.Sprint(pos)
+		out.Records = append(out.Records, &kinesis.Record{Data: []byte(c.In[id][pos]), PartitionKey: &pk, SequenceNumber: &seq})
+	}
+	if !c.Closed[id] || pos < len(c.In[id]) {
+		next := fmt.Sprintf("%s/%d", id, pos)
+		out.NextShardIterator = &next
+	}
+	return &out, nil
+}
+
+func (c *kinesisRelayMock) Add(shardID, data string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.In[shardID] = append(c.In[shardID], data)
+}
+
+// Reshard closes the parent shards and adds a child shard made from them.
+func (c *kinesisRelayMock) Reshard(child string, parents ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.Closed == nil {
+		c.Closed = make(map[string]bool)
+	}
+	if c.Parents == nil {
+		c.Parents = make(map[string][]string)
+	}
+	for _, p := range parents {
+		c.Closed[p] = true
+	}
+	c.Parents[child] = parents
+	c.In[child] = c.In[child]
+}
+
+func (c *kinesisRelayMock) ReadErr(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.ReadErrs = append(c.ReadErrs, err)
+}
+
+func (c *kinesisRelayMock) iterators() []*kinesis.GetShardIteratorInput {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]*kinesis.GetShardIteratorInput{}, c.Iterators...)
+}
+
+// accepted returns the payloads accepted by a shard of the output stream.
+func (c *kinesisRelayMock) accepted(shardID string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var payloads []string
+	for _, data := range c.Accepted[shardID] {
+		if m, err := Unwrap([]byte(data)); err == nil {
+			data = string(m.Data)
+		}
+		payloads = append(payloads, data)
+	}
+	return payloads
+}
+
+// waitFor polls cond until it holds, failing the test after a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBroadcasterRelaysRecords(t *testing.T) {
+	c := relayMock("in 1", "in 2")
+	b, err := NewBroadcaster(c, BroadcastConfig{In: "in", Out: "out", PollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	waitFor(t, "both shards to be read", func() bool { return len(c.iterators()) == 2 })
+	c.Add("in 1", "a")
+	c.Add("in 2", "b")
+	c.Add("in 1", "c")
+	for _, id := range []string{"shard ID 1", "shard ID 2"} {
+		waitFor(t, "records on "+id, func() bool { return len(c.accepted(id)) == 3 })
+	}
+	b.Close()
+	for _, id := range []string{"shard ID 1", "shard ID 2"} {
+		got := strings.Join(c.accepted(id), "")
+		if strings.Index(got, "a") > strings.Index(got, "c") || !strings.Contains(got, "b") {
+			t.Errorf("%s: expected a before c and b, was %s", id, got)
+		}
+	}
+	if n := len(c.iterators()); n != 2 {
+		t.Errorf("expected the iterators to be reused, %d were requested", n)
+	}
+	c.lock.Lock()
+	reads := c.Reads
+	c.lock.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.Reads != reads {
+		t.Errorf("expected no reads after Close, were %d", c.Reads-reads)
+	}
+}
+
+func TestBroadcasterRenewsIterators(t *testing.T) {
+	tests := []struct {
+		name   string
+		expire func(c *kinesisRelayMock, clock *fakeClock)
+	}{
+		{"validity window", func(c *kinesisRelayMock, clock *fakeClock) { clock.Advance(iteratorValidity) }},
+		{"expired error", func(c *kinesisRelayMock, clock *fakeClock) {
+			c.ReadErr(aws.APIError{Code: "ExpiredIteratorException"})
+		}},
+	}
+	for _, test := range tests {
+		c := relayMock("in 1")
+		clock := &fakeClock{now: time.Unix(0, 0)}
+		b, err := NewBroadcaster(c, BroadcastConfig{In: "in", Out: "out", PollInterval: time.Millisecond, Clock: clock})
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", test.name, err)
+		}
+		waitFor(t, "the shard to be read", func() bool { return len(c.iterators()) == 1 })
+		c.Add("in 1", "a")
+		waitFor(t, "the first record", func() bool { return len(c.accepted("shard ID 1")) == 1 })
+		test.expire(c, clock)
+		c.Add("in 1", "b")
+		waitFor(t, "the second record", func() bool { return len(c.accepted("shard ID 1")) == 2 })
+		b.Close()
+
+		its := c.iterators()
+		if len(its) != 2 {
+			t.Errorf("%s: expected one renewal, was %d iterators", test.name, len(its))
+			continue
+		}
+		if *its[1].ShardIteratorType != "AFTER_SEQUENCE_NUMBER" || *its[1].StartingSequenceNumber != "0" {
+			t.Errorf("%s: expected to resume after 0, was %s", test.name, *its[1].ShardIteratorType)
+		}
+		if got := c.accepted("shard ID 1"); fmt.Sprint(got) != "[a b]" {
+			t.Errorf("%s: expected [a b], was %v", test.name, got)
+		}
+	}
+}
+
+func TestBroadcasterRedeliversToFailedShards(t *testing.T) {
+	c := relayMock("in 1")
+	c.Reject = map[string]bool{"2/a": true}
+	errs := make(chan error, 100)
+	b, err := NewBroadcaster(c, BroadcastConfig{
+		In:           "in",
+		Out:          "out",
+		Options:      &Options{Retry: RetryPolicy{MaxAttempts: 1}},
+		PollInterval: time.Millisecond,
+		OnError: func(shardID string, err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer b.Close()
+	waitFor(t, "the shard to be read", func() bool { return len(c.iterators()) == 1 })
+	c.Add("in 1", "a")
+	if err := <-errs; err != ErrPartialFailure {
+		t.Errorf("expected %v, was %v", ErrPartialFailure, err)
+	}
+	c.mu.Lock()
+	c.Reject = nil
+	c.mu.Unlock()
+	waitFor(t, "redelivery", func() bool { return len(c.accepted("shard ID 2")) == 1 })
+	c.Add("in 1", "b")
+	waitFor(t, "the next record", func() bool { return len(c.accepted("shard ID 2")) == 2 })
+	for _, id := range []string{"shard ID 1", "shard ID 2"} {
+		if got := c.accepted(id); fmt.Sprint(got) != "[a b]" {
+			t.Errorf("%s: expected [a b] once each, was %v", id, got)
+		}
+	}
+}
+
+func TestBroadcasterSkipsShardsClosedBeforeStart(t *testing.T) {
+	c := relayMock("in 1", "in 2")
+	c.Reshard("in 2", "in 1")
+	b, err := Broadcast(c, "in", "out")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	waitFor(t, "the open shard to be read", func() bool { return len(c.iterators()) == 1 })
+	b.Close()
+	if its := c.iterators(); *its[0].ShardID != "in 2" || *its[0].ShardIteratorType != "LATEST" {
+		t.Errorf("expected to read only the open shard from its tip, was %s from %s", *its[0].ShardID, *its[0].ShardIteratorType)
+	}
+}
+
+func TestBroadcasterResumesFromCheckpoint(t *testing.T) {
+	c := relayMock("in 1")
+	checkpoints := NewMemoryCheckpointStore()
+	config := BroadcastConfig{In: "in", Out: "out", PollInterval: time.Millisecond, Checkpoints: checkpoints}
+	b, err := NewBroadcaster(c, config)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	waitFor(t, "the shard to be read", func() bool { return len(c.iterators()) == 1 })
+	c.Add("in 1", "a")
+	waitFor(t, "the first record", func() bool { return len(c.accepted("shard ID 2")) == 1 })
+	b.Close()
+	if seq, _ := checkpoints.Checkpoint("in", "in 1"); seq != "0" {
+		t.Errorf("expected checkpoint 0, was %q", seq)
+	}
+
+	// Records added while the relay was down are broadcast once it is back.
+	c.Add("in 1", "b")
+	if b, err = NewBroadcaster(c, config); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	waitFor(t, "the second record", func() bool { return len(c.accepted("shard ID 2")) == 2 })
+	b.Close()
+	its := c.iterators()
+	if *its[1].ShardIteratorType != "AFTER_SEQUENCE_NUMBER" || *its[1].StartingSequenceNumber != "0" {
+		t.Errorf("expected to resume after 0, was %s", *its[1].ShardIteratorType)
+	}
+	for _, id := range []string{"shard ID 1", "shard ID 2"} {
+		if got := c.accepted(id); fmt.Sprint(got) != "[a b]" {
+			t.Errorf("%s: expected [a b], was %v", id, got)
+		}
+	}
+	if seq, _ := checkpoints.Checkpoint("in", "in 1"); seq != "1" {
+		t.Errorf("expected checkpoint 1, was %q", seq)
+	}
+}
+
+func TestBroadcasterStampsHops(t *testing.T) {
+	c := relayMock("in 1")
+	b, err := NewBroadcaster(c, BroadcastConfig{In: "in", Out: "out", PollInterval: time.Millisecond, WrapRaw: true})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	waitFor(t, "the shard to be read", func() bool { return len(c.iterators()) == 1 })
+	published := time.Unix(1436000000, 0)
+	enveloped, _ := Wrap(&Message{ID: "m", PublisherID: "publisher", PublishedAt: published, Headers: map[string]string{
+		"k":        "v",
+		HopsHeader: "2", RelaysHeader: "x,y",
+	}, Data: []byte("enveloped")})
+	aggregated, _ := Aggregate([]*UserRecord{{PartitionKey: "k", Data: []byte("first")}, {PartitionKey: "k", Data: []byte("second")}}, maxRecordSize)
+	c.Add("in 1", "raw")
+	c.Add("in 1", string(enveloped))
+	c.Add("in 1", string(aggregated[0]))
+	waitFor(t, "the records", func() bool { return len(c.accepted("shard ID 1")) == 4 })
+	b.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var got []*Message
+	for _, data := range c.Accepted["shard ID 1"] {
+		m, _ := Unwrap([]byte(data))
+		got = append(got, m)
+	}
+	want := []struct {
+		id, data, hops, relays string
+	}{
+		{contentID([]byte("raw")), "raw", "1", "in>out"},
+		{"m", "enveloped", "3", "x,y,in>out"},
+		{contentID([]byte("first")), "first", "1", "in>out"},
+		{contentID([]byte("second")), "second", "1", "in>out"},
+	}
+	for i, w := range want {
+		m := got[i]
+		if !m.Enveloped || m.ID != w.id || string(m.Data) != w.data || m.Headers[HopsHeader] != w.hops || m.Headers[RelaysHeader] != w.relays {
+			t.Errorf("message %d: expected %s %q after %s hops via %s, was %+v", i, w.id, w.data, w.hops, w.relays, *m)
+		}
+	}
+	if m := got[1]; m.PublisherID != "publisher" || !m.PublishedAt.Equal(published) || m.Headers["k"] != "v" {
+		t.Errorf("expected the envelope to be kept, was %+v", *m)
+	}
+}
+
+func TestBroadcasterPassesThroughUnstampedRecords(t *testing.T) {
+	c := relayMock("in 1")
+	b, err := NewBroadcaster(c, BroadcastConfig{In: "in", Out: "out", PollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	waitFor(t, "the shard to be read", func() bool { return len(c.iterators()) == 1 })
+	first, _ := Wrap(&Message{ID: "first", Data: []byte("first")})
+	newer := append(append([]byte{}, envelopeMagic...), EnvelopeVersion+1, 0)
+	aggregated, _ := Aggregate([]*UserRecord{
+		{PartitionKey: "k", Data: first},
+		{PartitionKey: "k", Data: newer},
+		{PartitionKey: "k", Data: []byte("raw")},
+	}, maxRecordSize)
+	c.Add("in 1", "plain")
+	c.Add("in 1", string(aggregated[0]))
+	waitFor(t, "the records", func() bool { return len(c.accepted("shard ID 1")) == 4 })
+	b.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	got := c.Accepted["shard ID 1"]
+	if len(got) != 4 {
+		t.Fatalf("expected every user record to be forwarded once, was %q", got)
+	}
+	for i, want := range []string{"plain", "", string(newer), "raw"} {
+		if want != "" && got[i] != want {
+			t.Errorf("record %d: expected %q to be forwarded unchanged, was %q", i, want, got[i])
+		}
+	}
+	if m, _ := Unwrap([]byte(got[1])); m.ID != "first" || m.Headers[HopsHeader] != "1" {
+		t.Errorf("expected the enveloped message to be stamped, was %+v", *m)
+	}
+}
+
+func TestBroadcasterDropsLoops(t *testing.T) {
+	c := relayMock("in 1")
+	b, err := NewBroadcaster(c, BroadcastConfig{
+		In:           "in",
+		Out:          "out",
+		PollInterval: time.Millisecond,
+		RelayID:      "A>B",
+		MaxHops:      3,
+		WrapRaw:      true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer b.Close()
+	waitFor(t, "the shard to be read", func() bool { return len(c.iterators()) == 1 })
+	c.Add("in 1", "a")
+	waitFor(t, "the first record", func() bool { return len(c.accepted("shard ID 1")) == 1 })
+
+	// Another relay copies the output back into the input.
+	c.mu.Lock()
+	forwarded, _ := Unwrap([]byte(c.Accepted["shard ID 1"][0]))
+	c.mu.Unlock()
+	forwarded.Headers[HopsHeader] = "2"
+	forwarded.Headers[RelaysHeader] += ",B>A"
+	looped, _ := Wrap(forwarded)
+	tooFar, _ := Wrap(&Message{ID: "far", Headers: map[string]string{HopsHeader: "3"}, Data: []byte("far")})
+	c.Add("in 1", string(looped))
+	c.Add("in 1", string(tooFar))
+	c.Add("in 1", "b")
+	waitFor(t, "the next record", func() bool { return len(c.accepted("shard ID 1")) == 2 })
+	if got := c.accepted("shard ID 1"); fmt.Sprint(got) != "[a b]" {
+		t.Errorf("expected the loop and the far message to be dropped, was %v", got)
+	}
+	if n := b.DroppedLoops(); n != 2 {
+		t.Errorf("expected 2 dropped loops, was %d", n)
+	}
+}
+
+// kinesisIteratorCounter counts the shard iterators taken from an in-memory Kinesis.
+type kinesisIteratorCounter struct {
+	*kinesisfake.Kinesis
+	mu        sync.Mutex
+	Iterators int
+}
+
+func (c *kinesisIteratorCounter) GetShardIterator(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	c.mu.Lock()
+	c.Iterators++
+	c.mu.Unlock()
+	return c.Kinesis.GetShardIterator(input)
+}
+
+func (c *kinesisIteratorCounter) iterators() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Iterators
+}
+
+// count returns the number of records in every shard of a stream.
+func (c *kinesisIteratorCounter) count(t *testing.T, stream string) int {
+	shards, err := gatherShards(c.Kinesis, aws.String(stream))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	n := 0
+	for _, s := range shards {
+		it, err := c.Kinesis.GetShardIterator(&kinesis.GetShardIteratorInput{StreamName: aws.String(stream), ShardID: s.ShardID, ShardIteratorType: aws.String("TRIM_HORIZON")})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		out, err := c.Kinesis.GetRecords(&kinesis.GetRecordsInput{ShardIterator: it.ShardIterator})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		n += len(out.Records)
+	}
+	return n
+}
+
+func TestBroadcasterDropsRawLoopsByDefault(t *testing.T) {
+	c := &kinesisIteratorCounter{Kinesis: kinesisfake.New()}
+	for _, name := range []string{"a", "b"} {
+		if _, err := c.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String(name), ShardCount: aws.Long(2)}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	// The relays are chained into a cycle with the default settings.
+	var relays []*Broadcaster
+	for _, config := range []BroadcastConfig{{In: "a", Out: "b"}, {In: "b", Out: "a"}} {
+		config.PollInterval = time.Millisecond
+		b, err := NewBroadcaster(c, config)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		defer b.Close()
+		relays = append(relays, b)
+	}
+	waitFor(t, "every shard to be read", func() bool { return c.iterators() == 4 })
+	if _, err := c.PutRecord(&kinesis.PutRecordInput{StreamName: aws.String("a"), PartitionKey: aws.String("k"), Data: []byte("raw")}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// a holds the record and a copy on each shard from b, and b a copy on each shard from a.
+	waitFor(t, "the loop to be dropped", func() bool { return relays[0].DroppedLoops()+relays[1].DroppedLoops() == 3 })
+	time.Sleep(20 * time.Millisecond)
+	if a, b := c.count(t, "a"), c.count(t, "b"); a != 3 || b != 2 {
+		t.Errorf("expected 3 records in a and 2 in b, were %d and %d", a, b)
+	}
+	if n := relays[0].DroppedLoops() + relays[1].DroppedLoops(); n != 3 {
+		t.Errorf("expected 3 dropped loops, was %d", n)
+	}
+}
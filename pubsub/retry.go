@@ -0,0 +1,188 @@
+package pubsub
+
+import (
+	"errors"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"math/rand"
+	"time"
+)
+
+// ErrPartialFailure is returned alongside a PutRecordResult when at least one shard never accepted the record.
+var ErrPartialFailure = errors.New("record was not delivered to every shard")
+
+// errThroughputExceeded is the PutRecords entry error code for a throttled shard.
+const errThroughputExceeded = "ProvisionedThroughputExceededException"
+
+// RetryPolicy bounds how often entries rejected by PutRecords are re-sent.
+// Zero fields fall back to the matching field of DefaultRetryPolicy.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of PutRecords calls made for one fan-out, including the first.
+	MaxAttempts int
+	// BaseDelay is the backoff ceiling after the first throttled attempt. It doubles on every further attempt.
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff ceiling.
+	MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is used by PutRecord and fills in any zero field of a caller's RetryPolicy.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   50 * time.Millisecond,
+	MaxDelay:    2 * time.Second,
+}
+
+// withDefaults returns p with every zero field taken from DefaultRetryPolicy.
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = DefaultRetryPolicy.BaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = DefaultRetryPolicy.MaxDelay
+	}
+	return p
+}
+
+// backoff returns a delay drawn uniformly from zero up to the ceiling for the given attempt ("full jitter").
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.BaseDelay
+	for i := 1; i < attempt && ceiling < p.MaxDelay; i++ {
+		ceiling *= 2
+	}
+	if ceiling > p.MaxDelay {
+		ceiling = p.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// sleep is swapped out by tests so that backoff does not slow them down.
+var sleep = time.Sleep
+
+// ShardFailure describes a shard that never accepted a fanned-out record.
+type ShardFailure struct {
+	ShardID         string
+	ExplicitHashKey string
+	ErrorCode       string
+	ErrorMessage    string
+}
+
+// PutRecordResult is the outcome of sending one record to every shard in a stream.
+type PutRecordResult struct {
+	// Delivered holds the result entry of every shard that accepted the record.
+	Delivered []*kinesis.PutRecordsResultEntry
+	// Failed lists the shards that still rejected the record once the retry budget was spent.
+	Failed []*ShardFailure
+	// Attempts is the number of PutRecords calls that carried entries of the record.
+	Attempts int
+}
+
+// putRecordsWithRetry sends input, split into as many requests as needed, and re-sends the entries that
+// PutRecords rejected until all of them are accepted or the policy's attempt budget is spent. Rejected entries
+// are traced back to their shard through the explicit hash key they were addressed with. So that each shard still
+// receives the entries in order, those that followed a rejected entry to the same shard are re-sent along with it
+// even when they were accepted, which may duplicate them.
+//
+// The entries may carry several messages: owners[i] is the index of the message that input.Records[i] belongs
+// to, and one PutRecordResult is returned for each of the given number of messages. A nil owners means every
+// entry carries message 0.
+func putRecordsWithRetry(c kinesisPubSub, input *kinesis.PutRecordsInput, owners []int, messages int, shardIDs map[string]string, opts *Options) ([]*PutRecordResult, error) {
+	policy := opts.Retry.withDefaults()
+	if owners == nil {
+		owners = make([]int, len(input.Records))
+	}
+	results := make([]*PutRecordResult, messages)
+	for i := range results {
+		results[i] = &PutRecordResult{}
+	}
+
+	// pending holds the indexes into input.Records of the entries still to be sent.
+	pending := make([]int, len(input.Records))
+	for i := range pending {
+		pending[i] = i
+	}
+	for attempt := 1; len(pending) > 0; attempt++ {
+		// Only the messages with entries in this call count it as an attempt.
+		counted := make(map[int]bool)
+		for _, p := range pending {
+			if !counted[owners[p]] {
+				counted[owners[p]] = true
+				results[owners[p]].Attempts++
+			}
+		}
+		entries := make([]*kinesis.PutRecordsRequestEntry, len(pending))
+		for i, p := range pending {
+			entries[i] = input.Records[p]
+		}
+		var out *kinesis.PutRecordsOutput
+		err := opts.takeCapacity(*input.StreamName, entries, shardIDs)
+		if err == nil {
+			out, err = putRecordsChunked(c, &kinesis.PutRecordsInput{Records: entries, StreamName: input.StreamName}, opts.concurrency())
+		}
+		if err != nil {
+			for _, p := range pending {
+				r := results[owners[p]]
+				r.Failed = append(r.Failed, shardFailure(input.Records[p], shardIDs, "", err.Error()))
+			}
+			return results, err
+		}
+
+		var retry []int
+		var failed []*ShardFailure
+		throttled := false
+		// blocked holds the explicit hash keys of the shards that rejected an entry of this call.
+		blocked := make(map[string]bool)
+		last := attempt >= policy.MaxAttempts
+		for i, r := range out.Records {
+			p := pending[i]
+			key := ""
+			if e := input.Records[p].ExplicitHashKey; e != nil {
+				key = *e
+			}
+			if r.ErrorCode == nil {
+				if !blocked[key] || last {
+					results[owners[p]].Delivered = append(results[owners[p]].Delivered, r)
+					continue
+				}
+				// The entry overtook a rejected one, so it is sent again behind it.
+				retry = append(retry, p)
+				failed = append(failed, nil)
+				continue
+			}
+			if *r.ErrorCode == errThroughputExceeded {
+				throttled = true
+			}
+			var msg string
+			if r.ErrorMessage != nil {
+				msg = *r.ErrorMessage
+			}
+			blocked[key] = true
+			retry = append(retry, p)
+			failed = append(failed, shardFailure(input.Records[p], shardIDs, *r.ErrorCode, msg))
+		}
+
+		if len(retry) > 0 && last {
+			for i, p := range retry {
+				r := results[owners[p]]
+				r.Failed = append(r.Failed, failed[i])
+			}
+			return results, ErrPartialFailure
+		}
+		if throttled {
+			sleep(policy.backoff(attempt))
+		}
+		pending = retry
+	}
+	return results, nil
+}
+
+// shardFailure builds the ShardFailure for a request entry that was not accepted.
+func shardFailure(e *kinesis.PutRecordsRequestEntry, shardIDs map[string]string, code, msg string) *ShardFailure {
+	f := &ShardFailure{ErrorCode: code, ErrorMessage: msg}
+	if e.ExplicitHashKey != nil {
+		f.ExplicitHashKey = *e.ExplicitHashKey
+		f.ShardID = shardIDs[f.ExplicitHashKey]
+	}
+	return f
+}
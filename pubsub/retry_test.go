@@ -0,0 +1,255 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"github.com/brettcannon/kinesis-experiment/kinesisfake"
+	"github.com/brettcannon/kinesis-experiment/kinesisfault"
+	"testing"
+	"time"
+)
+
+// kinesisPutRecordsScript answers each PutRecords call by looking up the error code for every entry's explicit
+// hash key in the next element of Codes. Missing keys succeed.
+type kinesisPutRecordsScript struct {
+	kinesisDescribeStreamMock
+	Codes  []map[string]string
+	Inputs []*kinesis.PutRecordsInput
+	Err    error
+}
+
+func (c *kinesisPutRecordsScript) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	c.Inputs = append(c.Inputs, input)
+	if c.Err != nil {
+		return nil, c.Err
+	}
+	var codes map[string]string
+	if n := len(c.Inputs) - 1; n < len(c.Codes) {
+		codes = c.Codes[n]
+	}
+	var out kinesis.PutRecordsOutput
+	var failed int64
+	for _, e := range input.Records {
+		r := &kinesis.PutRecordsResultEntry{}
+		if code, ok := codes[*e.ExplicitHashKey]; ok {
+			msg := "simulated " + code
+			r.ErrorCode = &code
+			r.ErrorMessage = &msg
+			failed++
+		} else {
+			seq := "1"
+			r.SequenceNumber = &seq
+		}
+		out.Records = append(out.Records, r)
+	}
+	out.FailedRecordCount = &failed
+	return &out, nil
+}
+
+func stubSleep() *[]time.Duration {
+	var slept []time.Duration
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+	return &slept
+}
+
+func restoreSleep() {
+	sleep = time.Sleep
+}
+
+func fanOutInput(keys ...string) *kinesis.PutRecordsInput {
+	s := "stream name"
+	var records []*kinesis.PutRecordsRequestEntry
+	for i := range keys {
+		records = append(records, &kinesis.PutRecordsRequestEntry{Data: []byte("blob payload"), ExplicitHashKey: &keys[i]})
+	}
+	return &kinesis.PutRecordsInput{Records: records, StreamName: &s}
+}
+
+func TestPutRecordsWithRetryResendsOnlyFailed(t *testing.T) {
+	slept := stubSleep()
+	defer restoreSleep()
+	c := kinesisPutRecordsScript{Codes: []map[string]string{
+		{"2": errThroughputExceeded},
+		{},
+	}}
+	ids := map[string]string{"1": "shard ID 1", "2": "shard ID 2", "3": "shard ID 3"}
+	results, err := putRecordsWithRetry(&c, fanOutInput("1", "2", "3"), nil, 1, ids, &Options{})
+	result := results[0]
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if result.Attempts != 2 {
+		t.Errorf("expected 2 attempts, was %d", result.Attempts)
+	}
+	if len(result.Delivered) != 3 || len(result.Failed) != 0 {
+		t.Errorf("expected 3 delivered and 0 failed, was %d and %d", len(result.Delivered), len(result.Failed))
+	}
+	retried := c.Inputs[1].Records
+	if len(retried) != 1 || *retried[0].ExplicitHashKey != "2" {
+		t.Errorf("expected only key 2 to be re-sent, was %v", retried)
+	}
+	if len(*slept) != 1 {
+		t.Errorf("expected one backoff, was %v", *slept)
+	}
+}
+
+func TestPutRecordsWithRetryNoBackoffWithoutThrottling(t *testing.T) {
+	slept := stubSleep()
+	defer restoreSleep()
+	c := kinesisPutRecordsScript{Codes: []map[string]string{{"1": "InternalFailure"}}}
+	if _, err := putRecordsWithRetry(&c, fanOutInput("1"), nil, 1, nil, &Options{}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(*slept) != 0 {
+		t.Errorf("expected no backoff, was %v", *slept)
+	}
+}
+
+func TestPutRecordsWithRetryBudget(t *testing.T) {
+	stubSleep()
+	defer restoreSleep()
+	always := map[string]string{"2": errThroughputExceeded}
+	c := kinesisPutRecordsScript{Codes: []map[string]string{always, always, always, always}}
+	ids := map[string]string{"1": "shard ID 1", "2": "shard ID 2"}
+	results, err := putRecordsWithRetry(&c, fanOutInput("1", "2"), nil, 1, ids, &Options{Retry: RetryPolicy{MaxAttempts: 3}})
+	result := results[0]
+	if err != ErrPartialFailure {
+		t.Errorf("expected error %v, was %v", ErrPartialFailure, err)
+	}
+	if len(c.Inputs) != 3 || result.Attempts != 3 {
+		t.Errorf("expected 3 attempts, was %d calls and %d attempts", len(c.Inputs), result.Attempts)
+	}
+	if len(result.Failed) != 1 {
+		t.Fatalf("expected 1 failure, was %v", result.Failed)
+	}
+	f := result.Failed[0]
+	if f.ShardID != "shard ID 2" || f.ExplicitHashKey != "2" || f.ErrorCode != errThroughputExceeded {
+		t.Errorf("unexpected failure %+v", *f)
+	}
+}
+
+func TestPutRecordsWithRetryCallError(t *testing.T) {
+	simulated := errors.New("simulated PutRecords error")
+	c := kinesisPutRecordsScript{Err: simulated}
+	ids := map[string]string{"1": "shard ID 1"}
+	results, err := putRecordsWithRetry(&c, fanOutInput("1"), nil, 1, ids, &Options{})
+	result := results[0]
+	if err != simulated {
+		t.Errorf("expected error %v, was %v", simulated, err)
+	}
+	if len(result.Failed) != 1 || result.Failed[0].ShardID != "shard ID 1" {
+		t.Errorf("expected shard ID 1 to be reported as failed, was %v", result.Failed)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{BaseDelay: 10 * time.Millisecond, MaxDelay: 35 * time.Millisecond}.withDefaults()
+	tests := []struct {
+		attempt int
+		ceiling time.Duration
+	}{
+		{1, 10 * time.Millisecond},
+		{2, 20 * time.Millisecond},
+		{3, 35 * time.Millisecond},
+		{10, 35 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if d := p.backoff(tt.attempt); d < 0 || d > tt.ceiling {
+				t.Errorf("backoff(%d) == %v, want within [0, %v]", tt.attempt, d, tt.ceiling)
+			}
+		}
+	}
+}
+
+func TestPutRecordReportsFailedShards(t *testing.T) {
+	stubSleep()
+	defer restoreSleep()
+	id1 := "shard ID 1"
+	id2 := "shard ID 2"
+	k1 := "100"
+	k2 := "200"
+	s1 := kinesis.Shard{ShardID: &id1, HashKeyRange: &kinesis.HashKeyRange{StartingHashKey: &k1, EndingHashKey: &k1}}
+	s2 := kinesis.Shard{ShardID: &id2, HashKeyRange: &kinesis.HashKeyRange{StartingHashKey: &k2, EndingHashKey: &k2}}
+	var c kinesisPutRecordsScript
+	c.Shards = [][]*kinesis.Shard{{&s1, &s2}}
+	for i := 0; i < DefaultRetryPolicy.MaxAttempts; i++ {
+		c.Codes = append(c.Codes, map[string]string{k2: errThroughputExceeded})
+	}
+	stream := "stream name"
+	result, err := PutRecord(&c, &kinesis.PutRecordInput{Data: []byte("blob payload"), StreamName: &stream})
+	if err != ErrPartialFailure {
+		t.Errorf("expected error %v, was %v", ErrPartialFailure, err)
+	}
+	if len(result.Failed) != 1 || result.Failed[0].ShardID != id2 {
+		t.Errorf("expected %s to be reported as failed, was %v", id2, result.Failed)
+	}
+}
+
+// TestPutRecordThroughInjectedFailures fans a record out through a Kinesis whose PutRecords entries fail at
+// random, and checks that retrying delivers it to every shard exactly once.
+func TestPutRecordThroughInjectedFailures(t *testing.T) {
+	defer restoreSleep()
+	stubSleep()
+	k := kinesisfake.New()
+	if _, err := k.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String("s"), ShardCount: aws.Long(8)}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	in := kinesisfault.New(kinesisfault.Config{Seed: 1, FailEntry: 0.4})
+	opts := &Options{Retry: RetryPolicy{MaxAttempts: 20}}
+	result, err := PutRecordWithOptions(in.Wrap(k), &kinesis.PutRecordInput{StreamName: aws.String("s"), Data: []byte("x")}, opts)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(result.Delivered) != 8 || len(result.Failed) != 0 || result.Attempts < 2 {
+		t.Errorf("expected delivery to all 8 shards after retries, was %d delivered, %d failed in %d attempts", len(result.Delivered), len(result.Failed), result.Attempts)
+	}
+	if in.Stats().FailedEntries == 0 {
+		t.Errorf("expected entries to have failed")
+	}
+	shards, err := gatherShards(k, aws.String("s"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for _, shard := range shards {
+		it, err := k.GetShardIterator(&kinesis.GetShardIteratorInput{StreamName: aws.String("s"), ShardID: shard.ShardID, ShardIteratorType: aws.String("TRIM_HORIZON")})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		out, err := k.GetRecords(&kinesis.GetRecordsInput{ShardIterator: it.ShardIterator})
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if len(out.Records) != 1 {
+			t.Errorf("expected shard %s to hold the record once, held %d records", *shard.ShardID, len(out.Records))
+		}
+	}
+}
+
+// TestPutRecordReplaysPagesAndThrottling replays a fan-out to a stream whose DescribeStream output spans two pages
+// and lists a closed parent, and whose first PutRecords throttles one of the two open shards.
+func TestPutRecordReplaysPagesAndThrottling(t *testing.T) {
+	defer restoreSleep()
+	stubSleep()
+	c, p := replay(t, "put-record-paginated-throttled.json")
+	input := &kinesis.PutRecordInput{StreamName: aws.String("events"), PartitionKey: aws.String("user-42"), Data: []byte("hello")}
+	result, err := PutRecord(c, input)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if result.Attempts != 2 || len(result.Failed) != 0 {
+		t.Errorf("expected delivery on the second attempt, was %d attempts with %d failures", result.Attempts, len(result.Failed))
+	}
+	var delivered []string
+	for _, r := range result.Delivered {
+		delivered = append(delivered, *r.ShardID)
+	}
+	if fmt.Sprint(delivered) != "[shardId-000000000001 shardId-000000000002]" {
+		t.Errorf("expected delivery to both open shards, was %v", delivered)
+	}
+	if err := p.Check(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package pubsub
+
+import (
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"sort"
+	"time"
+)
+
+// StartPosition is where reading a shard begins when there is no checkpoint to resume from. The zero value is
+// Latest.
+type StartPosition struct {
+	iteratorType   string
+	sequenceNumber string
+	timestamp      time.Time
+}
+
+var (
+	// Latest starts with the records added to the shard from now on.
+	Latest = StartPosition{iteratorType: "LATEST"}
+	// TrimHorizon starts with the oldest record the shard still holds.
+	TrimHorizon = StartPosition{iteratorType: "TRIM_HORIZON"}
+)
+
+// AtSequenceNumber starts with the record of the given sequence number.
+func AtSequenceNumber(seq string) StartPosition {
+	return StartPosition{iteratorType: "AT_SEQUENCE_NUMBER", sequenceNumber: seq}
+}
+
+// AfterSequenceNumber starts with the record following the given sequence number.
+func AfterSequenceNumber(seq string) StartPosition {
+	return StartPosition{iteratorType: "AFTER_SEQUENCE_NUMBER", sequenceNumber: seq}
+}
+
+// AtTimestamp starts with the first message published at or after t, so that a shard can be replayed from a
+// point in time. The SDK cannot ask Kinesis for a position by time, so the shard is read from its trim horizon in
+// pages as large as Kinesis allows, and the page holding the first message published at or after t is binary
+// searched by the publish time in the envelopes of its records. Only sequence numbers Kinesis returned are ever
+// read from. The search assumes messages were published in the order they were stored, which only holds to
+// within the clock skew between publishers, and passes over records without an envelope as they carry no
+// publish time. It costs a GetShardIterator call and a GetRecords call for every 10000 records stored before t,
+// spaced to stay under the 5 reads a second a shard allows.
+//
+// A Subscription whose shard holds nothing from before t moves back to the shard it was split or merged from,
+// as long as the stream still lists it, and follows the stream through the reshard from there.
+func AtTimestamp(t time.Time) StartPosition {
+	return StartPosition{timestamp: t}
+}
+
+// String describes the position as its Kinesis iterator type, followed by the sequence number or time.
+func (p StartPosition) String() string {
+	switch {
+	case !p.timestamp.IsZero():
+		return "AT_TIMESTAMP " + p.timestamp.Format(time.RFC3339Nano)
+	case p.sequenceNumber != "":
+		return p.iteratorType + " " + p.sequenceNumber
+	case p.iteratorType == "":
+		return Latest.iteratorType
+	}
+	return p.iteratorType
+}
+
+// bySequenceNumber reports whether the position names a sequence number, which only exists in one shard.
+func (p StartPosition) bySequenceNumber() bool {
+	return p.sequenceNumber != ""
+}
+
+// iteratorInput fills the position into the input of GetShardIterator.
+func (p StartPosition) iteratorInput(input *kinesis.GetShardIteratorInput) {
+	if p.iteratorType == "" {
+		p = Latest
+	}
+	input.ShardIteratorType = aws.String(p.iteratorType)
+	if p.sequenceNumber != "" {
+		input.StartingSequenceNumber = aws.String(p.sequenceNumber)
+	}
+}
+
+// Bounds of the reads made while searching a shard by time.
+const (
+	// seekLimit is the number of records each read returns, the most Kinesis allows.
+	seekLimit = 10000
+	// seekInterval spaces the reads so that they stay under the 5 reads a second Kinesis allows a shard.
+	seekInterval = time.Second / 5
+	// seekEmptyReads is the number of reads in a row returning no record after which an open shard is taken to
+	// have been read to its tip.
+	seekEmptyReads = 3
+)
+
+// seekTimestamp turns an AtTimestamp position into one by sequence number for the shard. It returns TrimHorizon
+// when the shard holds no record from before at.
+func seekTimestamp(c kinesisSubscribe, stream, shardID string, at time.Time) (StartPosition, error) {
+	out, err := c.GetShardIterator(&kinesis.GetShardIteratorInput{
+		ShardID:           &shardID,
+		ShardIteratorType: aws.String(TrimHorizon.iteratorType),
+		StreamName:        &stream,
+	})
+	if err != nil {
+		return StartPosition{}, err
+	}
+	limit := int64(seekLimit)
+	// before is the sequence number of the last record read that was not published at or after at.
+	var before string
+	iterator := out.ShardIterator
+	for reads, empty := 0, 0; iterator != nil && empty < seekEmptyReads; reads++ {
+		if reads > 0 {
+			sleep(seekInterval)
+		}
+		records, err := c.GetRecords(&kinesis.GetRecordsInput{ShardIterator: iterator, Limit: &limit})
+		if err != nil {
+			return StartPosition{}, err
+		}
+		iterator = records.NextShardIterator
+		users := DeaggregateRecords(records.Records)
+		if len(users) == 0 {
+			empty++
+			continue
+		}
+		empty = 0
+		if i := searchPublished(users, at); i < len(users) {
+			switch {
+			case i > 0:
+				before = users[i-1].SequenceNumber
+			case before == "":
+				return TrimHorizon, nil
+			}
+			return AtSequenceNumber(users[i].SequenceNumber), nil
+		}
+		before = users[len(users)-1].SequenceNumber
+	}
+	if before == "" {
+		return TrimHorizon, nil
+	}
+	return AfterSequenceNumber(before), nil
+}
+
+// searchPublished returns the index of the first message in users published at or after at, or len(users) if
+// there is none. Records without a publish time are passed over.
+func searchPublished(users []*UserRecord, at time.Time) int {
+	var timed []int
+	var published []time.Time
+	for i, u := range users {
+		if m, err := Unwrap(u.Data); err == nil && m.Enveloped && !m.PublishedAt.IsZero() {
+			timed = append(timed, i)
+			published = append(published, m.PublishedAt)
+		}
+	}
+	j := sort.Search(len(timed), func(j int) bool { return !published[j].Before(at) })
+	if j == len(timed) {
+		return len(users)
+	}
+	return timed[j]
+}
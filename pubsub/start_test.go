@@ -0,0 +1,277 @@
+package pubsub
+
+import (
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"math/big"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStartPositionIteratorInput(t *testing.T) {
+	at := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		position StartPosition
+		want     string
+		str      string
+	}{
+		{StartPosition{}, "LATEST", "LATEST"},
+		{Latest, "LATEST", "LATEST"},
+		{TrimHorizon, "TRIM_HORIZON", "TRIM_HORIZON"},
+		{AtSequenceNumber("7"), "AT_SEQUENCE_NUMBER 7", "AT_SEQUENCE_NUMBER 7"},
+		{AfterSequenceNumber("7"), "AFTER_SEQUENCE_NUMBER 7", "AFTER_SEQUENCE_NUMBER 7"},
+		{AtTimestamp(at), "", "AT_TIMESTAMP 2015-06-01T12:00:00Z"},
+	}
+	for _, test := range tests {
+		if got := test.position.String(); got != test.str {
+			t.Errorf("expected %s, was %s", test.str, got)
+		}
+		if test.want == "" {
+			continue
+		}
+		var input kinesis.GetShardIteratorInput
+		test.position.iteratorInput(&input)
+		got := *input.ShardIteratorType
+		if input.StartingSequenceNumber != nil {
+			got += " " + *input.StartingSequenceNumber
+		}
+		if got != test.want {
+			t.Errorf("%s: expected iterator %s, was %s", test.str, test.want, got)
+		}
+	}
+}
+
+func TestSubscribeStartPositions(t *testing.T) {
+	tests := []struct {
+		start StartPosition
+		want  string
+	}{
+		{TrimHorizon, "[0 1 2 3 4]"},
+		{AtSequenceNumber("2"), "[2 3 4]"},
+		{AfterSequenceNumber("2"), "[3 4]"},
+	}
+	for _, test := range tests {
+		c := relayMock("in 1")
+		for i := 0; i < 5; i++ {
+			c.Add("in 1", fmt.Sprint(i))
+		}
+		s, err := Subscribe(c, "in", &SubscribeOptions{ShardID: "in 1", Start: test.start, PollInterval: time.Millisecond})
+		if err != nil {
+			t.Fatalf("%s: unexpected error %v", test.start, err)
+		}
+		var got []string
+		for _, m := range receive(t, s, len(test.want)/2) {
+			got = append(got, string(m.Data))
+		}
+		s.Close()
+		if fmt.Sprint(got) != test.want {
+			t.Errorf("%s: expected %s, was %v", test.start, test.want, got)
+		}
+	}
+
+	if _, err := Subscribe(relayMock("in 1"), "in", &SubscribeOptions{Start: AtSequenceNumber("2")}); err == nil {
+		t.Error("expected an error starting at a sequence number without a shard ID, was nil")
+	}
+}
+
+// timedMock returns a mock whose shard "in 1" holds n messages published a minute apart from base, with a raw
+// record after every third one.
+func timedMock(base time.Time, n int) *kinesisRelayMock {
+	c := relayMock("in 1")
+	for i := 0; i < n; i++ {
+		data, _ := Wrap(&Message{ID: fmt.Sprint("m", i), PublishedAt: base.Add(time.Duration(i) * time.Minute), Data: []byte(fmt.Sprint(i))})
+		c.Add("in 1", string(data))
+		if i%3 == 2 {
+			c.Add("in 1", "raw")
+		}
+	}
+	return c
+}
+
+func TestSeekTimestamp(t *testing.T) {
+	stubSleep()
+	defer restoreSleep()
+	base := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	// Messages 0 to 9 are at sequence numbers 0 1 2 4 5 6 8 9 10 12, with raw records at 3, 7 and 11.
+	tests := []struct {
+		name   string
+		at     time.Time
+		closed bool
+		want   string
+	}{
+		{"first", base, false, "TRIM_HORIZON"},
+		{"before all", base.Add(-time.Hour), false, "TRIM_HORIZON"},
+		{"second", base.Add(time.Minute), false, "AT_SEQUENCE_NUMBER 1"},
+		{"exact", base.Add(4 * time.Minute), false, "AT_SEQUENCE_NUMBER 5"},
+		{"between", base.Add(4*time.Minute + time.Second), false, "AT_SEQUENCE_NUMBER 6"},
+		{"after a raw record", base.Add(3 * time.Minute), false, "AT_SEQUENCE_NUMBER 4"},
+		{"last", base.Add(9 * time.Minute), false, "AT_SEQUENCE_NUMBER 12"},
+		{"after all", base.Add(time.Hour), false, "AFTER_SEQUENCE_NUMBER 12"},
+		{"closed", base.Add(4 * time.Minute), true, "AT_SEQUENCE_NUMBER 5"},
+		{"closed after all", base.Add(time.Hour), true, "AFTER_SEQUENCE_NUMBER 12"},
+	}
+	for _, test := range tests {
+		for _, pageSize := range []int{0, 4} {
+			c := timedMock(base, 10)
+			c.PageSize = pageSize
+			if test.closed {
+				c.Reshard("in 2", "in 1")
+			}
+			p, err := seekTimestamp(c, "in", "in 1", test.at)
+			if err != nil {
+				t.Fatalf("%s: unexpected error %v", test.name, err)
+			}
+			if p.String() != test.want {
+				t.Errorf("%s, %d records a read: expected %s, was %s", test.name, pageSize, test.want, p)
+			}
+		}
+	}
+
+	p, err := seekTimestamp(relayMock("in 1"), "in", "in 1", base)
+	if err != nil || p != TrimHorizon {
+		t.Errorf("expected an empty shard to be read from its start, was %s, %v", p, err)
+	}
+}
+
+// sparseSeq is the sequence number of the record at pos in a sparseMock shard: like those of Kinesis, 56 digits
+// long and far apart.
+func sparseSeq(pos int) string {
+	seq, _ := new(big.Int).SetString("49546986683135544286507457936321625675700192471156785154", 10)
+	gap, _ := new(big.Int).SetString("1000000000000000000000037", 10)
+	return seq.Add(seq, gap.Mul(gap, big.NewInt(int64(pos)))).String()
+}
+
+// kinesisSparseMock serves a kinesisRelayMock with sequence numbers made by sparseSeq. Like Kinesis, it rejects
+// iterators at sequence numbers it never returned.
+type kinesisSparseMock struct {
+	*kinesisRelayMock
+}
+
+func (c kinesisSparseMock) DescribeStream(input *kinesis.DescribeStreamInput) (*kinesis.DescribeStreamOutput, error) {
+	out, err := c.kinesisRelayMock.DescribeStream(input)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range out.StreamDescription.Shards {
+		if r := s.SequenceNumberRange; r != nil {
+			r.StartingSequenceNumber = aws.String(sparseSeq(0))
+			if r.EndingSequenceNumber != nil {
+				end, _ := strconv.Atoi(*r.EndingSequenceNumber)
+				r.EndingSequenceNumber = aws.String(sparseSeq(end))
+			}
+		}
+	}
+	return out, nil
+}
+
+func (c kinesisSparseMock) GetShardIterator(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	in := *input
+	if input.StartingSequenceNumber != nil {
+		pos := -1
+		c.lock.Lock()
+		for i := range c.In[*input.ShardID] {
+			if sparseSeq(i) == *input.StartingSequenceNumber {
+				pos = i
+			}
+		}
+		c.lock.Unlock()
+		if pos < 0 {
+			return nil, aws.APIError{Code: "InvalidArgumentException", Message: "unknown sequence number " + *input.StartingSequenceNumber}
+		}
+		in.StartingSequenceNumber = aws.String(strconv.Itoa(pos))
+	}
+	return c.kinesisRelayMock.GetShardIterator(&in)
+}
+
+func (c kinesisSparseMock) GetRecords(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	out, err := c.kinesisRelayMock.GetRecords(input)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range out.Records {
+		pos, _ := strconv.Atoi(*r.SequenceNumber)
+		r.SequenceNumber = aws.String(sparseSeq(pos))
+	}
+	return out, nil
+}
+
+func TestSeekTimestampSparseSequenceNumbers(t *testing.T) {
+	stubSleep()
+	defer restoreSleep()
+	base := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := kinesisSparseMock{timedMock(base, 100)}
+	c.PageSize = 10
+	p, err := seekTimestamp(c, "in", "in 1", base.Add(40*time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// Message 40 follows 13 raw records.
+	if want := "AT_SEQUENCE_NUMBER " + sparseSeq(53); p.String() != want {
+		t.Errorf("expected %s, was %s", want, p)
+	}
+	if n := len(c.iterators()); n != 1 {
+		t.Errorf("expected a single GetShardIterator call, was %d", n)
+	}
+	if c.Reads != 6 {
+		t.Errorf("expected to read up to message 40 in 6 reads, was %d", c.Reads)
+	}
+
+	s, err := Subscribe(c, "in", &SubscribeOptions{Start: AtTimestamp(base.Add(98 * time.Minute)), PollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer s.Close()
+	var got []string
+	for _, m := range receive(t, s, 2) {
+		got = append(got, string(m.Data))
+	}
+	if fmt.Sprint(got) != "[98 raw]" {
+		t.Errorf("expected to replay from message 98, was %v", got)
+	}
+}
+
+func TestSubscribeAtTimestamp(t *testing.T) {
+	stubSleep()
+	defer restoreSleep()
+	base := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := timedMock(base, 10)
+	s, err := Subscribe(c, "in", &SubscribeOptions{Start: AtTimestamp(base.Add(7 * time.Minute)), PollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer s.Close()
+	var got []string
+	for _, m := range receive(t, s, 4) {
+		got = append(got, string(m.Data))
+	}
+	if fmt.Sprint(got) != "[7 8 raw 9]" {
+		t.Errorf("expected to replay from message 7, was %v", got)
+	}
+}
+
+func TestSubscribeAtTimestampBeforeReshard(t *testing.T) {
+	stubSleep()
+	defer restoreSleep()
+	base := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := timedMock(base, 10)
+	c.Reshard("in 2", "in 1")
+	c.Reshard("in 3", "in 2")
+	for i := 10; i < 12; i++ {
+		data, _ := Wrap(&Message{ID: fmt.Sprint("m", i), PublishedAt: base.Add(time.Duration(i) * time.Minute), Data: []byte(fmt.Sprint(i))})
+		c.Add("in 3", string(data))
+	}
+	s, err := Subscribe(c, "in", &SubscribeOptions{Start: AtTimestamp(base.Add(8 * time.Minute)), PollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer s.Close()
+	var got []string
+	for _, m := range receive(t, s, 5) {
+		got = append(got, string(m.Data))
+	}
+	if fmt.Sprint(got) != "[8 raw 9 10 11]" {
+		t.Errorf("expected to replay from message 8 of the grandparent shard, was %v", got)
+	}
+}
@@ -0,0 +1,354 @@
+package pubsub
+
+import (
+	"errors"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// errorBufferSize is the number of errors a Subscription holds for a reader that is not keeping up.
+const errorBufferSize = 16
+
+var (
+	// ErrNoChildShards is reported by a Subscription that has read a closed shard to its end but cannot find the
+	// shards it was resharded into. It keeps looking for them.
+	ErrNoChildShards = errors.New("closed shard has no child shards")
+	// ErrNoOpenShards is returned by Subscribe when the stream has no open shard to pick.
+	ErrNoOpenShards = errors.New("stream has no open shards")
+)
+
+// SubscribeOptions tunes a Subscription. Zero values select the defaults.
+type SubscribeOptions struct {
+	// ShardID is the shard to read. Every shard of a broadcast stream carries every message, so by default an
+	// open shard is picked at random, spreading subscribers across the stream's read capacity.
+	ShardID string
+	// Start is where reading begins when there is no checkpoint to resume from. It defaults to Latest. A
+	// position by sequence number needs ShardID, as sequence numbers belong to a single shard.
+	Start StartPosition
+	// PollInterval is the time between two reads of the shard.
+	PollInterval time.Duration
+	// Limit caps the number of records a single read returns; zero leaves it to Kinesis.
+	Limit int64
+	// Retry sets the backoff between failed reads. Its MaxAttempts is ignored, as reads are retried until the
+	// subscription is closed.
+	Retry RetryPolicy
+	// Dedup, when set, drops the messages it has seen before, such as those read again after following the
+	// shard through a reshard. Share one between the subscriptions of a consumer that reads several shards.
+	Dedup Deduplicator
+	// Checkpoints, when set, records the last record whose messages have all been received, and the
+	// subscription resumes after it when made again.
+	Checkpoints CheckpointStore
+	// Clock is the time source used to age shard iterators; nil uses the system clock.
+	Clock Clock
+}
+
+// Subscription streams the messages broadcast to one shard of a stream. Aggregated records are unpacked and
+// envelopes are decoded, so every Message holds a single payload along with its position in the shard.
+//
+// When the shard is closed by SplitShard or MergeShards, the subscription reads it to its end and carries on from
+// the start of a shard created from it. Every shard of a broadcast stream carries every message, so one child is
+// enough; it is picked at random after a split.
+//
+// Every subscriber receives every message. Use a Group instead to split the shards of a stream between consumers.
+type Subscription struct {
+	c        kinesisSubscribe
+	mu       sync.Mutex
+	reader   *shardReader
+	opts     SubscribeOptions
+	messages chan *Message
+	errors   chan error
+	// follows is set when the subscription moves on to a child shard at the end of a closed one. Otherwise it
+	// checkpoints the shard at ShardEnd and ends.
+	follows bool
+	// rewinding is set while a start by time has yet to be searched for through the ancestors of the shard.
+	rewinding bool
+	// handle, when set, is given each message instead of Messages, and the error unwrapping a record that cannot
+	// be decoded along with a message holding its raw data. It returns false if it gave up because closing was
+	// closed.
+	handle func(m *Message, err error, closing <-chan struct{}) bool
+
+	closeOnce sync.Once
+	closing   chan struct{}
+	done      chan struct{}
+}
+
+// Subscribe starts reading messages from a shard of stream, beginning after its checkpoint or, without one, at
+// opts.Start. Read failures are reported on Errors and retried with backoff.
+func Subscribe(c kinesisSubscribe, stream string, opts *SubscribeOptions) (*Subscription, error) {
+	return subscribe(c, stream, opts, nil)
+}
+
+// subscribe is Subscribe handing messages to handle, when set, rather than to Messages.
+func subscribe(c kinesisSubscribe, stream string, opts *SubscribeOptions, handle func(*Message, error, <-chan struct{}) bool) (*Subscription, error) {
+	var o SubscribeOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = DefaultPollInterval
+	}
+	o.Retry = o.Retry.withDefaults()
+	shardID := o.ShardID
+	if shardID == "" && o.Start.bySequenceNumber() {
+		return nil, errors.New("start position by sequence number needs a shard ID")
+	}
+	if shardID == "" {
+		shards, err := gatherShards(c, &stream)
+		if err != nil {
+			return nil, err
+		}
+		open := openShards(shards)
+		if len(open) == 0 {
+			return nil, ErrNoOpenShards
+		}
+		shardID = *open[rand.Intn(len(open))].ShardID
+	}
+	r := &shardReader{c: c, stream: stream, shardID: shardID, limit: o.Limit, clock: o.Clock, start: o.Start}
+	if err := r.resume(o.Checkpoints); err != nil {
+		return nil, err
+	}
+	s := newSubscription(c, r, o, true)
+	s.rewinding = !o.Start.timestamp.IsZero() && r.last == nil && !r.closed
+	s.handle = handle
+	go s.run()
+	return s, nil
+}
+
+func newSubscription(c kinesisSubscribe, r *shardReader, o SubscribeOptions, follows bool) *Subscription {
+	return &Subscription{
+		c:        c,
+		reader:   r,
+		opts:     o,
+		follows:  follows,
+		messages: make(chan *Message),
+		errors:   make(chan error, errorBufferSize),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// ShardID is the shard the subscription is reading.
+func (s *Subscription) ShardID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reader.shardID
+}
+
+// Messages delivers the messages of the shard in order. It is closed when the subscription ends.
+func (s *Subscription) Messages() <-chan *Message {
+	return s.messages
+}
+
+// Errors reports read and checkpoint failures. Errors that find the channel full are dropped. It is closed when
+// the subscription ends.
+func (s *Subscription) Errors() <-chan error {
+	return s.errors
+}
+
+// Close stops reading and closes both channels.
+func (s *Subscription) Close() error {
+	s.closeOnce.Do(func() { close(s.closing) })
+	<-s.done
+	return nil
+}
+
+// run reads the shard and its descendants until the subscription is closed.
+func (s *Subscription) run() {
+	defer close(s.done)
+	defer close(s.errors)
+	defer close(s.messages)
+	failures := 0
+	for {
+		if s.rewinding {
+			if err := s.rewind(); err != nil {
+				s.report(err)
+				failures++
+				if !s.wait(s.opts.Retry.backoff(failures)) {
+					return
+				}
+				continue
+			}
+		}
+		if s.reader.closed && !s.follows {
+			if err := s.checkpointEnd(); err != nil {
+				s.report(err)
+			}
+			return
+		}
+		if s.reader.closed {
+			if err := s.follow(); err != nil {
+				s.report(err)
+				if !s.wait(s.opts.PollInterval) {
+					return
+				}
+			}
+			continue
+		}
+		records, err := s.reader.read()
+		if err != nil {
+			s.report(err)
+			failures++
+			if !s.wait(s.opts.Retry.backoff(failures)) {
+				return
+			}
+			continue
+		}
+		failures = 0
+		if !s.deliver(records) {
+			return
+		}
+		if !s.reader.closed && !s.wait(s.opts.PollInterval) {
+			return
+		}
+	}
+}
+
+// deliver sends the messages held by records and checkpoints the last record once they have all been received.
+// It returns false if the subscription was closed first.
+func (s *Subscription) deliver(records []*kinesis.Record) bool {
+	if len(records) == 0 {
+		return true
+	}
+	for _, u := range DeaggregateRecords(records) {
+		m, err := Unwrap(u.Data)
+		if err != nil {
+			if s.handle == nil {
+				s.report(err)
+				continue
+			}
+			// The handler decides what becomes of a record that cannot be decoded, so it is not lost unseen.
+			m = &Message{Data: u.Data}
+		} else if s.opts.Dedup != nil && s.opts.Dedup.Seen(m) {
+			continue
+		}
+		m.ShardID = s.reader.shardID
+		m.SequenceNumber = u.SequenceNumber
+		m.SubSequenceNumber = u.SubSequenceNumber
+		if s.handle != nil {
+			if !s.handle(m, err, s.closing) {
+				return false
+			}
+			continue
+		}
+		select {
+		case s.messages <- m:
+		case <-s.closing:
+			return false
+		}
+	}
+	if s.opts.Checkpoints != nil {
+		if err := s.opts.Checkpoints.SetCheckpoint(s.reader.stream, s.reader.shardID, *s.reader.last); err != nil {
+			s.report(err)
+		}
+	}
+	return true
+}
+
+// rewind searches the shard for the start time and, for as long as the shard searched holds nothing from before
+// it, the shard it was split or merged from, then starts reading the last shard searched at the position found.
+// Shards the stream no longer lists are past its retention period, so the search stops short of them.
+func (s *Subscription) rewind() error {
+	r := s.reader
+	shards, err := gatherShards(s.c, &r.stream)
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]*kinesis.Shard, len(shards))
+	for _, sh := range shards {
+		listed[*sh.ShardID] = sh
+	}
+	id := r.shardID
+	for {
+		p, err := seekTimestamp(s.c, r.stream, id, r.start.timestamp)
+		if err != nil {
+			return err
+		}
+		var parent *kinesis.Shard
+		if sh := listed[id]; sh != nil && p == TrimHorizon {
+			for _, pid := range parentIDs(sh) {
+				if parent = listed[pid]; parent != nil {
+					break
+				}
+			}
+		}
+		if parent == nil {
+			start := &shardReader{c: s.c, stream: r.stream, shardID: id, limit: r.limit, clock: r.clock, start: p}
+			if id != r.shardID {
+				if err := start.resume(s.opts.Checkpoints); err != nil {
+					return err
+				}
+			}
+			s.mu.Lock()
+			s.reader = start
+			s.mu.Unlock()
+			s.rewinding = false
+			return nil
+		}
+		id = *parent.ShardID
+	}
+}
+
+// follow moves on from a shard read to its end to one of its children, read from the start or, when the
+// subscription starts at a time, from the first message published since.
+func (s *Subscription) follow() error {
+	r := s.reader
+	if err := s.checkpointEnd(); err != nil {
+		return err
+	}
+	shards, err := gatherShards(s.c, &r.stream)
+	if err != nil {
+		return err
+	}
+	children := childShards(shards, r.shardID)
+	if len(children) == 0 {
+		return ErrNoChildShards
+	}
+	child := &shardReader{
+		c:       s.c,
+		stream:  r.stream,
+		shardID: *children[rand.Intn(len(children))].ShardID,
+		limit:   r.limit,
+		clock:   r.clock,
+		start:   TrimHorizon,
+	}
+	if !s.opts.Start.timestamp.IsZero() {
+		child.start = s.opts.Start
+	}
+	if err := child.resume(s.opts.Checkpoints); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.reader = child
+	s.mu.Unlock()
+	return nil
+}
+
+// checkpointEnd records that the shard has been read to its end.
+func (s *Subscription) checkpointEnd() error {
+	if s.opts.Checkpoints == nil {
+		return nil
+	}
+	return s.opts.Checkpoints.SetCheckpoint(s.reader.stream, s.reader.shardID, ShardEnd)
+}
+
+// report hands err to Errors unless it is full.
+func (s *Subscription) report(err error) {
+	select {
+	case s.errors <- err:
+	default:
+	}
+}
+
+// wait pauses for d and returns false if the subscription was closed in the meantime.
+func (s *Subscription) wait(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-s.closing:
+		return false
+	}
+}
@@ -0,0 +1,200 @@
+package pubsub
+
+import (
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"github.com/brettcannon/kinesis-experiment/kinesisfake"
+	"github.com/brettcannon/kinesis-experiment/kinesisfault"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, s *Subscription, n int) []*Message {
+	var got []*Message
+	for len(got) < n {
+		select {
+		case m := <-s.Messages():
+			got = append(got, m)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after %d of %d messages", len(got), n)
+		}
+	}
+	return got
+}
+
+func TestSubscribeDecodesMessages(t *testing.T) {
+	c := relayMock("in 1")
+	s, err := Subscribe(c, "in", &SubscribeOptions{PollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer s.Close()
+	if s.ShardID() != "in 1" {
+		t.Errorf("expected to subscribe to the only shard, was %s", s.ShardID())
+	}
+	waitFor(t, "the shard to be read", func() bool { return len(c.iterators()) == 1 })
+
+	enveloped, _ := Wrap(&Message{ID: "enveloped", Data: []byte("a")})
+	b, _ := Wrap(&Message{ID: "aggregated", Data: []byte("b")})
+	aggregated, _ := Aggregate([]*UserRecord{{PartitionKey: "k", Data: b}, {PartitionKey: "k", Data: []byte("c")}}, maxRecordSize)
+	c.Add("in 1", string(enveloped))
+	c.Add("in 1", "raw")
+	c.Add("in 1", string(aggregated[0]))
+
+	got := receive(t, s, 4)
+	want := []struct {
+		id, data, position string
+		enveloped          bool
+	}{
+		{"enveloped", "a", "0/0", true},
+		{"", "raw", "1/0", false},
+		{"aggregated", "b", "2/0", true},
+		{"", "c", "2/1", false},
+	}
+	for i, w := range want {
+		m := got[i]
+		position := fmt.Sprintf("%s/%d", m.SequenceNumber, m.SubSequenceNumber)
+		if m.ID != w.id || string(m.Data) != w.data || position != w.position || m.Enveloped != w.enveloped || m.ShardID != "in 1" {
+			t.Errorf("message %d: expected %s %q at %s, was %s %q at %s", i, w.id, w.data, w.position, m.ID, m.Data, position)
+		}
+	}
+}
+
+func TestSubscribeRetriesFailedReads(t *testing.T) {
+	c := relayMock("in 1", "in 2")
+	c.ReadErr(aws.APIError{Code: errThroughputExceeded})
+	c.ReadErr(aws.APIError{Code: "ExpiredIteratorException"})
+	s, err := Subscribe(c, "in", &SubscribeOptions{
+		ShardID:      "in 2",
+		PollInterval: time.Millisecond,
+		Retry:        RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer s.Close()
+	if e := aws.Error(<-s.Errors()); e == nil || e.Code != errThroughputExceeded {
+		t.Errorf("expected the throttling error to be reported, was %v", e)
+	}
+	waitFor(t, "the shard to be read", func() bool { return len(c.iterators()) == 2 })
+	c.Add("in 1", "not subscribed")
+	c.Add("in 2", "subscribed")
+	if m := receive(t, s, 1)[0]; string(m.Data) != "subscribed" {
+		t.Errorf("expected the message of shard in 2, was %q", m.Data)
+	}
+	select {
+	case err := <-s.Errors():
+		t.Errorf("expected the expired iterator to be renewed silently, was %v", err)
+	default:
+	}
+}
+
+func TestSubscribeReportsMissingChildShards(t *testing.T) {
+	c := relayMock("in 1")
+	c.Closed = map[string]bool{"in 1": true}
+	s, err := Subscribe(c, "in", &SubscribeOptions{ShardID: "in 1", PollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer s.Close()
+	if err := <-s.Errors(); err != ErrNoChildShards {
+		t.Errorf("expected %v, was %v", ErrNoChildShards, err)
+	}
+}
+
+func TestSubscribeResumesFromCheckpoint(t *testing.T) {
+	c := relayMock("in 1")
+	checkpoints := NewMemoryCheckpointStore()
+	opts := &SubscribeOptions{PollInterval: time.Millisecond, Checkpoints: checkpoints}
+	s, err := Subscribe(c, "in", opts)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	waitFor(t, "the shard to be read", func() bool { return len(c.iterators()) == 1 })
+	c.Add("in 1", "a")
+	receive(t, s, 1)
+	waitFor(t, "the checkpoint", func() bool {
+		seq, _ := checkpoints.Checkpoint("in", "in 1")
+		return seq == "0"
+	})
+	s.Close()
+
+	c.Add("in 1", "b")
+	if s, err = Subscribe(c, "in", opts); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer s.Close()
+	if m := receive(t, s, 1)[0]; string(m.Data) != "b" {
+		t.Errorf("expected to resume with b, was %q", m.Data)
+	}
+}
+
+func TestSubscribeReportsUnsupportedEnvelopes(t *testing.T) {
+	c := relayMock("in 1")
+	s, err := Subscribe(c, "in", &SubscribeOptions{PollInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer s.Close()
+	waitFor(t, "the shard to be read", func() bool { return len(c.iterators()) == 1 })
+	future, _ := Wrap(&Message{Data: []byte("future")})
+	future[len(envelopeMagic)] = EnvelopeVersion + 1
+	c.Add("in 1", string(future))
+	c.Add("in 1", "next")
+	if err := <-s.Errors(); err != ErrUnsupportedEnvelope {
+		t.Errorf("expected %v, was %v", ErrUnsupportedEnvelope, err)
+	}
+	if m := receive(t, s, 1)[0]; string(m.Data) != "next" {
+		t.Errorf("expected the next message, was %q", m.Data)
+	}
+}
+
+func TestSubscribeNoOpenShards(t *testing.T) {
+	if _, err := Subscribe(relayMock(), "in", nil); err != ErrNoOpenShards {
+		t.Errorf("expected %v, was %v", ErrNoOpenShards, err)
+	}
+}
+
+// TestSubscriptionReadsThroughInjectedFaults reads a shard through a Kinesis that throttles, fails, drops
+// connections and expires iterators at random, and checks that every message still arrives once and in order.
+func TestSubscriptionReadsThroughInjectedFaults(t *testing.T) {
+	k := kinesisfake.New()
+	if _, err := k.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String("in"), ShardCount: aws.Long(2)}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	const n = 50
+	for i := 0; i < n; i++ {
+		if _, err := PutRecord(k, &kinesis.PutRecordInput{StreamName: aws.String("in"), Data: []byte(fmt.Sprint(i))}); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	in := kinesisfault.New(kinesisfault.Config{Seed: 1, Throttle: 0.1, ServerError: 0.1, Drop: 0.1, ExpireIterator: 0.2})
+	opts := &SubscribeOptions{
+		ShardID:      "shardId-000000000001",
+		Start:        TrimHorizon,
+		PollInterval: time.Millisecond,
+		Limit:        3,
+		Retry:        RetryPolicy{BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	}
+	s, err := Subscribe(in.Wrap(k), "in", opts)
+	for err != nil {
+		// Finding the shard can fail too.
+		s, err = Subscribe(in.Wrap(k), "in", opts)
+	}
+	defer s.Close()
+	for i, m := range receive(t, s, n) {
+		if string(m.Data) != fmt.Sprint(i) {
+			t.Fatalf("expected message %d, was %q", i, m.Data)
+		}
+	}
+	select {
+	case m := <-s.Messages():
+		t.Errorf("unexpected message %q", m.Data)
+	case <-time.After(20 * time.Millisecond):
+	}
+	stats := in.Stats()
+	if stats.Throttled == 0 || stats.ServerErrors == 0 || stats.Dropped == 0 || stats.ExpiredIterators == 0 {
+		t.Errorf("expected every kind of fault to be injected, were %+v", stats)
+	}
+}
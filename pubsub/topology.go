@@ -0,0 +1,122 @@
+package pubsub
+
+import (
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"sync"
+	"time"
+)
+
+// DefaultShardCacheTTL is how long a ShardCache reuses a stream's shard list when its TTL is zero.
+const DefaultShardCacheTTL = time.Minute
+
+// ShardCache keeps the shard list of each stream it is asked about so that publishers do not page through
+// DescribeStream, which has a very low account-wide limit, on every call. A stream's entry expires after TTL.
+// Concurrent lookups of a missing or expired stream share a single DescribeStream refresh.
+//
+// A ShardCache is safe for concurrent use and is meant to be long-lived and shared by every publisher.
+type ShardCache struct {
+	// TTL is how long a stream's shard list is reused before it is described again.
+	TTL time.Duration
+	// Clock is the time source; nil uses the system clock.
+	Clock Clock
+
+	mu      sync.Mutex
+	streams map[string]*shardCacheEntry
+}
+
+// shardCacheEntry is the cached topology of a single stream.
+type shardCacheEntry struct {
+	shards  []*kinesis.Shard
+	expires time.Time
+	// refresh is the DescribeStream call currently in flight for the stream, if any.
+	refresh *shardRefresh
+}
+
+// shardRefresh is a DescribeStream call that any number of goroutines can wait on.
+type shardRefresh struct {
+	done   chan struct{}
+	shards []*kinesis.Shard
+	err    error
+}
+
+// NewShardCache creates a ShardCache whose entries expire after ttl.
+func NewShardCache(ttl time.Duration) *ShardCache {
+	return &ShardCache{TTL: ttl}
+}
+
+// Shards returns the shards of a stream, describing the stream only when it is not cached or has expired.
+func (sc *ShardCache) Shards(c kinesisDescribeStream, stream string) ([]*kinesis.Shard, error) {
+	return sc.lookup(c, stream, false)
+}
+
+// Refresh describes a stream again regardless of its expiry and returns the new shard list. If a refresh of the
+// stream is already in flight its result is shared instead of starting another one.
+func (sc *ShardCache) Refresh(c kinesisDescribeStream, stream string) ([]*kinesis.Shard, error) {
+	return sc.lookup(c, stream, true)
+}
+
+// Invalidate drops a stream from the cache so that the next lookup describes it again. A refresh already in
+// flight still answers those waiting on it, but its result is not cached.
+func (sc *ShardCache) Invalidate(stream string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	delete(sc.streams, stream)
+}
+
+func (sc *ShardCache) lookup(c kinesisDescribeStream, stream string, force bool) ([]*kinesis.Shard, error) {
+	sc.mu.Lock()
+	if sc.streams == nil {
+		sc.streams = make(map[string]*shardCacheEntry)
+	}
+	e, ok := sc.streams[stream]
+	if !ok {
+		e = &shardCacheEntry{}
+		sc.streams[stream] = e
+	}
+	if !force && e.shards != nil && sc.clock().Before(e.expires) {
+		s := e.shards
+		sc.mu.Unlock()
+		return s, nil
+	}
+	r := e.refresh
+	if r != nil {
+		sc.mu.Unlock()
+		<-r.done
+		return r.shards, r.err
+	}
+	r = &shardRefresh{done: make(chan struct{})}
+	e.refresh = r
+	sc.mu.Unlock()
+
+	sc.describe(c, stream, e, r)
+	return r.shards, r.err
+}
+
+// describe runs a refresh and publishes its result to the entry and every waiter. An entry dropped by
+// Invalidate meanwhile is no longer in streams, so the result it is given is never looked up.
+func (sc *ShardCache) describe(c kinesisDescribeStream, stream string, e *shardCacheEntry, r *shardRefresh) {
+	r.shards, r.err = gatherShards(c, &stream)
+
+	sc.mu.Lock()
+	if r.err == nil {
+		e.shards = r.shards
+		e.expires = sc.clock().Add(sc.ttl())
+	}
+	e.refresh = nil
+	sc.mu.Unlock()
+	close(r.done)
+}
+
+func (sc *ShardCache) ttl() time.Duration {
+	if sc.TTL <= 0 {
+		return DefaultShardCacheTTL
+	}
+	return sc.TTL
+}
+
+func (sc *ShardCache) clock() time.Time {
+	if sc.Clock == nil {
+		return time.Now()
+	}
+	return sc.Clock.Now()
+}
@@ -0,0 +1,291 @@
+package pubsub
+
+import (
+	"github.com/awslabs/aws-sdk-go/aws"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// kinesisTopologyMock describes a stream as a single page holding Shards and routes PutRecords entries to the
+// shard ID listed for their explicit hash key in Routes. Entries for a key in Reject are throttled that many times.
+type kinesisTopologyMock struct {
+	mu        sync.Mutex
+	Shards    []*kinesis.Shard
+	Routes    map[string]string
+	Reject    map[string]int
+	Err       error
+	PutErr    error
+	Describes int
+	Puts      []*kinesis.PutRecordsInput
+	// Entered and Release, when set, let a test hold DescribeStream calls open.
+	Entered chan bool
+	Release chan bool
+}
+
+func (c *kinesisTopologyMock) DescribeStream(input *kinesis.DescribeStreamInput) (*kinesis.DescribeStreamOutput, error) {
+	c.mu.Lock()
+	c.Describes++
+	c.mu.Unlock()
+	if c.Entered != nil {
+		c.Entered <- true
+		<-c.Release
+	}
+	if c.Err != nil {
+		return nil, c.Err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	more := false
+	return &kinesis.DescribeStreamOutput{StreamDescription: &kinesis.StreamDescription{
+		HasMoreShards: &more,
+		Shards:        c.Shards,
+		StreamName:    input.StreamName,
+	}}, nil
+}
+
+func (c *kinesisTopologyMock) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Puts = append(c.Puts, input)
+	if c.PutErr != nil {
+		return nil, c.PutErr
+	}
+	var out kinesis.PutRecordsOutput
+	for _, e := range input.Records {
+		if c.Reject[*e.ExplicitHashKey] > 0 {
+			c.Reject[*e.ExplicitHashKey]--
+			code := errThroughputExceeded
+			out.Records = append(out.Records, &kinesis.PutRecordsResultEntry{ErrorCode: &code})
+			continue
+		}
+		id := c.Routes[*e.ExplicitHashKey]
+		seq := "1"
+		out.Records = append(out.Records, &kinesis.PutRecordsResultEntry{ShardID: &id, SequenceNumber: &seq})
+	}
+	return &out, nil
+}
+
+func (c *kinesisTopologyMock) SetShards(shards ...*kinesis.Shard) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Shards = shards
+}
+
+func testShard(id, key string) *kinesis.Shard {
+	return &kinesis.Shard{ShardID: &id, HashKeyRange: &kinesis.HashKeyRange{StartingHashKey: &key, EndingHashKey: &key}}
+}
+
+func TestShardCacheReusesTopology(t *testing.T) {
+	c := kinesisTopologyMock{Shards: []*kinesis.Shard{testShard("shard ID 1", "1")}}
+	sc := NewShardCache(time.Minute)
+	for i := 0; i < 3; i++ {
+		s, err := sc.Shards(&c, "stream name")
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if len(s) != 1 || *s[0].ShardID != "shard ID 1" {
+			t.Errorf("unexpected shards %v", s)
+		}
+	}
+	if c.Describes != 1 {
+		t.Errorf("expected 1 DescribeStream call, was %d", c.Describes)
+	}
+}
+
+func TestShardCacheExpires(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	c := kinesisTopologyMock{Shards: []*kinesis.Shard{testShard("shard ID 1", "1")}}
+	sc := NewShardCache(time.Minute)
+	sc.Clock = clock
+	sc.Shards(&c, "stream name")
+	clock.Advance(59 * time.Second)
+	sc.Shards(&c, "stream name")
+	if c.Describes != 1 {
+		t.Errorf("expected 1 DescribeStream call before expiry, was %d", c.Describes)
+	}
+	clock.Advance(time.Second)
+	sc.Shards(&c, "stream name")
+	if c.Describes != 2 {
+		t.Errorf("expected 2 DescribeStream calls after expiry, was %d", c.Describes)
+	}
+}
+
+func TestShardCacheRefreshAndInvalidate(t *testing.T) {
+	c := kinesisTopologyMock{Shards: []*kinesis.Shard{testShard("shard ID 1", "1")}}
+	sc := NewShardCache(time.Hour)
+	sc.Shards(&c, "stream name")
+	c.SetShards(testShard("shard ID 2", "2"))
+	s, err := sc.Refresh(&c, "stream name")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if *s[0].ShardID != "shard ID 2" {
+		t.Errorf("expected refreshed shard ID 2, was %v", *s[0].ShardID)
+	}
+	sc.Invalidate("stream name")
+	sc.Shards(&c, "stream name")
+	if c.Describes != 3 {
+		t.Errorf("expected 3 DescribeStream calls, was %d", c.Describes)
+	}
+}
+
+func TestShardCacheSharesInFlightRefresh(t *testing.T) {
+	c := kinesisTopologyMock{
+		Shards:  []*kinesis.Shard{testShard("shard ID 1", "1")},
+		Entered: make(chan bool, 1),
+		Release: make(chan bool),
+	}
+	sc := NewShardCache(time.Minute)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if s, err := sc.Shards(&c, "stream name"); err != nil || len(s) != 1 {
+				t.Errorf("unexpected result %v, %v", s, err)
+			}
+		}()
+	}
+	<-c.Entered
+	time.Sleep(10 * time.Millisecond)
+	close(c.Release)
+	wg.Wait()
+	if c.Describes != 1 {
+		t.Errorf("expected 1 DescribeStream call, was %d", c.Describes)
+	}
+}
+
+func TestShardCacheInvalidateDiscardsInFlightRefresh(t *testing.T) {
+	c := kinesisTopologyMock{
+		Shards:  []*kinesis.Shard{testShard("shard ID 1", "1")},
+		Entered: make(chan bool, 1),
+		Release: make(chan bool, 1),
+	}
+	sc := NewShardCache(time.Hour)
+	done := make(chan bool)
+	go func() {
+		sc.Shards(&c, "stream name")
+		done <- true
+	}()
+	<-c.Entered
+	sc.Invalidate("stream name")
+	c.Release <- true
+	<-done
+
+	c.SetShards(testShard("shard ID 2", "2"))
+	c.Release <- true
+	s, err := sc.Shards(&c, "stream name")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if c.Describes != 2 || len(s) != 1 || *s[0].ShardID != "shard ID 2" {
+		t.Errorf("expected the invalidated refresh not to be cached, was %d DescribeStream calls and %v", c.Describes, s)
+	}
+}
+
+func TestPutRecordWithOptionsRefreshesAfterReshard(t *testing.T) {
+	c := kinesisTopologyMock{
+		Shards: []*kinesis.Shard{testShard("shard ID 1", "1"), testShard("shard ID 2", "2")},
+		Routes: map[string]string{"1": "shard ID 1", "2": "shard ID 2"},
+	}
+	opts := Options{Shards: NewShardCache(time.Hour)}
+	stream := "stream name"
+	input := kinesis.PutRecordInput{Data: []byte("blob payload"), StreamName: &stream}
+	if _, err := PutRecordWithOptions(&c, &input, &opts); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// Shard 2 is split into shards 3 and 4; the cached key "2" now routes to shard 3.
+	c.SetShards(testShard("shard ID 1", "1"), testShard("shard ID 3", "2"), testShard("shard ID 4", "3"))
+	c.Routes["2"] = "shard ID 3"
+	c.Routes["3"] = "shard ID 4"
+	result, err := PutRecordWithOptions(&c, &input, &opts)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if c.Describes != 2 {
+		t.Errorf("expected 2 DescribeStream calls, was %d", c.Describes)
+	}
+	got := map[string]bool{}
+	for _, r := range result.Delivered {
+		got[*r.ShardID] = true
+	}
+	for _, id := range []string{"shard ID 1", "shard ID 3", "shard ID 4"} {
+		if !got[id] {
+			t.Errorf("expected delivery to %s, was %v", id, got)
+		}
+	}
+	if last := c.Puts[len(c.Puts)-1].Records; len(last) != 1 || *last[0].ExplicitHashKey != "3" {
+		t.Errorf("expected only the new shard to be sent to after the refresh, was %v", last)
+	}
+}
+
+func TestPutRecordWithOptionsMergesFailuresAfterReshard(t *testing.T) {
+	closed := func(s *kinesis.Shard) *kinesis.Shard {
+		end := "2"
+		s.SequenceNumberRange = &kinesis.SequenceNumberRange{EndingSequenceNumber: &end}
+		return s
+	}
+	for _, test := range []struct {
+		rejects int
+		failed  []string
+		err     error
+	}{
+		// The failure on the closed shard 2 is dropped once its child shard 4 accepts the record.
+		{1, nil, nil},
+		{2, []string{"shard ID 4"}, ErrPartialFailure},
+	} {
+		c := kinesisTopologyMock{
+			Shards: []*kinesis.Shard{testShard("shard ID 1", "1"), testShard("shard ID 2", "2")},
+			Routes: map[string]string{"1": "shard ID 1", "2": "shard ID 2"},
+		}
+		opts := Options{Shards: NewShardCache(time.Hour), Retry: RetryPolicy{MaxAttempts: 1}}
+		stream := "stream name"
+		input := kinesis.PutRecordInput{Data: []byte("blob payload"), StreamName: &stream}
+		if _, err := PutRecordWithOptions(&c, &input, &opts); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		// A reshard closes shards 1 and 2 and hands their ranges to shards 3 and 4. The first send lands on the
+		// unknown shard 3, which sets off a refresh, and is throttled on shard 2.
+		c.SetShards(closed(testShard("shard ID 1", "1")), closed(testShard("shard ID 2", "2")),
+			testShard("shard ID 3", "1"), testShard("shard ID 4", "2"))
+		c.Routes = map[string]string{"1": "shard ID 3", "2": "shard ID 4"}
+		c.Reject = map[string]int{"2": test.rejects}
+		result, err := PutRecordWithOptions(&c, &input, &opts)
+		if err != test.err {
+			t.Errorf("expected error %v, was %v", test.err, err)
+		}
+		var failed []string
+		for _, f := range result.Failed {
+			failed = append(failed, f.ShardID)
+		}
+		if !reflect.DeepEqual(failed, test.failed) {
+			t.Errorf("expected failures on %v, were on %v", test.failed, failed)
+		}
+	}
+}
+
+func TestPutRecordWithOptionsInvalidatesMissingStream(t *testing.T) {
+	c := kinesisTopologyMock{
+		Shards: []*kinesis.Shard{testShard("shard ID 1", "1")},
+		Routes: map[string]string{"1": "shard ID 1"},
+		PutErr: aws.APIError{Code: "ResourceNotFoundException"},
+	}
+	opts := Options{Shards: NewShardCache(time.Hour)}
+	stream := "stream name"
+	input := kinesis.PutRecordInput{Data: []byte("blob payload"), StreamName: &stream}
+	if _, err := PutRecordWithOptions(&c, &input, &opts); err != c.PutErr {
+		t.Errorf("expected error %v, was %v", c.PutErr, err)
+	}
+	c.PutErr = nil
+	if _, err := PutRecordWithOptions(&c, &input, &opts); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if c.Describes != 2 {
+		t.Errorf("expected 2 DescribeStream calls, was %d", c.Describes)
+	}
+}
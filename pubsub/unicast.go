@@ -0,0 +1,80 @@
+package pubsub
+
+import (
+	"crypto/md5"
+	"fmt"
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"math/big"
+)
+
+// Unicaster publishes each message to a single shard of a stream, the one Kinesis routes its partition key to,
+// for a consumer Group to share out between its members. It is the counterpart of the broadcasting PutRecord and
+// Publisher: messages with the same key land on the same shard, in the order they were published.
+type Unicaster struct {
+	c      kinesisPubSub
+	stream string
+	opts   *Options
+}
+
+// NewUnicaster returns a Unicaster publishing to stream through c. Of opts, Retry, PublisherID and, to keep
+// within the write limits of the shard each key maps to, Limiter apply; a nil opts uses the defaults. A Limiter
+// needs the stream's shards, so pair it with a ShardCache.
+func NewUnicaster(c kinesisPubSub, stream string, opts *Options) *Unicaster {
+	if opts == nil {
+		opts = &Options{}
+	}
+	return &Unicaster{c: c, stream: stream, opts: opts}
+}
+
+// Publish sends data to the shard of key, retrying while the shard is throttled. The result holds the entry of
+// the shard that accepted it or, with ErrPartialFailure, the failure of the last attempt.
+func (u *Unicaster) Publish(key string, data []byte) (*PutRecordResult, error) {
+	if !validPartitionKey(key) {
+		return nil, ErrInvalidPartitionKey
+	}
+	entry := &kinesis.PutRecordsRequestEntry{Data: data, PartitionKey: &key}
+	var shardIDs map[string]string
+	if u.opts.Limiter != nil {
+		shards, err := u.opts.shards(u.c, &u.stream)
+		if err != nil {
+			return nil, err
+		}
+		hashKey := partitionKeyHash(key)
+		for _, s := range shards {
+			r, err := parseHashKeyRange(s)
+			if err != nil {
+				return nil, err
+			}
+			if r.contains(hashKey) {
+				// The hash key Kinesis would derive from the partition key, made explicit so the limiter can
+				// tell which shard the entry is for.
+				k := hashKey.String()
+				entry.ExplicitHashKey = &k
+				shardIDs = map[string]string{k: *s.ShardID}
+				break
+			}
+		}
+		if shardIDs == nil {
+			return nil, fmt.Errorf("no open shard of %s covers partition key %q", u.stream, key)
+		}
+	}
+	input := &kinesis.PutRecordsInput{Records: []*kinesis.PutRecordsRequestEntry{entry}, StreamName: &u.stream}
+	results, err := putRecordsWithRetry(u.c, input, nil, 1, shardIDs, u.opts)
+	return results[0], err
+}
+
+// PublishMessage wraps m in an envelope and sends it like Publish. The ID and timestamp given to the message are
+// left on m.
+func (u *Unicaster) PublishMessage(key string, m *Message) (*PutRecordResult, error) {
+	data, err := u.opts.wrap(m)
+	if err != nil {
+		return nil, err
+	}
+	return u.Publish(key, data)
+}
+
+// partitionKeyHash is the hash key Kinesis maps a partition key to: its MD5 digest read as a 128-bit integer.
+func partitionKeyHash(key string) *big.Int {
+	sum := md5.Sum([]byte(key))
+	return new(big.Int).SetBytes(sum[:])
+}
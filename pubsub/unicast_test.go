@@ -0,0 +1,111 @@
+package pubsub
+
+import (
+	"github.com/awslabs/aws-sdk-go/service/kinesis"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// kinesisUnicastMock throttles the first Throttle entries it is sent and accepts the others on "shard ID 1".
+type kinesisUnicastMock struct {
+	kinesisDescribeStreamMock
+	Throttle int
+	Requests []*kinesis.PutRecordsInput
+}
+
+func (c *kinesisUnicastMock) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	c.Requests = append(c.Requests, input)
+	var out kinesis.PutRecordsOutput
+	for range input.Records {
+		if c.Throttle > 0 {
+			c.Throttle--
+			code := errThroughputExceeded
+			out.Records = append(out.Records, &kinesis.PutRecordsResultEntry{ErrorCode: &code})
+			continue
+		}
+		id, seq := "shard ID 1", "1"
+		out.Records = append(out.Records, &kinesis.PutRecordsResultEntry{ShardID: &id, SequenceNumber: &seq})
+	}
+	return &out, nil
+}
+
+func TestUnicasterPublish(t *testing.T) {
+	slept := stubSleep()
+	defer restoreSleep()
+	c := &kinesisUnicastMock{Throttle: 2}
+	u := NewUnicaster(c, "stream name", nil)
+	result, err := u.Publish("user 7", []byte("data"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(c.Requests) != 3 || len(*slept) != 2 {
+		t.Errorf("expected 2 throttled attempts before the record was accepted, was %d requests", len(c.Requests))
+	}
+	for _, r := range c.Requests {
+		e := r.Records[0]
+		if len(r.Records) != 1 || *r.StreamName != "stream name" || *e.PartitionKey != "user 7" || e.ExplicitHashKey != nil || string(e.Data) != "data" {
+			t.Errorf("expected a single entry routed by its partition key, was %v", r)
+		}
+	}
+	if len(result.Delivered) != 1 || *result.Delivered[0].ShardID != "shard ID 1" || result.Attempts != 3 {
+		t.Errorf("unexpected result %v", result)
+	}
+
+	c.Throttle = 5
+	if result, err = u.Publish("user 7", []byte("data")); err != ErrPartialFailure || len(result.Failed) != 1 {
+		t.Errorf("expected ErrPartialFailure once the attempts run out, was %v, %v", result, err)
+	}
+}
+
+func TestUnicasterInvalidKey(t *testing.T) {
+	c := &kinesisUnicastMock{}
+	u := NewUnicaster(c, "stream name", nil)
+	for _, key := range []string{"", strings.Repeat("k", MaxPartitionKeyLength+1)} {
+		if _, err := u.Publish(key, []byte("data")); err != ErrInvalidPartitionKey {
+			t.Errorf("expected ErrInvalidPartitionKey for a key of %d characters, was %v", len(key), err)
+		}
+	}
+	if len(c.Requests) != 0 {
+		t.Errorf("expected nothing to be sent, was %v", c.Requests)
+	}
+}
+
+func TestUnicasterPublishMessage(t *testing.T) {
+	c := &kinesisUnicastMock{}
+	u := NewUnicaster(c, "stream name", &Options{PublisherID: "publisher"})
+	m := &Message{Data: []byte("data")}
+	if _, err := u.PublishMessage("user 7", m); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	got, err := Unwrap(c.Requests[0].Records[0].Data)
+	if err != nil || !got.Enveloped || got.ID != m.ID || got.PublisherID != "publisher" || string(got.Data) != "data" {
+		t.Errorf("expected the enveloped message, was %+v, %v", got, err)
+	}
+}
+
+func TestUnicasterLimiterRoutes(t *testing.T) {
+	half := new(big.Int).Lsh(big.NewInt(1), 127)
+	low, high := testShard("shard ID 1", "0"), testShard("shard ID 2", half.String())
+	lowEnd, highEnd := new(big.Int).Sub(half, big.NewInt(1)).String(), new(big.Int).Sub(new(big.Int).Lsh(half, 1), big.NewInt(1)).String()
+	low.HashKeyRange.EndingHashKey, high.HashKeyRange.EndingHashKey = &lowEnd, &highEnd
+	c := &kinesisUnicastMock{kinesisDescribeStreamMock: kinesisDescribeStreamMock{Shards: [][]*kinesis.Shard{{low, high}}}}
+	limiter := NewShardLimiter(Block)
+	u := NewUnicaster(c, "stream name", &Options{Limiter: limiter})
+	if _, err := u.Publish("user 7", []byte("data")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	want := partitionKeyHash("user 7")
+	e := c.Requests[0].Records[0]
+	if e.ExplicitHashKey == nil || *e.ExplicitHashKey != want.String() {
+		t.Errorf("expected the explicit hash key %s Kinesis derives from the partition key, was %v", want, e.ExplicitHashKey)
+	}
+}
+
+func TestPartitionKeyHash(t *testing.T) {
+	// The MD5 digest of the empty string is d41d8cd98f00b204e9800998ecf8427e.
+	want, _ := new(big.Int).SetString("d41d8cd98f00b204e9800998ecf8427e", 16)
+	if got := partitionKeyHash(""); got.Cmp(want) != 0 {
+		t.Errorf("expected %s, was %s", want, got)
+	}
+}